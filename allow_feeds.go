@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Published ranges of cloud providers and crawlers which we never block
+type AllowFeedConfiguration struct {
+	// Used in logs and lookup
+	Name string `json:"name"`
+
+	// aws for ip-ranges.json, gcp for cloud.json, azure for Service Tags and googlebot for googlebot.json, goog.json and other files in same format
+	Format string `json:"format"`
+
+	// Local file, please download it with cron
+	Path string `json:"path"`
+
+	// We use only entries for these services and regions, all entries when lists are empty
+	Services []string `json:"services"`
+	Regions  []string `json:"regions"`
+}
+
+var allow_feed_formats = []string{"aws", "gcp", "azure", "googlebot"}
+
+// Single network from allow feed
+type AllowFeedEntry struct {
+	Prefix  netip.Prefix
+	Service string
+	Region  string
+}
+
+// https://docs.aws.amazon.com/vpc/latest/userguide/aws-ip-ranges.html
+type AWSIPRanges struct {
+	Prefixes []struct {
+		IPPrefix string `json:"ip_prefix"`
+		Region   string `json:"region"`
+		Service  string `json:"service"`
+	} `json:"prefixes"`
+}
+
+// https://www.gstatic.com/ipranges/cloud.json, Googlebot and other Google files have only prefixes
+type GoogleIPRanges struct {
+	Prefixes []struct {
+		IPv4Prefix string `json:"ipv4Prefix"`
+		Service    string `json:"service"`
+		Scope      string `json:"scope"`
+	} `json:"prefixes"`
+}
+
+// https://www.microsoft.com/en-us/download/details.aspx?id=56519
+type AzureServiceTags struct {
+	Values []struct {
+		Name       string `json:"name"`
+		Properties struct {
+			Region          string   `json:"region"`
+			SystemService   string   `json:"systemService"`
+			AddressPrefixes []string `json:"addressPrefixes"`
+		} `json:"properties"`
+	} `json:"values"`
+}
+
+func validate_allow_feeds(feeds []AllowFeedConfiguration) error {
+	names := []string{}
+
+	for index, feed := range feeds {
+		if feed.Name == "" {
+			return fmt.Errorf("Allow feed %d does not have name", index)
+		}
+
+		if slices.Contains(names, feed.Name) {
+			return fmt.Errorf("We have multiple allow feeds with name %s", feed.Name)
+		}
+
+		names = append(names, feed.Name)
+
+		if !slices.Contains(allow_feed_formats, feed.Format) {
+			return fmt.Errorf("Unknown format %s for allow feed %s, please use one of %v", feed.Format, feed.Name, allow_feed_formats)
+		}
+
+		if feed.Path == "" {
+			return fmt.Errorf("Path for allow feed %s is not set", feed.Name)
+		}
+
+		if feed.Format == "googlebot" && (len(feed.Services) > 0 || len(feed.Regions) > 0) {
+			return fmt.Errorf("Allow feed %s in googlebot format does not have services and regions", feed.Name)
+		}
+	}
+
+	return nil
+}
+
+// Reads all entries from file in format of feed, we do not filter them here
+func parse_allow_feed_file(feed AllowFeedConfiguration) ([]AllowFeedEntry, error) {
+	feed_as_json, err := os.ReadFile(feed.Path)
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read allow feed %s: %w", feed.Name, err)
+	}
+
+	entries := []AllowFeedEntry{}
+
+	// We have only IPv4 prefixes in these fields, IPv6 are in separate ones
+	add_entry := func(value string, service string, region string) error {
+		if value == "" {
+			return nil
+		}
+
+		prefix, err := netip.ParsePrefix(value)
+
+		if err != nil {
+			return fmt.Errorf("Cannot parse prefix %s: %v", value, err)
+		}
+
+		if prefix.Addr().Is4() {
+			entries = append(entries, AllowFeedEntry{Prefix: prefix.Masked(), Service: service, Region: region})
+		}
+
+		return nil
+	}
+
+	switch feed.Format {
+	case "aws":
+		ranges := AWSIPRanges{}
+
+		err = json.Unmarshal(feed_as_json, &ranges)
+
+		if err != nil {
+			break
+		}
+
+		for _, prefix := range ranges.Prefixes {
+			err = add_entry(prefix.IPPrefix, prefix.Service, prefix.Region)
+
+			if err != nil {
+				break
+			}
+		}
+	case "gcp", "googlebot":
+		ranges := GoogleIPRanges{}
+
+		err = json.Unmarshal(feed_as_json, &ranges)
+
+		if err != nil {
+			break
+		}
+
+		for _, prefix := range ranges.Prefixes {
+			err = add_entry(prefix.IPv4Prefix, prefix.Service, prefix.Scope)
+
+			if err != nil {
+				break
+			}
+		}
+	case "azure":
+		service_tags := AzureServiceTags{}
+
+		err = json.Unmarshal(feed_as_json, &service_tags)
+
+		if err != nil {
+			break
+		}
+
+		for _, value := range service_tags.Values {
+			// Tags like AzureCloud.eastus do not have system service and we use name of tag for them
+			service := value.Properties.SystemService
+
+			if service == "" {
+				service, _, _ = strings.Cut(value.Name, ".")
+			}
+
+			for _, address_prefix := range value.Properties.AddressPrefixes {
+				err = add_entry(address_prefix, service, value.Properties.Region)
+
+				if err != nil {
+					break
+				}
+			}
+
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse allow feed %s: %w", feed.Name, err)
+	}
+
+	return entries, nil
+}
+
+// Checks value against filter from configuration, empty filter matches everything
+func matches_allow_feed_filter(filter []string, value string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+
+	for _, filter_value := range filter {
+		if strings.EqualFold(filter_value, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Reads allow feed and keeps only entries for configured services and regions
+func load_allow_feed(feed AllowFeedConfiguration) ([]AllowFeedEntry, error) {
+	all_entries, err := parse_allow_feed_file(feed)
+
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []AllowFeedEntry{}
+
+	for _, entry := range all_entries {
+		if !matches_allow_feed_filter(feed.Services, entry.Service) || !matches_allow_feed_filter(feed.Regions, entry.Region) {
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	slog.Info("Loaded allow feed", "name", feed.Name, "path", feed.Path, "prefixes", len(entries), "filtered_out", len(all_entries)-len(entries))
+
+	if len(entries) == 0 {
+		slog.Warn("Allow feed does not have prefixes, please check services and regions", "name", feed.Name)
+	}
+
+	return entries, nil
+}
+
+// Loads all configured allow feeds, we stop on any error to avoid blocking of services because of broken file
+func load_allow_feeds(feeds []AllowFeedConfiguration) (map[string][]AllowFeedEntry, error) {
+	entries_by_feed := make(map[string][]AllowFeedEntry)
+
+	for _, feed := range feeds {
+		entries, err := load_allow_feed(feed)
+
+		if err != nil {
+			return nil, err
+		}
+
+		entries_by_feed[feed.Name] = entries
+	}
+
+	return entries_by_feed, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func get_allow_feed_prefixes(t *testing.T, feed AllowFeedConfiguration) []netip.Prefix {
+	t.Helper()
+
+	entries, err := load_allow_feed(feed)
+
+	if err != nil {
+		t.Fatalf("Cannot load allow feed %s: %v", feed.Name, err)
+	}
+
+	prefixes := []netip.Prefix{}
+
+	for _, entry := range entries {
+		prefixes = append(prefixes, entry.Prefix)
+	}
+
+	return prefixes
+}
+
+func TestLoadAllowFeeds(t *testing.T) {
+	aws_path := write_test_feed(t, `{
+  "syncToken": "1792317600",
+  "prefixes": [
+    {"ip_prefix": "10.0.0.0/24", "region": "us-east-1", "service": "AMAZON", "network_border_group": "us-east-1"},
+    {"ip_prefix": "10.0.1.0/24", "region": "eu-west-1", "service": "CLOUDFRONT", "network_border_group": "eu-west-1"},
+    {"ip_prefix": "10.0.2.0/24", "region": "us-east-1", "service": "EC2", "network_border_group": "us-east-1"}
+  ],
+  "ipv6_prefixes": [
+    {"ipv6_prefix": "2001:db8::/32", "region": "us-east-1", "service": "AMAZON", "network_border_group": "us-east-1"}
+  ]
+}`)
+
+	gcp_path := write_test_feed(t, `{
+  "syncToken": "1792317600",
+  "prefixes": [
+    {"ipv4Prefix": "10.1.0.0/24", "service": "Google Cloud", "scope": "europe-west1"},
+    {"ipv6Prefix": "2001:db8::/32", "service": "Google Cloud", "scope": "europe-west1"},
+    {"ipv4Prefix": "10.1.1.0/24", "service": "Google Cloud", "scope": "us-central1"}
+  ]
+}`)
+
+	googlebot_path := write_test_feed(t, `{
+  "creationTime": "2026-10-18T10:00:00.000000",
+  "prefixes": [
+    {"ipv4Prefix": "10.2.0.0/27"},
+    {"ipv6Prefix": "2001:db8::/64"}
+  ]
+}`)
+
+	azure_path := write_test_feed(t, `{
+  "changeNumber": 1,
+  "cloud": "Public",
+  "values": [
+    {"name": "AzureCloud.eastus", "properties": {"region": "eastus", "systemService": "", "addressPrefixes": ["10.3.0.0/24", "2001:db8::/32"]}},
+    {"name": "AzureFrontDoor.Frontend", "properties": {"region": "", "systemService": "AzureFrontDoor", "addressPrefixes": ["10.3.1.0/24"]}}
+  ]
+}`)
+
+	feeds := []struct {
+		feed     AllowFeedConfiguration
+		expected []netip.Prefix
+	}{
+		{AllowFeedConfiguration{Name: "aws", Format: "aws", Path: aws_path},
+			[]netip.Prefix{netip.MustParsePrefix("10.0.0.0/24"), netip.MustParsePrefix("10.0.1.0/24"), netip.MustParsePrefix("10.0.2.0/24")}},
+		// Filters do not depend on case
+		{AllowFeedConfiguration{Name: "aws", Format: "aws", Path: aws_path, Services: []string{"ec2", "CLOUDFRONT"}, Regions: []string{"us-east-1"}},
+			[]netip.Prefix{netip.MustParsePrefix("10.0.2.0/24")}},
+		{AllowFeedConfiguration{Name: "gcp", Format: "gcp", Path: gcp_path, Regions: []string{"europe-west1"}},
+			[]netip.Prefix{netip.MustParsePrefix("10.1.0.0/24")}},
+		{AllowFeedConfiguration{Name: "googlebot", Format: "googlebot", Path: googlebot_path},
+			[]netip.Prefix{netip.MustParsePrefix("10.2.0.0/27")}},
+		// Tag without system service is filtered by name of tag
+		{AllowFeedConfiguration{Name: "azure", Format: "azure", Path: azure_path, Services: []string{"AzureCloud"}},
+			[]netip.Prefix{netip.MustParsePrefix("10.3.0.0/24")}},
+		{AllowFeedConfiguration{Name: "azure", Format: "azure", Path: azure_path, Services: []string{"AzureFrontDoor"}},
+			[]netip.Prefix{netip.MustParsePrefix("10.3.1.0/24")}},
+		{AllowFeedConfiguration{Name: "azure", Format: "azure", Path: azure_path, Regions: []string{"westeurope"}},
+			[]netip.Prefix{}},
+	}
+
+	for _, feed := range feeds {
+		if prefixes := get_allow_feed_prefixes(t, feed.feed); !slices.Equal(prefixes, feed.expected) {
+			t.Errorf("Unexpected prefixes from %+v: %v, expected %v", feed.feed, prefixes, feed.expected)
+		}
+	}
+}
+
+func TestBrokenAllowFeeds(t *testing.T) {
+	broken_feeds := []AllowFeedConfiguration{
+		{Name: "aws", Format: "aws", Path: write_test_feed(t, `{"prefixes": [{"ip_prefix": "10.0.0.0/33"}]}`)},
+		{Name: "gcp", Format: "gcp", Path: write_test_feed(t, `{"prefixes": `)},
+		{Name: "azure", Format: "azure", Path: write_test_feed(t, `{"values": [{"properties": {"addressPrefixes": ["10.0.0.0"]}}]}`)},
+	}
+
+	for _, feed := range broken_feeds {
+		if _, err := load_allow_feed(feed); err == nil {
+			t.Errorf("We must fail on broken feed %s", feed.Name)
+		}
+	}
+
+	if err := validate_allow_feeds([]AllowFeedConfiguration{{Name: "googlebot", Format: "googlebot", Path: "googlebot.json", Regions: []string{"us"}}}); err == nil {
+		t.Errorf("Googlebot feed does not have regions and we must reject filter")
+	}
+}
@@ -0,0 +1,27 @@
+// Package announcer keeps our routes in BGP speaker, we use gobgpd for it
+package announcer
+
+import (
+	"context"
+	"net/netip"
+)
+
+// Our route in BGP speaker
+type Route struct {
+	Prefix netip.Prefix
+
+	// Route has next hop, communities or other attributes which differ from ones we announce now
+	Outdated bool
+}
+
+// Place where we announce prefixes of block list
+type Announcer interface {
+	// Returns our own routes, Outdated is set when none of our paths for prefix has attributes which we announce now
+	ListAnnounced(ctx context.Context) ([]Route, error)
+
+	// Announces prefix with our attributes and replaces our route with same prefix, we use it to update outdated routes too
+	Announce(ctx context.Context, prefix netip.Prefix) error
+
+	// Withdraws our route for prefix and keeps routes of others
+	Withdraw(ctx context.Context, prefix netip.Prefix) error
+}
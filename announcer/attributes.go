@@ -0,0 +1,93 @@
+package announcer
+
+import (
+	"slices"
+
+	"google.golang.org/protobuf/proto"
+	apb "google.golang.org/protobuf/types/known/anypb"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+)
+
+// Attributes of path which we set and compare with desired ones
+// gobgp may add more attributes to path and we ignore them
+type path_attributes struct {
+	origin   uint32
+	next_hop string
+
+	// Sorted as order does not matter
+	communities []uint32
+
+	route_targets []*apb.Any
+}
+
+// Extracts attributes which we set from path, next hop of VPN path lives in MP_REACH_NLRI
+func parse_path_attributes(pattrs []*apb.Any) path_attributes {
+	attributes := path_attributes{}
+
+	for _, attr := range pattrs {
+		origin := apipb.OriginAttribute{}
+		next_hop := apipb.NextHopAttribute{}
+		mp_reach := apipb.MpReachNLRIAttribute{}
+		communities := apipb.CommunitiesAttribute{}
+		extended_communities := apipb.ExtendedCommunitiesAttribute{}
+
+		switch {
+		case attr.MessageIs(&origin) && attr.UnmarshalTo(&origin) == nil:
+			attributes.origin = origin.Origin
+		case attr.MessageIs(&next_hop) && attr.UnmarshalTo(&next_hop) == nil:
+			attributes.next_hop = next_hop.NextHop
+		case attr.MessageIs(&mp_reach) && attr.UnmarshalTo(&mp_reach) == nil:
+			if len(mp_reach.NextHops) > 0 {
+				attributes.next_hop = mp_reach.NextHops[0]
+			}
+		case attr.MessageIs(&communities) && attr.UnmarshalTo(&communities) == nil:
+			attributes.communities = append([]uint32{}, communities.Communities...)
+			slices.Sort(attributes.communities)
+		case attr.MessageIs(&extended_communities) && attr.UnmarshalTo(&extended_communities) == nil:
+			attributes.route_targets = extended_communities.Communities
+		}
+	}
+
+	return attributes
+}
+
+// Compares attributes, we compare route targets only when we set them ourselves
+func (a path_attributes) equal(b path_attributes, compare_route_targets bool) bool {
+	if a.origin != b.origin || a.next_hop != b.next_hop || !slices.Equal(a.communities, b.communities) {
+		return false
+	}
+
+	if !compare_route_targets {
+		return true
+	}
+
+	if len(a.route_targets) != len(b.route_targets) {
+		return false
+	}
+
+	for _, route_target := range a.route_targets {
+		if !slices.ContainsFunc(b.route_targets, func(other *apb.Any) bool { return is_same_any(route_target, other) }) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Compares content of messages as gobgp may encode same message differently
+func is_same_any(a *apb.Any, b *apb.Any) bool {
+	a_message, err := a.UnmarshalNew()
+
+	if err != nil {
+		return false
+	}
+
+	b_message, err := b.UnmarshalNew()
+
+	if err != nil {
+		return false
+	}
+
+	return proto.Equal(a_message, b_message)
+}
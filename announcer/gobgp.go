@@ -0,0 +1,418 @@
+package announcer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"slices"
+
+	"google.golang.org/protobuf/proto"
+	apb "google.golang.org/protobuf/types/known/anypb"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+)
+
+// BGP attributes which we add to every announce
+type Attributes struct {
+	NextHop netip.Addr
+
+	// Communities encoded as uint32
+	Communities []uint32
+
+	// We add marker community to all our routes and use it to find them in RIB
+	// We use it as path identifier too to keep same prefix from multiple profiles in RIB
+	// Zero means that we own all routes in table
+	Marker uint32
+
+	// We announce into VPN table or VRF when it's set
+	L3VPN *L3VPN
+}
+
+// Route distinguisher and route targets in gobgp API format
+type L3VPN struct {
+	RouteDistinguisher *apb.Any
+	RouteTargets       []*apb.Any
+
+	// MPLS label for our announces
+	Label uint32
+
+	// gobgp adds route distinguisher and route targets from VRF configuration when it's set
+	VRF string
+}
+
+// Announcer which uses gobgpd API
+type GoBGP struct {
+	client     apipb.GobgpApiClient
+	attributes Attributes
+}
+
+func NewGoBGP(client apipb.GobgpApiClient, attributes Attributes) *GoBGP {
+	return &GoBGP{client: client, attributes: attributes}
+}
+
+// Address families where we may have announces
+var address_families = []apipb.Family_Afi{apipb.Family_AFI_IP, apipb.Family_AFI_IP6}
+
+// Returns all active announces with our marker and checks their attributes
+func (g *GoBGP) ListAnnounced(ctx context.Context) ([]Route, error) {
+	announces := []Route{}
+
+	for _, afi := range address_families {
+		family_announces, err := g.list_announced(ctx, afi)
+
+		if err != nil {
+			return nil, err
+		}
+
+		announces = append(announces, family_announces...)
+	}
+
+	return announces, nil
+}
+
+// Returns active announces with our marker in single address family
+func (g *GoBGP) list_announced(ctx context.Context, afi apipb.Family_Afi) ([]Route, error) {
+	l3vpn := g.attributes.L3VPN
+
+	stream, err := g.client.ListPath(ctx, ListPathRequest(l3vpn, afi))
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list path: %w", err)
+	}
+
+	announces := []Route{}
+
+	for {
+		r, err := stream.Recv()
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		// Routes of other profiles
+		owned_paths := OwnedPaths(r.Destination, g.attributes.Marker)
+
+		if len(owned_paths) == 0 {
+			continue
+		}
+
+		prefix_as_string := r.Destination.Prefix
+
+		if l3vpn != nil {
+			vpn_prefix, ok := VPNPrefix(r.Destination, l3vpn.RouteDistinguisher)
+
+			if !ok {
+				continue
+			}
+
+			prefix_as_string = vpn_prefix
+		}
+
+		prefix, err := netip.ParsePrefix(prefix_as_string)
+
+		if err != nil {
+			// Well, we accept some malformed prefixes and do not return error in this case
+			slog.Warn("Cannot parse active announce as prefix", "prefix", prefix_as_string, "error", err)
+			continue
+		}
+
+		outdated, err := g.is_outdated(prefix, owned_paths)
+
+		if err != nil {
+			return nil, err
+		}
+
+		announces = append(announces, Route{Prefix: prefix, Outdated: outdated})
+	}
+
+	return announces, nil
+}
+
+// Checks that none of our paths for prefix has attributes which we announce now
+func (g *GoBGP) is_outdated(prefix netip.Prefix, owned_paths []*apipb.Path) (bool, error) {
+	add_path_request, err := g.build_add_path_request(prefix, false)
+
+	if err != nil {
+		return false, err
+	}
+
+	desired := parse_path_attributes(add_path_request.Path.Pattrs)
+
+	// gobgp adds route targets from VRF configuration and we do not control them
+	compare_route_targets := g.attributes.L3VPN != nil && g.attributes.L3VPN.VRF == ""
+
+	for _, path := range owned_paths {
+		if parse_path_attributes(path.Pattrs).equal(desired, compare_route_targets) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func (g *GoBGP) Announce(ctx context.Context, prefix netip.Prefix) error {
+	return g.add_path(ctx, prefix, false)
+}
+
+func (g *GoBGP) Withdraw(ctx context.Context, prefix netip.Prefix) error {
+	return g.add_path(ctx, prefix, true)
+}
+
+// Announces or withdraws prefix with our attributes
+func (g *GoBGP) add_path(ctx context.Context, prefix netip.Prefix, withdraw bool) error {
+	add_path_request, err := g.build_add_path_request(prefix, withdraw)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = g.client.AddPath(ctx, add_path_request)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Returns request which announces or withdraws prefix in our table
+// gobgp finds path for withdrawal by prefix and identifier and we do not add attributes to withdrawals
+func (g *GoBGP) build_add_path_request(prefix netip.Prefix, withdraw bool) (*apipb.AddPathRequest, error) {
+	nlri, err := apb.New(&apipb.IPAddressPrefix{
+		Prefix:    prefix.Addr().String(),
+		PrefixLen: uint32(prefix.Bits()),
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot create prefix message: %v", err)
+	}
+
+	var attrs []*apb.Any
+
+	if !withdraw {
+		attrs, err = build_path_attributes(g.attributes)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	add_path_request := &apipb.AddPathRequest{
+		Path: &apipb.Path{
+			Family:     &apipb.Family{Afi: AFI(prefix.Addr()), Safi: apipb.Family_SAFI_UNICAST},
+			Nlri:       nlri,
+			Pattrs:     attrs,
+			IsWithdraw: withdraw,
+			Identifier: g.attributes.Marker,
+		}}
+
+	if l3vpn := g.attributes.L3VPN; l3vpn != nil {
+		if l3vpn.VRF != "" {
+			add_path_request.TableType = apipb.TableType_VRF
+			add_path_request.VrfId = l3vpn.VRF
+		} else {
+			vpn_path, err := build_vpn_path(prefix, g.attributes.NextHop, attrs, l3vpn, withdraw)
+
+			if err != nil {
+				return nil, err
+			}
+
+			vpn_path.IsWithdraw = withdraw
+			vpn_path.Identifier = g.attributes.Marker
+			add_path_request.Path = vpn_path
+		}
+	}
+
+	return add_path_request, nil
+}
+
+// Returns origin, next hop and communities with marker
+func build_path_attributes(attributes Attributes) ([]*apb.Any, error) {
+	origin_attr, err := apb.New(&apipb.OriginAttribute{
+		Origin: 0,
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot create origin message: %v", err)
+	}
+
+	next_hop_attr, err := apb.New(&apipb.NextHopAttribute{
+		NextHop: attributes.NextHop.String(),
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot create next hop message: %v", err)
+	}
+
+	// Create BGP attributes array
+	attrs := []*apb.Any{origin_attr, next_hop_attr}
+
+	communities := append([]uint32{}, attributes.Communities...)
+
+	if attributes.Marker != 0 && !slices.Contains(communities, attributes.Marker) {
+		communities = append(communities, attributes.Marker)
+	}
+
+	if len(communities) > 0 {
+		community_attribute, err := apb.New(&apipb.CommunitiesAttribute{
+			Communities: communities,
+		})
+
+		if err != nil {
+			return nil, fmt.Errorf("Cannot create community message: %v", err)
+		}
+
+		attrs = append(attrs, community_attribute)
+	}
+
+	return attrs, nil
+}
+
+// Returns request for table where we keep our announces of address family
+func ListPathRequest(l3vpn *L3VPN, afi apipb.Family_Afi) *apipb.ListPathRequest {
+	list_path_request := &apipb.ListPathRequest{
+		TableType: apipb.TableType_GLOBAL,
+		Family:    &apipb.Family{Afi: afi, Safi: apipb.Family_SAFI_UNICAST},
+	}
+
+	if l3vpn == nil {
+		return list_path_request
+	}
+
+	// VRF keeps plain unicast prefixes
+	if l3vpn.VRF != "" {
+		list_path_request.TableType = apipb.TableType_VRF
+		list_path_request.Name = l3vpn.VRF
+		return list_path_request
+	}
+
+	list_path_request.Family.Safi = apipb.Family_SAFI_MPLS_VPN
+
+	return list_path_request
+}
+
+// Returns address family of address
+func AFI(addr netip.Addr) apipb.Family_Afi {
+	if addr.Is4() {
+		return apipb.Family_AFI_IP
+	}
+
+	return apipb.Family_AFI_IP6
+}
+
+// Checks that destination has path with marker community, zero marker owns everything
+func IsOwned(destination *apipb.Destination, marker uint32) bool {
+	return len(OwnedPaths(destination, marker)) > 0
+}
+
+// Returns paths of destination with marker community, zero marker owns everything
+func OwnedPaths(destination *apipb.Destination, marker uint32) []*apipb.Path {
+	if marker == 0 {
+		return destination.Paths
+	}
+
+	owned_paths := []*apipb.Path{}
+
+	for _, path := range destination.Paths {
+		if slices.Contains(parse_path_attributes(path.Pattrs).communities, marker) {
+			owned_paths = append(owned_paths, path)
+		}
+	}
+
+	return owned_paths
+}
+
+// Extracts prefix from VPN destination when it has specified route distinguisher
+func VPNPrefix(destination *apipb.Destination, route_distinguisher *apb.Any) (string, bool) {
+	for _, path := range destination.Paths {
+		// gobgp returns routes from VRF with plain prefixes and we keep our VRF only for block list
+		vrf_prefix := apipb.IPAddressPrefix{}
+
+		if path.Nlri != nil && path.Nlri.MessageIs(&vrf_prefix) && path.Nlri.UnmarshalTo(&vrf_prefix) == nil {
+			return fmt.Sprintf("%s/%d", vrf_prefix.Prefix, vrf_prefix.PrefixLen), true
+		}
+
+		vpn_prefix := apipb.LabeledVPNIPAddressPrefix{}
+
+		if path.Nlri == nil || path.Nlri.UnmarshalTo(&vpn_prefix) != nil {
+			continue
+		}
+
+		if !proto.Equal(vpn_prefix.Rd, route_distinguisher) {
+			continue
+		}
+
+		return fmt.Sprintf("%s/%d", vpn_prefix.Prefix, vpn_prefix.PrefixLen), true
+	}
+
+	return "", false
+}
+
+// Returns VPN family for prefix
+func get_vpn_family(prefix netip.Prefix) *apipb.Family {
+	return &apipb.Family{Afi: AFI(prefix.Addr()), Safi: apipb.Family_SAFI_MPLS_VPN}
+}
+
+// Builds VPN path for global VPN table
+// Next hop for VPN routes must be carried in MP_REACH_NLRI, withdrawal needs only route distinguisher in prefix
+func build_vpn_path(prefix netip.Prefix, next_hop netip.Addr, attrs []*apb.Any, l3vpn *L3VPN, withdraw bool) (*apipb.Path, error) {
+	nlri, err := apb.New(&apipb.LabeledVPNIPAddressPrefix{
+		Labels:    []uint32{l3vpn.Label},
+		Rd:        l3vpn.RouteDistinguisher,
+		Prefix:    prefix.Addr().String(),
+		PrefixLen: uint32(prefix.Bits()),
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot create VPN prefix message: %v", err)
+	}
+
+	family := get_vpn_family(prefix)
+
+	if withdraw {
+		return &apipb.Path{Family: family, Nlri: nlri}, nil
+	}
+
+	mp_reach_attr, err := apb.New(&apipb.MpReachNLRIAttribute{
+		Family:   family,
+		NextHops: []string{next_hop.String()},
+		Nlris:    []*apb.Any{nlri},
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot create MP_REACH_NLRI message: %v", err)
+	}
+
+	vpn_attrs := []*apb.Any{mp_reach_attr}
+
+	// We do not need next hop attribute as we carry it in MP_REACH_NLRI
+	for _, attr := range attrs {
+		if attr.MessageIs(&apipb.NextHopAttribute{}) {
+			continue
+		}
+
+		vpn_attrs = append(vpn_attrs, attr)
+	}
+
+	if len(l3vpn.RouteTargets) > 0 {
+		route_targets_attr, err := apb.New(&apipb.ExtendedCommunitiesAttribute{
+			Communities: l3vpn.RouteTargets,
+		})
+
+		if err != nil {
+			return nil, fmt.Errorf("Cannot create extended communities message: %v", err)
+		}
+
+		vpn_attrs = append(vpn_attrs, route_targets_attr)
+	}
+
+	return &apipb.Path{
+		Family: family,
+		Nlri:   nlri,
+		Pattrs: vpn_attrs,
+	}, nil
+}
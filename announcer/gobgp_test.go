@@ -0,0 +1,246 @@
+package announcer
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	apb "google.golang.org/protobuf/types/known/anypb"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+
+	"bitbucket.org/fastnetmon/country_lockdown/internal/gobgpfake"
+)
+
+func start_fake_gobgp(t *testing.T) (*gobgpfake.Server, apipb.GobgpApiClient) {
+	t.Helper()
+
+	server, err := gobgpfake.Start()
+
+	if err != nil {
+		t.Fatalf("Cannot start fake gobgp: %v", err)
+	}
+
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient(server.Address(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+
+	if err != nil {
+		t.Fatalf("Cannot connect to fake gobgp: %v", err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	return server, apipb.NewGobgpApiClient(conn)
+}
+
+func route_distinguisher(t *testing.T, assigned uint32) *apb.Any {
+	t.Helper()
+
+	rd, err := apb.New(&apipb.RouteDistinguisherTwoOctetASN{Admin: 65000, Assigned: assigned})
+
+	if err != nil {
+		t.Fatalf("Cannot create route distinguisher: %v", err)
+	}
+
+	return rd
+}
+
+func TestAnnounceWithAttributes(t *testing.T) {
+	ctx := context.Background()
+
+	server, client := start_fake_gobgp(t)
+
+	marker := uint32(65000<<16 | 666)
+
+	a := NewGoBGP(client, Attributes{
+		NextHop:     netip.MustParseAddr("192.0.2.1"),
+		Communities: []uint32{65000<<16 | 1},
+		Marker:      marker,
+	})
+
+	err := a.Announce(ctx, netip.MustParsePrefix("10.0.0.0/24"))
+
+	if err != nil {
+		t.Fatalf("Cannot announce: %v", err)
+	}
+
+	paths := server.Paths()
+
+	if len(paths) != 1 {
+		t.Fatalf("Unexpected paths: %v", paths)
+	}
+
+	if paths[0].Identifier != marker {
+		t.Errorf("Marker must be used as path identifier: %d", paths[0].Identifier)
+	}
+
+	communities := apipb.CommunitiesAttribute{}
+	next_hop := apipb.NextHopAttribute{}
+
+	for _, attr := range paths[0].Pattrs {
+		attr.UnmarshalTo(&communities)
+		attr.UnmarshalTo(&next_hop)
+	}
+
+	if !slices.Equal(communities.Communities, []uint32{65000<<16 | 1, marker}) {
+		t.Errorf("Unexpected communities: %v", communities.Communities)
+	}
+
+	if next_hop.NextHop != "192.0.2.1" {
+		t.Errorf("Unexpected next hop: %s", next_hop.NextHop)
+	}
+
+	err = a.Withdraw(ctx, netip.MustParsePrefix("10.0.0.0/24"))
+
+	if err != nil {
+		t.Fatalf("Cannot withdraw: %v", err)
+	}
+
+	if paths := server.Paths(); len(paths) != 0 {
+		t.Errorf("Path was not withdrawn: %v", paths)
+	}
+}
+
+func TestListAnnouncedInVPNTable(t *testing.T) {
+	ctx := context.Background()
+
+	_, client := start_fake_gobgp(t)
+
+	ours := NewGoBGP(client, Attributes{
+		NextHop: netip.MustParseAddr("192.0.2.1"),
+		L3VPN:   &L3VPN{RouteDistinguisher: route_distinguisher(t, 100), Label: 16},
+	})
+
+	// Another customer in same table
+	others := NewGoBGP(client, Attributes{
+		NextHop: netip.MustParseAddr("192.0.2.1"),
+		L3VPN:   &L3VPN{RouteDistinguisher: route_distinguisher(t, 200), Label: 16},
+	})
+
+	for _, prefix := range []string{"10.0.0.0/24", "10.0.1.0/24"} {
+		if err := ours.Announce(ctx, netip.MustParsePrefix(prefix)); err != nil {
+			t.Fatalf("Cannot announce: %v", err)
+		}
+	}
+
+	if err := others.Announce(ctx, netip.MustParsePrefix("10.0.2.0/24")); err != nil {
+		t.Fatalf("Cannot announce: %v", err)
+	}
+
+	// VPNv6 routes live in separate family
+	if err := ours.Announce(ctx, netip.MustParsePrefix("2001:db8::/48")); err != nil {
+		t.Fatalf("Cannot announce: %v", err)
+	}
+
+	announced, err := ours.ListAnnounced(ctx)
+
+	if err != nil {
+		t.Fatalf("Cannot list announces: %v", err)
+	}
+
+	slices.SortFunc(announced, func(a Route, b Route) int { return a.Prefix.Addr().Compare(b.Prefix.Addr()) })
+
+	expected := []Route{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/24")},
+		{Prefix: netip.MustParsePrefix("10.0.1.0/24")},
+		{Prefix: netip.MustParsePrefix("2001:db8::/48")},
+	}
+
+	if !slices.Equal(announced, expected) {
+		t.Errorf("Unexpected announces: %v", announced)
+	}
+}
+
+func TestListAnnouncedFindsOutdatedAttributes(t *testing.T) {
+	ctx := context.Background()
+
+	_, client := start_fake_gobgp(t)
+
+	marker := uint32(65000<<16 | 666)
+
+	attributes := Attributes{
+		NextHop:     netip.MustParseAddr("192.0.2.1"),
+		Communities: []uint32{65000<<16 | 1},
+		Marker:      marker,
+	}
+
+	if err := NewGoBGP(client, attributes).Announce(ctx, netip.MustParsePrefix("10.0.0.0/24")); err != nil {
+		t.Fatalf("Cannot announce: %v", err)
+	}
+
+	// Order of communities does not matter
+	attributes.Communities = []uint32{marker, 65000<<16 | 1}
+
+	announced, err := NewGoBGP(client, attributes).ListAnnounced(ctx)
+
+	if err != nil {
+		t.Fatalf("Cannot list announces: %v", err)
+	}
+
+	if len(announced) != 1 || announced[0].Outdated {
+		t.Errorf("Route with same attributes must not be outdated: %v", announced)
+	}
+
+	changes := map[string]Attributes{
+		"next hop":    {NextHop: netip.MustParseAddr("192.0.2.2"), Communities: []uint32{65000<<16 | 1}, Marker: marker},
+		"communities": {NextHop: netip.MustParseAddr("192.0.2.1"), Communities: []uint32{65000<<16 | 2}, Marker: marker},
+	}
+
+	for name, changed_attributes := range changes {
+		announced, err := NewGoBGP(client, changed_attributes).ListAnnounced(ctx)
+
+		if err != nil {
+			t.Fatalf("Cannot list announces: %v", err)
+		}
+
+		if len(announced) != 1 || !announced[0].Outdated {
+			t.Errorf("Route must be outdated after change of %s: %v", name, announced)
+		}
+	}
+}
+
+func TestWithdrawWithoutAttributes(t *testing.T) {
+	ctx := context.Background()
+
+	server, client := start_fake_gobgp(t)
+
+	marker := uint32(65000<<16 | 666)
+	l3vpn := &L3VPN{RouteDistinguisher: route_distinguisher(t, 100), Label: 16}
+
+	unicast := NewGoBGP(client, Attributes{NextHop: netip.MustParseAddr("192.0.2.1"), Communities: []uint32{65000<<16 | 1}, Marker: marker})
+	vpn := NewGoBGP(client, Attributes{NextHop: netip.MustParseAddr("192.0.2.1"), Marker: marker, L3VPN: l3vpn})
+
+	for _, a := range []*GoBGP{unicast, vpn} {
+		if err := a.Announce(ctx, netip.MustParsePrefix("10.0.0.0/24")); err != nil {
+			t.Fatalf("Cannot announce: %v", err)
+		}
+	}
+
+	// Emergency withdrawal knows only marker and route distinguisher
+	for _, a := range []*GoBGP{
+		NewGoBGP(client, Attributes{Marker: marker}),
+		NewGoBGP(client, Attributes{Marker: marker, L3VPN: &L3VPN{RouteDistinguisher: l3vpn.RouteDistinguisher, Label: 16}}),
+	} {
+		request, err := a.build_add_path_request(netip.MustParsePrefix("10.0.0.0/24"), true)
+
+		if err != nil {
+			t.Fatalf("Cannot build withdrawal: %v", err)
+		}
+
+		if len(request.Path.Pattrs) != 0 {
+			t.Errorf("Withdrawal must not have attributes: %v", request.Path.Pattrs)
+		}
+
+		if err := a.Withdraw(ctx, netip.MustParsePrefix("10.0.0.0/24")); err != nil {
+			t.Fatalf("Cannot withdraw: %v", err)
+		}
+	}
+
+	if paths := server.Paths(); len(paths) != 0 {
+		t.Errorf("Paths were not withdrawn: %v", paths)
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"bitbucket.org/fastnetmon/country_lockdown/blockset"
+	"bitbucket.org/fastnetmon/country_lockdown/geo"
+	"bitbucket.org/fastnetmon/country_lockdown/lockdown"
+)
+
+// Outcome of sync for single target in API format
+type TargetStatus struct {
+	Name      string `json:"name"`
+	Announced int    `json:"announced"`
+	Updated   int    `json:"updated"`
+	Withdrawn int    `json:"withdrawn"`
+	Unchanged int    `json:"unchanged"`
+	Failed    int    `json:"failed"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Outcome of sync for single profile in API format
+type ProfileSyncStatus struct {
+	Name      string                    `json:"name"`
+	Success   bool                      `json:"success"`
+	Error     string                    `json:"error,omitempty"`
+	Prefixes  int                       `json:"prefixes"`
+	Addresses uint64                    `json:"addresses"`
+	Countries map[string]blockset.Stats `json:"countries"`
+	ASNs      map[uint]blockset.Stats   `json:"asns,omitempty"`
+	Feeds     map[string]blockset.Stats `json:"feeds,omitempty"`
+
+	GeoIPOverrides []geo.OverrideUsage `json:"geoip_overrides,omitempty"`
+
+	Targets []TargetStatus `json:"targets"`
+}
+
+// Information about last run, prefixes and addresses are totals for all profiles
+// Without profiles in configuration we have other details about block list on top level as before
+type SyncStatus struct {
+	StartedAt       time.Time `json:"started_at"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Success         bool      `json:"success"`
+	Error           string    `json:"error,omitempty"`
+
+	LastSuccessfulSync *time.Time `json:"last_successful_sync,omitempty"`
+
+	Prefixes  int                       `json:"prefixes"`
+	Addresses uint64                    `json:"addresses"`
+	Countries map[string]blockset.Stats `json:"countries"`
+	ASNs      map[uint]blockset.Stats   `json:"asns,omitempty"`
+	Feeds     map[string]blockset.Stats `json:"feeds,omitempty"`
+
+	GeoIPOverrides []geo.OverrideUsage `json:"geoip_overrides,omitempty"`
+
+	GeoIPBuildEpoch   uint   `json:"geoip_build_epoch"`
+	GeoIPDatabaseType string `json:"geoip_database_type"`
+
+	Targets []TargetStatus `json:"targets"`
+
+	Profiles []ProfileSyncStatus `json:"profiles"`
+}
+
+var sync_status_mutex sync.Mutex
+
+// Nil until first run
+var last_sync_status *SyncStatus
+
+// Last block list we calculated for every profile, we serve prefixes from them
+var last_block_lists = make(map[string]*lockdown.Result)
+
+// Daemon loop reads sync requests from API here and replies with result of sync
+var sync_requests = make(chan chan error)
+
+// Keeps details about last run for API
+func record_sync_status(started_at time.Time, profile_results []ProfileSyncResult, err error) {
+	status := &SyncStatus{
+		StartedAt:       started_at.UTC(),
+		DurationSeconds: time.Since(started_at).Seconds(),
+		Success:         err == nil,
+		Targets:         []TargetStatus{},
+		Profiles:        []ProfileSyncStatus{},
+	}
+
+	if err != nil {
+		status.Error = err.Error()
+	}
+
+	for _, profile_result := range profile_results {
+		profile_status := ProfileSyncStatus{
+			Name:    profile_result.Profile,
+			Success: profile_result.Err == nil,
+			Targets: []TargetStatus{},
+		}
+
+		if profile_result.Err != nil {
+			profile_status.Error = profile_result.Err.Error()
+		}
+
+		block_list := profile_result.BlockList
+
+		if block_list != nil {
+			profile_status.Prefixes = len(block_list.Prefixes)
+			profile_status.Addresses = blockset.CountAddresses(block_list.Prefixes)
+			profile_status.Countries = block_list.Countries
+			profile_status.ASNs = block_list.ASNs
+			profile_status.Feeds = block_list.Feeds
+			profile_status.GeoIPOverrides = block_list.Diagnostics.GeoIPOverrides
+
+			// All profiles use same geo source
+			status.GeoIPBuildEpoch = block_list.Diagnostics.GeoIPBuildEpoch
+			status.GeoIPDatabaseType = block_list.Diagnostics.GeoIPDatabaseType
+		}
+
+		for _, result := range profile_result.Results {
+			target_status := TargetStatus{
+				Name:      result.Target,
+				Announced: result.Announced,
+				Updated:   result.Updated,
+				Withdrawn: result.Withdrawn,
+				Unchanged: result.Skipped,
+				Failed:    result.Failed,
+			}
+
+			if result.Err != nil {
+				target_status.Error = result.Err.Error()
+			}
+
+			profile_status.Targets = append(profile_status.Targets, target_status)
+		}
+
+		status.Profiles = append(status.Profiles, profile_status)
+
+		status.Prefixes += profile_status.Prefixes
+		status.Addresses += profile_status.Addresses
+	}
+
+	if len(conf.Profiles) == 0 && len(status.Profiles) == 1 {
+		status.Countries = status.Profiles[0].Countries
+		status.ASNs = status.Profiles[0].ASNs
+		status.Feeds = status.Profiles[0].Feeds
+		status.GeoIPOverrides = status.Profiles[0].GeoIPOverrides
+		status.Targets = status.Profiles[0].Targets
+	}
+
+	sync_status_mutex.Lock()
+	defer sync_status_mutex.Unlock()
+
+	if err == nil {
+		status.LastSuccessfulSync = &status.StartedAt
+	} else if last_sync_status != nil {
+		status.LastSuccessfulSync = last_sync_status.LastSuccessfulSync
+	}
+
+	last_sync_status = status
+
+	for _, profile_result := range profile_results {
+		if profile_result.BlockList != nil {
+			last_block_lists[profile_result.Profile] = profile_result.BlockList
+		}
+	}
+}
+
+// Uses loopback address when host is not set, API can add blocks for whole countries and must not be exposed by accident
+func get_api_listen_address(address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+
+	if err != nil {
+		return "", fmt.Errorf("Cannot parse management API address %s: %w", address, err)
+	}
+
+	if host == "" {
+		host = "127.0.0.1"
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// Checks bearer token when it's configured
+func require_api_token(token string, handler http.Handler) http.Handler {
+	if token == "" {
+		return handler
+	}
+
+	expected_header := []byte("Bearer " + token)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected_header) != 1 {
+			write_api_error(w, http.StatusUnauthorized, fmt.Errorf("Please pass valid token in Authorization header"))
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Starts management API in background
+func start_api_server(address string) error {
+	address, err := get_api_listen_address(address)
+
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", address)
+
+	if err != nil {
+		return fmt.Errorf("Cannot listen on %s for management API: %w", address, err)
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /status", handle_api_status)
+	mux.HandleFunc("GET /prefixes", handle_api_prefixes)
+	mux.HandleFunc("POST /sync", handle_api_sync)
+
+	for _, list_name := range []string{"allow", "block"} {
+		mux.HandleFunc("GET /"+list_name, func(w http.ResponseWriter, r *http.Request) {
+			handle_api_list_overrides(w, r, list_name)
+		})
+
+		mux.HandleFunc("POST /"+list_name, func(w http.ResponseWriter, r *http.Request) {
+			handle_api_change_override(w, r, list_name, true)
+		})
+
+		mux.HandleFunc("DELETE /"+list_name, func(w http.ResponseWriter, r *http.Request) {
+			handle_api_change_override(w, r, list_name, false)
+		})
+	}
+
+	go func() {
+		err := http.Serve(listener, require_api_token(conf.ApiToken, mux))
+
+		if err != nil {
+			slog.Error("Management API stopped", "error", err)
+		}
+	}()
+
+	slog.Info("Started management API", "address", address, "token_required", conf.ApiToken != "")
+
+	if conf.ApiToken == "" && !is_loopback_listener(listener) {
+		slog.Warn("Management API listens on non loopback address without api_token, anyone who can reach it can block whole countries", "address", address)
+	}
+
+	return nil
+}
+
+func is_loopback_listener(listener net.Listener) bool {
+	tcp_address, ok := listener.Addr().(*net.TCPAddr)
+
+	return ok && tcp_address.IP.IsLoopback()
+}
+
+func write_api_response(w http.ResponseWriter, status_code int, response any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status_code)
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "    ")
+
+	err := encoder.Encode(response)
+
+	if err != nil {
+		slog.Warn("Cannot encode API response", "error", err)
+	}
+}
+
+func write_api_error(w http.ResponseWriter, status_code int, err error) {
+	write_api_response(w, status_code, map[string]string{"error": err.Error()})
+}
+
+func handle_api_status(w http.ResponseWriter, r *http.Request) {
+	sync_status_mutex.Lock()
+	status := last_sync_status
+	sync_status_mutex.Unlock()
+
+	if status == nil {
+		write_api_error(w, http.StatusServiceUnavailable, fmt.Errorf("First sync did not finish yet"))
+		return
+	}
+
+	write_api_response(w, http.StatusOK, status)
+}
+
+func handle_api_prefixes(w http.ResponseWriter, r *http.Request) {
+	profile, err := get_blocking_profile(r.URL.Query().Get("profile"))
+
+	if err != nil {
+		write_api_error(w, http.StatusBadRequest, err)
+		return
+	}
+
+	sync_status_mutex.Lock()
+	block_list := last_block_lists[profile.Name]
+	sync_status_mutex.Unlock()
+
+	if block_list == nil {
+		write_api_error(w, http.StatusServiceUnavailable, fmt.Errorf("Block list was not calculated yet"))
+		return
+	}
+
+	prefixes := block_list.Prefixes
+
+	country_code := r.URL.Query().Get("country")
+
+	// Keys are in canonical form like in configuration after load
+	if entry, err := geo.ParseBlockListEntry(country_code); err == nil {
+		country_code = entry.String()
+	}
+
+	if country_code != "" {
+		country_prefixes, ok := block_list.PrefixesByCountry[country_code]
+
+		if !ok {
+			write_api_error(w, http.StatusNotFound, fmt.Errorf("We do not block country %s", country_code))
+			return
+		}
+
+		prefixes = country_prefixes
+	}
+
+	if prefixes == nil {
+		prefixes = []netip.Prefix{}
+	}
+
+	write_api_response(w, http.StatusOK, prefixes)
+}
+
+// Runs sync immediately and waits for result
+func handle_api_sync(w http.ResponseWriter, r *http.Request) {
+	reply := make(chan error, 1)
+
+	select {
+	case sync_requests <- reply:
+	case <-r.Context().Done():
+		return
+	}
+
+	select {
+	case err := <-reply:
+		if err != nil {
+			write_api_error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		handle_api_status(w, r)
+	case <-r.Context().Done():
+	}
+}
+
+func handle_api_list_overrides(w http.ResponseWriter, r *http.Request, list_name string) {
+	overrides, err := load_overrides()
+
+	if err != nil {
+		write_api_error(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	write_api_response(w, http.StatusOK, *get_override_list(overrides, list_name))
+}
+
+// Adds or removes temporary entry, changes will be applied on next sync
+func handle_api_change_override(w http.ResponseWriter, r *http.Request, list_name string, add bool) {
+	entry := OverrideEntry{}
+
+	// For DELETE it's more convenient to pass entry in query string
+	if r.URL.Query().Get("prefix") != "" || r.URL.Query().Get("country") != "" {
+		entry.Prefix = r.URL.Query().Get("prefix")
+		entry.Country = r.URL.Query().Get("country")
+		entry.Profile = r.URL.Query().Get("profile")
+	} else {
+		err := json.NewDecoder(r.Body).Decode(&entry)
+
+		if err != nil {
+			write_api_error(w, http.StatusBadRequest, fmt.Errorf("Cannot decode request: %v", err))
+			return
+		}
+	}
+
+	var changed bool
+	var err error
+
+	if add {
+		changed, err = add_override(list_name, entry)
+	} else {
+		changed, err = remove_override(list_name, entry)
+	}
+
+	if err != nil {
+		write_api_error(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if !add && !changed {
+		write_api_error(w, http.StatusNotFound, fmt.Errorf("We do not have this entry in %s list", list_name))
+		return
+	}
+
+	slog.Info("Changed overrides via API", "list", list_name, "add", add, "prefix", entry.Prefix, "country", entry.Country, "profile", entry.Profile, "changed", changed)
+
+	write_api_response(w, http.StatusOK, map[string]bool{"changed": changed})
+}
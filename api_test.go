@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestPrefixesAPIWithLowerCaseCountry(t *testing.T) {
+	env := start_test_environment(t, test_networks, map[string]any{
+		"country_block_list": []string{"tv", "Nr"},
+	})
+
+	// Entries are in canonical form after load
+	if !slices.Equal(conf.CountryBlockList, []string{"TV", "NR"}) {
+		t.Errorf("Unexpected block list after load: %v", conf.CountryBlockList)
+	}
+
+	env.sync(t)
+
+	for _, country_code := range []string{"tv", "TV", "tV"} {
+		w := httptest.NewRecorder()
+
+		handle_api_prefixes(w, httptest.NewRequest(http.MethodGet, "/prefixes?country="+country_code, nil))
+
+		prefixes := []netip.Prefix{}
+
+		if err := json.Unmarshal(w.Body.Bytes(), &prefixes); err != nil || w.Code != http.StatusOK {
+			t.Errorf("Unexpected response for %s: %d %s", country_code, w.Code, w.Body.String())
+			continue
+		}
+
+		if !slices.Equal(prefixes, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}) {
+			t.Errorf("Unexpected prefixes for %s: %v", country_code, prefixes)
+		}
+	}
+
+	w := httptest.NewRecorder()
+
+	handle_api_prefixes(w, httptest.NewRequest(http.MethodGet, "/prefixes?country=ki", nil))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("We do not block KI: %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+
+	"github.com/oschwald/geoip2-golang"
+	"github.com/oschwald/maxminddb-golang"
+	"go4.org/netipx"
+)
+
+// Checks asn_path, asn_block_list and asn_allow_list from configuration
+func validate_asn_lists(asn_block_list []uint, asn_allow_list []uint) error {
+	if len(asn_block_list) == 0 && len(asn_allow_list) == 0 {
+		return nil
+	}
+
+	if conf.ASNPath == "" {
+		return fmt.Errorf("Please set asn_path with GeoLite2-ASN or GeoIP2-ISP database to use asn_block_list and asn_allow_list")
+	}
+
+	for _, asn := range asn_block_list {
+		if slices.Contains(asn_allow_list, asn) {
+			return fmt.Errorf("AS%d is in both asn_block_list and asn_allow_list", asn)
+		}
+	}
+
+	return nil
+}
+
+// We need database which has autonomous_system_number field
+func check_asn_database_type(database_type string) error {
+	if database_type != "GeoLite2-ASN" && database_type != "GeoIP2-ISP" {
+		return fmt.Errorf("Wrong type of ASN database %s, please use GeoLite2-ASN or GeoIP2-ISP", database_type)
+	}
+
+	return nil
+}
+
+func open_asn_database() (*maxminddb.Reader, error) {
+	asn_db, err := maxminddb.Open(conf.ASNPath)
+
+	if err != nil {
+		return nil, fmt.Errorf("Can't open ASN database: %v", err)
+	}
+
+	err = check_asn_database_type(asn_db.Metadata.DatabaseType)
+
+	if err != nil {
+		asn_db.Close()
+		return nil, err
+	}
+
+	return asn_db, nil
+}
+
+// Loads IPv4 networks for ASNs from both lists in single walk over database
+func load_configured_asn_networks(asn_block_list []uint, asn_allow_list []uint) (map[uint][]netip.Prefix, error) {
+	prefixes_by_asn := make(map[uint][]netip.Prefix)
+
+	if len(asn_block_list) == 0 && len(asn_allow_list) == 0 {
+		return prefixes_by_asn, nil
+	}
+
+	asn_db, err := open_asn_database()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer asn_db.Close()
+
+	slog.Info("Loaded ASN file",
+		"path", conf.ASNPath,
+		"database_type", asn_db.Metadata.DatabaseType,
+		"build_epoch", asn_db.Metadata.BuildEpoch)
+
+	// Same approach as for countries, please check comments in geo.MMDBSource.WalkIPv4Networks
+	networks := asn_db.Networks(maxminddb.SkipAliasedNetworks)
+
+	for networks.Next() {
+		// GeoIP2-ISP has same fields for ASN
+		record := geoip2.ASN{}
+
+		subnet, err := networks.Network(&record)
+
+		if err != nil {
+			return nil, fmt.Errorf("Cannot decode field in ASN dataset: %v", err)
+		}
+
+		if subnet.IP.To4() == nil {
+			continue
+		}
+
+		asn := record.AutonomousSystemNumber
+
+		if !slices.Contains(asn_block_list, asn) && !slices.Contains(asn_allow_list, asn) {
+			continue
+		}
+
+		prefix, ok := netipx.FromStdIPNet(subnet)
+
+		if !ok {
+			slog.Warn("Cannot parse network from ASN database as prefix", "prefix", subnet.String())
+			continue
+		}
+
+		prefixes_by_asn[asn] = append(prefixes_by_asn[asn], prefix.Masked())
+	}
+
+	if networks.Err() != nil {
+		return nil, fmt.Errorf("Cannot correctly iterate over all available networks in ASN database %w", networks.Err())
+	}
+
+	for _, asn := range append(append([]uint{}, asn_block_list...), asn_allow_list...) {
+		slog.Info("Loaded prefixes for ASN", "asn", asn, "prefixes", len(prefixes_by_asn[asn]))
+		slog.Debug("ASN prefixes", "asn", asn, "prefix_list", prefixes_by_asn[asn])
+	}
+
+	return prefixes_by_asn, nil
+}
+
+// Returns ASN record for address or nil when database does not have it
+func lookup_asn(addr netip.Addr) (*geoip2.ASN, netip.Prefix, error) {
+	asn_db, err := open_asn_database()
+
+	if err != nil {
+		return nil, netip.Prefix{}, err
+	}
+
+	defer asn_db.Close()
+
+	record := geoip2.ASN{}
+
+	network, found, err := asn_db.LookupNetwork(net.IP(addr.AsSlice()), &record)
+
+	if err != nil {
+		return nil, netip.Prefix{}, fmt.Errorf("Cannot lookup %s in ASN database: %v", addr, err)
+	}
+
+	if !found {
+		return nil, netip.Prefix{}, nil
+	}
+
+	prefix, _ := netipx.FromStdIPNet(network)
+
+	return &record, prefix.Masked(), nil
+}
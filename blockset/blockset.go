@@ -0,0 +1,176 @@
+// Package blockset combines networks of countries, ASNs and feeds with allow lists into aggregated block list
+package blockset
+
+import (
+	"net/netip"
+
+	"go4.org/netipx"
+)
+
+// Networks which we block and exempt, already loaded from geo source, ASN database and feeds
+type Input struct {
+	// Networks for every country or subdivision from block list
+	Countries map[string][]netip.Prefix
+
+	// Networks for every ASN from block list
+	ASNs map[uint][]netip.Prefix
+
+	// Networks for every block feed
+	Feeds map[string][]netip.Prefix
+
+	// Networks without category, e.g. entries added via management API
+	Extra []netip.Prefix
+
+	// We remove these networks from everything above
+	Allow []netip.Prefix
+}
+
+// Aggregated block list with statistics for every category after applying allow list
+type Result struct {
+	Prefixes []netip.Prefix
+
+	Countries         map[string]Stats
+	PrefixesByCountry map[string][]netip.Prefix
+
+	ASNs  map[uint]Stats
+	Feeds map[string]Stats
+}
+
+type Stats struct {
+	Prefixes  int    `json:"prefixes"`
+	Addresses uint64 `json:"addresses"`
+}
+
+// Calculates block list from input
+func Compute(input Input) Result {
+	// https://pkg.go.dev/go4.org/netipx#IPSetBuilder
+	// https://tailscale.com/blog/netaddr-new-ip-type-for-go/
+	var b netipx.IPSetBuilder
+
+	for _, prefixes := range input.Countries {
+		add_prefixes(&b, prefixes)
+	}
+
+	add_prefixes(&b, input.Extra)
+
+	for _, prefixes := range input.ASNs {
+		add_prefixes(&b, prefixes)
+	}
+
+	for _, prefixes := range input.Feeds {
+		add_prefixes(&b, prefixes)
+	}
+
+	// Exclude:
+	for _, prefix := range input.Allow {
+		b.RemovePrefix(prefix)
+	}
+
+	s := BuildSet(&b)
+
+	result := Result{
+		Prefixes:          s.Prefixes(),
+		Countries:         make(map[string]Stats),
+		PrefixesByCountry: make(map[string][]netip.Prefix),
+		ASNs:              make(map[uint]Stats),
+		Feeds:             make(map[string]Stats),
+	}
+
+	for country_code, prefixes := range input.Countries {
+		blocked_prefixes := Blocked(prefixes, s)
+
+		result.Countries[country_code] = get_stats(blocked_prefixes)
+		result.PrefixesByCountry[country_code] = blocked_prefixes
+	}
+
+	for asn, prefixes := range input.ASNs {
+		result.ASNs[asn] = get_stats(Blocked(prefixes, s))
+	}
+
+	for feed_name, prefixes := range input.Feeds {
+		result.Feeds[feed_name] = get_stats(Blocked(prefixes, s))
+	}
+
+	return result
+}
+
+func add_prefixes(builder *netipx.IPSetBuilder, prefixes []netip.Prefix) {
+	for _, prefix := range prefixes {
+		builder.AddPrefix(prefix)
+	}
+}
+
+func get_stats(prefixes []netip.Prefix) Stats {
+	return Stats{Prefixes: len(prefixes), Addresses: CountAddresses(prefixes)}
+}
+
+// Returns part of prefixes which remained in block list after allow list
+func Blocked(prefixes []netip.Prefix, block_list_set *netipx.IPSet) []netip.Prefix {
+	var builder netipx.IPSetBuilder
+
+	add_prefixes(&builder, prefixes)
+
+	builder.Intersect(block_list_set)
+
+	return BuildSet(&builder).Prefixes()
+}
+
+// Returns number of IPv4 addresses in prefixes
+func CountAddresses(prefixes []netip.Prefix) uint64 {
+	var addresses uint64
+
+	for _, prefix := range prefixes {
+		if !prefix.Addr().Is4() {
+			continue
+		}
+
+		addresses += 1 << (32 - prefix.Bits())
+	}
+
+	return addresses
+}
+
+// We add only valid prefixes and builder cannot fail
+func BuildSet(builder *netipx.IPSetBuilder) *netipx.IPSet {
+	set, _ := builder.IPSet()
+
+	return set
+}
+
+// Returns prefixes from first set which are missing in second one
+func Subtract(a *netipx.IPSet, b *netipx.IPSet) []netip.Prefix {
+	var builder netipx.IPSetBuilder
+
+	if a != nil {
+		builder.AddSet(a)
+	}
+
+	if b != nil {
+		builder.RemoveSet(b)
+	}
+
+	return BuildSet(&builder).Prefixes()
+}
+
+// Returns prefixes which belong to both sets
+func Intersect(a *netipx.IPSet, b *netipx.IPSet) []netip.Prefix {
+	if a == nil || b == nil {
+		return []netip.Prefix{}
+	}
+
+	var builder netipx.IPSetBuilder
+
+	builder.AddSet(a)
+	builder.Intersect(b)
+
+	return BuildSet(&builder).Prefixes()
+}
+
+// Returns prefixes of set which may be nil
+func Prefixes(set *netipx.IPSet) []netip.Prefix {
+	if set == nil {
+		return []netip.Prefix{}
+	}
+
+	return set.Prefixes()
+}
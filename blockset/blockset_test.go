@@ -0,0 +1,124 @@
+package blockset
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+
+	"go4.org/netipx"
+)
+
+func parse_prefixes(t *testing.T, values ...string) []netip.Prefix {
+	t.Helper()
+
+	prefixes := []netip.Prefix{}
+
+	for _, value := range values {
+		prefixes = append(prefixes, netip.MustParsePrefix(value))
+	}
+
+	return prefixes
+}
+
+func TestComputeAllowListPunchesHoles(t *testing.T) {
+	result := Compute(Input{
+		Countries: map[string][]netip.Prefix{
+			"TV": parse_prefixes(t, "10.0.0.0/24", "10.0.1.0/24"),
+		},
+		Allow: parse_prefixes(t, "10.0.0.128/25", "10.0.1.7/32"),
+	})
+
+	expected := parse_prefixes(t,
+		"10.0.0.0/25",
+		"10.0.1.0/30", "10.0.1.4/31", "10.0.1.6/32",
+		"10.0.1.8/29", "10.0.1.16/28", "10.0.1.32/27", "10.0.1.64/26", "10.0.1.128/25")
+
+	if !slices.Equal(result.Prefixes, expected) {
+		t.Fatalf("Unexpected prefixes %v, expected %v", result.Prefixes, expected)
+	}
+
+	stats := result.Countries["TV"]
+
+	if stats.Addresses != 512-128-1 {
+		t.Errorf("Unexpected number of blocked addresses for TV: %d", stats.Addresses)
+	}
+
+	if stats.Prefixes != len(expected) {
+		t.Errorf("Unexpected number of blocked prefixes for TV: %d", stats.Prefixes)
+	}
+}
+
+func TestComputeAggregatesCategories(t *testing.T) {
+	result := Compute(Input{
+		Countries: map[string][]netip.Prefix{
+			"TV": parse_prefixes(t, "10.0.0.0/25"),
+			"NR": parse_prefixes(t, "10.0.0.128/25"),
+		},
+		ASNs: map[uint][]netip.Prefix{
+			64500: parse_prefixes(t, "192.0.2.0/24"),
+		},
+		Feeds: map[string][]netip.Prefix{
+			"drop": parse_prefixes(t, "192.0.2.0/25", "198.51.100.0/24"),
+		},
+		Extra: parse_prefixes(t, "203.0.113.1/32"),
+		Allow: parse_prefixes(t, "198.51.100.0/24"),
+	})
+
+	expected := parse_prefixes(t, "10.0.0.0/24", "192.0.2.0/24", "203.0.113.1/32")
+
+	if !slices.Equal(result.Prefixes, expected) {
+		t.Fatalf("Unexpected prefixes %v, expected %v", result.Prefixes, expected)
+	}
+
+	if result.ASNs[64500].Addresses != 256 {
+		t.Errorf("Unexpected stats for ASN: %+v", result.ASNs[64500])
+	}
+
+	// Allowed part of feed is not blocked and we do not count it
+	if result.Feeds["drop"].Addresses != 128 {
+		t.Errorf("Unexpected stats for feed: %+v", result.Feeds["drop"])
+	}
+
+	if !slices.Equal(result.PrefixesByCountry["NR"], parse_prefixes(t, "10.0.0.128/25")) {
+		t.Errorf("Unexpected prefixes for NR: %v", result.PrefixesByCountry["NR"])
+	}
+}
+
+func TestCountAddressesSkipsIPv6(t *testing.T) {
+	addresses := CountAddresses(parse_prefixes(t, "10.0.0.0/8", "2001:db8::/32"))
+
+	if addresses != 1<<24 {
+		t.Errorf("Unexpected number of addresses: %d", addresses)
+	}
+}
+
+func TestSubtractAndIntersect(t *testing.T) {
+	build := func(values ...string) *netipx.IPSet {
+		var builder netipx.IPSetBuilder
+
+		for _, prefix := range parse_prefixes(t, values...) {
+			builder.AddPrefix(prefix)
+		}
+
+		return BuildSet(&builder)
+	}
+
+	a := build("10.0.0.0/24")
+	b := build("10.0.0.0/25", "10.1.0.0/24")
+
+	if subtracted := Subtract(a, b); !slices.Equal(subtracted, parse_prefixes(t, "10.0.0.128/25")) {
+		t.Errorf("Unexpected result of subtraction: %v", subtracted)
+	}
+
+	if intersected := Intersect(a, b); !slices.Equal(intersected, parse_prefixes(t, "10.0.0.0/25")) {
+		t.Errorf("Unexpected result of intersection: %v", intersected)
+	}
+
+	if intersected := Intersect(a, nil); len(intersected) != 0 {
+		t.Errorf("Intersection with missing set must be empty: %v", intersected)
+	}
+
+	if subtracted := Subtract(nil, b); len(subtracted) != 0 {
+		t.Errorf("Subtraction from missing set must be empty: %v", subtracted)
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"sort"
+
+	"go4.org/netipx"
+
+	"bitbucket.org/fastnetmon/country_lockdown/blockset"
+	"bitbucket.org/fastnetmon/country_lockdown/geo"
+)
+
+// Networks which moved between blocked country and some other country
+type CountryMove struct {
+	Country   string         `json:"country"`
+	Prefixes  []netip.Prefix `json:"prefixes"`
+	Addresses uint64         `json:"addresses"`
+}
+
+// Changes for single country between two databases
+type CountryDiff struct {
+	Country string `json:"country"`
+
+	OldPrefixes  int    `json:"old_prefixes"`
+	NewPrefixes  int    `json:"new_prefixes"`
+	OldAddresses uint64 `json:"old_addresses"`
+	NewAddresses uint64 `json:"new_addresses"`
+
+	AddressesChange int64 `json:"addresses_change"`
+
+	Added   []netip.Prefix `json:"added"`
+	Removed []netip.Prefix `json:"removed"`
+
+	// Country is empty when network is missing in database or does not have country
+	MovedTo   []CountryMove `json:"moved_to"`
+	MovedFrom []CountryMove `json:"moved_from"`
+}
+
+type DatabaseDiff struct {
+	OldDatabase string `json:"old_database"`
+	NewDatabase string `json:"new_database"`
+
+	OldBuildEpoch uint `json:"old_build_epoch"`
+	NewBuildEpoch uint `json:"new_build_epoch"`
+
+	Countries []CountryDiff `json:"countries"`
+}
+
+// Returns type of configured geo source, both files must have this type
+// Merged sources need multiple files for each side and we cannot compare them
+func get_db_diff_source_type() (string, error) {
+	if len(conf.GeoSources) == 0 {
+		return conf.GeoSource.Type, nil
+	}
+
+	if len(conf.GeoSources) > 1 {
+		return "", fmt.Errorf("We cannot compare databases when geo_sources has %d merged sources, please use configuration with single source for db-diff", len(conf.GeoSources))
+	}
+
+	return conf.GeoSources[0].Type, nil
+}
+
+// Loads all IPv4 networks from database grouped by country and networks for every entry of block list
+// Entries are countries like UA or subdivisions like UA-43 and UA:Crimea
+func load_ipv4_sets(geoip_path string, values []string) (map[string]*netipx.IPSet, map[string]*netipx.IPSet, uint, error) {
+	source_type, err := get_db_diff_source_type()
+
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	geo_source, err := geo.Open(source_type, []string{geoip_path}, get_geo_source_options())
+
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	defer geo_source.Close()
+
+	sets, err := geo.SetsByCountry(geo_source, nil)
+
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("Cannot load networks from %s: %w", geoip_path, err)
+	}
+
+	sets_by_entry := make(map[string]*netipx.IPSet)
+	subdivision_values := []string{}
+
+	for _, value := range values {
+		entry, err := geo.ParseSourceEntry(geo_source, value)
+
+		if err != nil {
+			return nil, nil, 0, err
+		}
+
+		if !entry.HasSubdivision() {
+			sets_by_entry[value] = sets[entry.Country]
+			continue
+		}
+
+		subdivision_values = append(subdivision_values, value)
+	}
+
+	if len(subdivision_values) == 0 {
+		return sets, sets_by_entry, geo_source.BuildEpoch(), nil
+	}
+
+	// Sets by country do not have subdivisions and we walk database again for them
+	networks_by_entry, err := geo.LoadNetworksByEntry(geo_source, subdivision_values)
+
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("Cannot load networks from %s: %w", geoip_path, err)
+	}
+
+	for value, networks := range networks_by_entry {
+		var builder netipx.IPSetBuilder
+
+		for _, network := range networks {
+			builder.AddPrefix(network)
+		}
+
+		sets_by_entry[value] = blockset.BuildSet(&builder)
+	}
+
+	return sets, sets_by_entry, geo_source.BuildEpoch(), nil
+}
+
+// Returns networks which left entry and belong to other countries or other subdivisions of same country now
+func get_country_moves(value string, from_entry_set *netipx.IPSet, to_entry_set *netipx.IPSet, to map[string]*netipx.IPSet) ([]CountryMove, error) {
+	moves := []CountryMove{}
+
+	var left_networks netipx.IPSetBuilder
+
+	for _, prefix := range blockset.Subtract(from_entry_set, to_entry_set) {
+		left_networks.AddPrefix(prefix)
+	}
+
+	left_set, err := left_networks.IPSet()
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot build set of networks for %s: %w", value, err)
+	}
+
+	for other_country_code, other_set := range to {
+		// We report networks without country with missing ones
+		if other_country_code == "" {
+			continue
+		}
+
+		moved_prefixes := blockset.Intersect(left_set, other_set)
+
+		if len(moved_prefixes) == 0 {
+			continue
+		}
+
+		moves = append(moves, CountryMove{
+			Country:   other_country_code,
+			Prefixes:  moved_prefixes,
+			Addresses: blockset.CountAddresses(moved_prefixes),
+		})
+	}
+
+	// Networks which disappeared from database completely or lost country
+	var all_networks netipx.IPSetBuilder
+
+	for other_country_code, set := range to {
+		if other_country_code != "" {
+			all_networks.AddSet(set)
+		}
+	}
+
+	// Failed build must not look like empty diff
+	all_networks_set, err := all_networks.IPSet()
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot build set of networks for %s: %w", value, err)
+	}
+
+	missing_prefixes := blockset.Subtract(left_set, all_networks_set)
+
+	if len(missing_prefixes) > 0 {
+		moves = append(moves, CountryMove{
+			Country:   "",
+			Prefixes:  missing_prefixes,
+			Addresses: blockset.CountAddresses(missing_prefixes),
+		})
+	}
+
+	sort.Slice(moves, func(i, j int) bool {
+		return moves[i].Addresses > moves[j].Addresses
+	})
+
+	return moves, nil
+}
+
+// Compares networks for countries between two GeoIP databases
+func compare_geoip_databases(old_path string, new_path string, countries []string) (*DatabaseDiff, error) {
+	// Keys of sets are in canonical form like entries from configuration
+	values := []string{}
+
+	for _, value := range countries {
+		entry, err := geo.ParseBlockListEntry(value)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !slices.Contains(values, entry.String()) {
+			values = append(values, entry.String())
+		}
+	}
+
+	old_sets, old_entry_sets, old_build_epoch, err := load_ipv4_sets(old_path, values)
+
+	if err != nil {
+		return nil, err
+	}
+
+	new_sets, new_entry_sets, new_build_epoch, err := load_ipv4_sets(new_path, values)
+
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &DatabaseDiff{
+		OldDatabase:   old_path,
+		NewDatabase:   new_path,
+		OldBuildEpoch: old_build_epoch,
+		NewBuildEpoch: new_build_epoch,
+		Countries:     []CountryDiff{},
+	}
+
+	for _, value := range values {
+		old_set, new_set := old_entry_sets[value], new_entry_sets[value]
+
+		moved_to, err := get_country_moves(value, old_set, new_set, new_sets)
+
+		if err != nil {
+			return nil, err
+		}
+
+		moved_from, err := get_country_moves(value, new_set, old_set, old_sets)
+
+		if err != nil {
+			return nil, err
+		}
+
+		old_prefixes := blockset.Prefixes(old_set)
+		new_prefixes := blockset.Prefixes(new_set)
+
+		country_diff := CountryDiff{
+			Country:      value,
+			OldPrefixes:  len(old_prefixes),
+			NewPrefixes:  len(new_prefixes),
+			OldAddresses: blockset.CountAddresses(old_prefixes),
+			NewAddresses: blockset.CountAddresses(new_prefixes),
+			Added:        blockset.Subtract(new_set, old_set),
+			Removed:      blockset.Subtract(old_set, new_set),
+			MovedTo:      moved_to,
+			MovedFrom:    moved_from,
+		}
+
+		country_diff.AddressesChange = int64(country_diff.NewAddresses) - int64(country_diff.OldAddresses)
+
+		diff.Countries = append(diff.Countries, country_diff)
+	}
+
+	return diff, nil
+}
+
+// Returns countries from configuration which we may block
+func get_all_configured_countries() []string {
+	countries := append([]string{}, conf.CountryBlockList...)
+
+	for _, profile := range conf.Profiles {
+		for _, country_code := range profile.CountryBlockList {
+			if !slices.Contains(countries, country_code) {
+				countries = append(countries, country_code)
+			}
+		}
+	}
+
+	for _, block := range conf.ScheduledCountryBlocks {
+		for _, country_code := range block.Countries {
+			if !slices.Contains(countries, country_code) {
+				countries = append(countries, country_code)
+			}
+		}
+	}
+
+	return countries
+}
+
+func format_country_code(country_code string) string {
+	if country_code == "" {
+		return "not in database"
+	}
+
+	return country_code
+}
+
+// Prints report about changes between two databases
+func run_db_diff(old_path string, new_path string, countries []string, format string) error {
+	if len(countries) == 0 {
+		countries = get_all_configured_countries()
+	}
+
+	if len(countries) == 0 {
+		return fmt.Errorf("We do not have any countries in configuration")
+	}
+
+	diff, err := compare_geoip_databases(old_path, new_path, countries)
+
+	if err != nil {
+		return err
+	}
+
+	if format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "    ")
+
+		return encoder.Encode(diff)
+	}
+
+	if format != "table" {
+		return fmt.Errorf("Unknown format %s, please use table or json", format)
+	}
+
+	fmt.Printf("%-8s %12s %12s %16s %16s %12s %8s %8s\n", "Country", "Old prefixes", "New prefixes", "Old addresses", "New addresses", "Change", "Added", "Removed")
+
+	for _, country_diff := range diff.Countries {
+		fmt.Printf("%-8s %12d %12d %16d %16d %+12d %8d %8d\n",
+			country_diff.Country,
+			country_diff.OldPrefixes,
+			country_diff.NewPrefixes,
+			country_diff.OldAddresses,
+			country_diff.NewAddresses,
+			country_diff.AddressesChange,
+			len(country_diff.Added),
+			len(country_diff.Removed))
+	}
+
+	for _, country_diff := range diff.Countries {
+		if len(country_diff.Added) == 0 && len(country_diff.Removed) == 0 {
+			continue
+		}
+
+		fmt.Printf("\n%s\n", country_diff.Country)
+
+		for _, prefix := range country_diff.Added {
+			fmt.Printf("  + %s\n", prefix)
+		}
+
+		for _, prefix := range country_diff.Removed {
+			fmt.Printf("  - %s\n", prefix)
+		}
+
+		for _, move := range country_diff.MovedTo {
+			fmt.Printf("  moved to %s: %d addresses %v\n", format_country_code(move.Country), move.Addresses, move.Prefixes)
+		}
+
+		for _, move := range country_diff.MovedFrom {
+			fmt.Printf("  moved from %s: %d addresses %v\n", format_country_code(move.Country), move.Addresses, move.Prefixes)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+
+	"bitbucket.org/fastnetmon/country_lockdown/internal/mmdbtest"
+)
+
+func TestDatabaseDiffWithGeoSources(t *testing.T) {
+	env := start_test_environment(t, test_networks, map[string]any{
+		"country_block_list": []string{"TV"},
+		"geo_sources":        []map[string]any{{"type": "maxmind"}},
+	})
+
+	// Half of NR moved to TV in new database
+	new_path := mmdbtest.WriteTemp(t, "GeoLite2-Country", []mmdbtest.Network{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Record: mmdbtest.Country("TV", "Tuvalu")},
+		{Prefix: netip.MustParsePrefix("10.0.1.0/25"), Record: mmdbtest.Country("TV", "Tuvalu")},
+		{Prefix: netip.MustParsePrefix("10.0.1.128/25"), Record: mmdbtest.Country("NR", "Nauru")},
+		{Prefix: netip.MustParsePrefix("10.0.2.0/24"), Record: mmdbtest.Country("KI", "Kiribati")},
+	})
+
+	diff, err := compare_geoip_databases(env.geoip_path, new_path, get_all_configured_countries())
+
+	if err != nil {
+		t.Fatalf("Cannot compare databases: %v", err)
+	}
+
+	if len(diff.Countries) != 1 {
+		t.Fatalf("Unexpected diff: %+v", diff)
+	}
+
+	country_diff := diff.Countries[0]
+
+	if !slices.Equal(country_diff.Added, []netip.Prefix{netip.MustParsePrefix("10.0.1.0/25")}) || country_diff.AddressesChange != 128 {
+		t.Errorf("Unexpected diff for TV: %+v", country_diff)
+	}
+
+	if len(country_diff.MovedFrom) != 1 || country_diff.MovedFrom[0].Country != "NR" {
+		t.Errorf("Unexpected moves for TV: %+v", country_diff.MovedFrom)
+	}
+
+	// We do not know which files belong to which source for merged sources
+	env.configuration["geo_sources"] = []map[string]any{{"type": "maxmind"}, {"type": "maxmind", "name": "fallback", "path": new_path}}
+	env.reload(t)
+
+	if _, err := compare_geoip_databases(env.geoip_path, new_path, []string{"TV"}); err == nil {
+		t.Errorf("We must reject db-diff for merged geo sources")
+	}
+}
+
+func TestDatabaseDiffForSubdivisions(t *testing.T) {
+	start_test_environment(t, test_networks, map[string]any{
+		"country_block_list": []string{"UA-43", "ua:Kyiv City"},
+	})
+
+	old_path := mmdbtest.WriteTemp(t, "GeoLite2-City", []mmdbtest.Network{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Record: mmdbtest.City("UA", "Ukraine", "43", "Crimea")},
+		{Prefix: netip.MustParsePrefix("10.0.1.0/24"), Record: mmdbtest.City("UA", "Ukraine", "30", "Kyiv City")},
+	})
+
+	// Half of Crimea moved to Kyiv City
+	new_path := mmdbtest.WriteTemp(t, "GeoLite2-City", []mmdbtest.Network{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/25"), Record: mmdbtest.City("UA", "Ukraine", "43", "Crimea")},
+		{Prefix: netip.MustParsePrefix("10.0.0.128/25"), Record: mmdbtest.City("UA", "Ukraine", "30", "Kyiv City")},
+		{Prefix: netip.MustParsePrefix("10.0.1.0/24"), Record: mmdbtest.City("UA", "Ukraine", "30", "Kyiv City")},
+	})
+
+	diff, err := compare_geoip_databases(old_path, new_path, get_all_configured_countries())
+
+	if err != nil {
+		t.Fatalf("Cannot compare databases: %v", err)
+	}
+
+	if len(diff.Countries) != 2 {
+		t.Fatalf("Unexpected diff: %+v", diff)
+	}
+
+	crimea, kyiv := diff.Countries[0], diff.Countries[1]
+
+	if crimea.Country != "UA-43" || crimea.OldAddresses != 256 || crimea.NewAddresses != 128 ||
+		!slices.Equal(crimea.Removed, []netip.Prefix{netip.MustParsePrefix("10.0.0.128/25")}) {
+		t.Errorf("Unexpected diff for UA-43: %+v", crimea)
+	}
+
+	// Network stays in same country but leaves subdivision
+	if len(crimea.MovedTo) != 1 || crimea.MovedTo[0].Country != "UA" || crimea.MovedTo[0].Addresses != 128 {
+		t.Errorf("Unexpected moves for UA-43: %+v", crimea.MovedTo)
+	}
+
+	if kyiv.Country != "UA:Kyiv City" || kyiv.OldAddresses != 256 || kyiv.NewAddresses != 384 || len(kyiv.MovedFrom) != 1 {
+		t.Errorf("Unexpected diff for UA:Kyiv City: %+v", kyiv)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/osrg/gobgp/v3/pkg/server"
+)
+
+// Configuration for BGP speaker which runs inside our process
+type EmbeddedBGPConfiguration struct {
+	ASN      uint32 `json:"asn"`
+	RouterID string `json:"router_id"`
+
+	// Port for incoming BGP connections, use -1 to disable listening
+	ListenPort      int32    `json:"listen_port"`
+	ListenAddresses []string `json:"listen_addresses"`
+
+	Neighbors []EmbeddedBGPNeighbor `json:"neighbors"`
+}
+
+type EmbeddedBGPNeighbor struct {
+	Address      string `json:"address"`
+	PeerASN      uint32 `json:"peer_asn"`
+	Description  string `json:"description"`
+	Password     string `json:"password"`
+	LocalAddress string `json:"local_address"`
+	Passive      bool   `json:"passive"`
+
+	// Zero means that multihop is disabled
+	EBGPMultihopTTL uint32 `json:"ebgp_multihop_ttl"`
+
+	// Address families in gobgp notation, ipv4-unicast by default
+	Families []string `json:"families"`
+}
+
+// Maps gobgp family names to API structures
+var bgp_families_by_name = map[string]*apipb.Family{
+	"ipv4-unicast": {Afi: apipb.Family_AFI_IP, Safi: apipb.Family_SAFI_UNICAST},
+	"ipv6-unicast": {Afi: apipb.Family_AFI_IP6, Safi: apipb.Family_SAFI_UNICAST},
+
+	"l3vpn-ipv4-unicast": {Afi: apipb.Family_AFI_IP, Safi: apipb.Family_SAFI_MPLS_VPN},
+	"l3vpn-ipv6-unicast": {Afi: apipb.Family_AFI_IP6, Safi: apipb.Family_SAFI_MPLS_VPN},
+}
+
+// Starts gobgp server in our process and configures all neighbors for it
+// We expose gRPC API on api_address and use it exactly as we use standalone gobgpd
+func start_embedded_bgp_server(bgp_conf EmbeddedBGPConfiguration, api_address string) (*server.BgpServer, error) {
+	if bgp_conf.ASN == 0 {
+		return nil, fmt.Errorf("ASN for embedded BGP speaker is not set")
+	}
+
+	if bgp_conf.RouterID == "" {
+		return nil, fmt.Errorf("Router ID for embedded BGP speaker is not set")
+	}
+
+	listen_port := bgp_conf.ListenPort
+
+	if listen_port == 0 {
+		listen_port = 179
+	}
+
+	bgp_server := server.NewBgpServer(
+		server.GrpcListenAddress(api_address),
+		server.LoggerOption(&GoBGPLogger{logger: slog.With("component", "gobgp")}),
+	)
+
+	go bgp_server.Serve()
+
+	err := bgp_server.StartBgp(context.Background(), &apipb.StartBgpRequest{
+		Global: &apipb.Global{
+			Asn:             bgp_conf.ASN,
+			RouterId:        bgp_conf.RouterID,
+			ListenPort:      listen_port,
+			ListenAddresses: bgp_conf.ListenAddresses,
+		},
+	})
+
+	if err != nil {
+		bgp_server.Stop()
+		return nil, fmt.Errorf("Cannot start BGP: %w", err)
+	}
+
+	slog.Info("Started embedded BGP speaker", "asn", bgp_conf.ASN, "router_id", bgp_conf.RouterID)
+
+	for _, neighbor := range bgp_conf.Neighbors {
+		peer, err := build_embedded_bgp_peer(neighbor)
+
+		if err != nil {
+			bgp_server.Stop()
+			return nil, err
+		}
+
+		err = bgp_server.AddPeer(context.Background(), &apipb.AddPeerRequest{Peer: peer})
+
+		if err != nil {
+			bgp_server.Stop()
+			return nil, fmt.Errorf("Cannot add neighbor %s: %w", neighbor.Address, err)
+		}
+
+		slog.Info("Added BGP neighbor", "peer", neighbor.Address, "peer_asn", neighbor.PeerASN)
+	}
+
+	return bgp_server, nil
+}
+
+// Converts neighbor from our configuration into gobgp API structure
+func build_embedded_bgp_peer(neighbor EmbeddedBGPNeighbor) (*apipb.Peer, error) {
+	if neighbor.Address == "" {
+		return nil, fmt.Errorf("Neighbor address is not set")
+	}
+
+	if neighbor.PeerASN == 0 {
+		return nil, fmt.Errorf("Peer ASN for neighbor %s is not set", neighbor.Address)
+	}
+
+	families := neighbor.Families
+
+	if len(families) == 0 {
+		families = []string{"ipv4-unicast"}
+	}
+
+	afi_safis := []*apipb.AfiSafi{}
+
+	for _, family_name := range families {
+		family, ok := bgp_families_by_name[family_name]
+
+		if !ok {
+			return nil, fmt.Errorf("Unknown address family %s for neighbor %s", family_name, neighbor.Address)
+		}
+
+		afi_safis = append(afi_safis, &apipb.AfiSafi{
+			Config: &apipb.AfiSafiConfig{Family: family, Enabled: true},
+		})
+	}
+
+	peer := &apipb.Peer{
+		Conf: &apipb.PeerConf{
+			NeighborAddress: neighbor.Address,
+			PeerAsn:         neighbor.PeerASN,
+			Description:     neighbor.Description,
+			AuthPassword:    neighbor.Password,
+		},
+		Transport: &apipb.Transport{
+			LocalAddress: neighbor.LocalAddress,
+			PassiveMode:  neighbor.Passive,
+		},
+		AfiSafis: afi_safis,
+	}
+
+	if neighbor.EBGPMultihopTTL > 0 {
+		peer.EbgpMultihop = &apipb.EbgpMultihop{
+			Enabled:     true,
+			MultihopTtl: neighbor.EBGPMultihopTTL,
+		}
+	}
+
+	return peer, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Third party list of networks which we block in addition to countries
+type BlockFeedConfiguration struct {
+	// Used in logs, lookup and statistics
+	Name string `json:"name"`
+
+	// spamhaus-drop (DROP and EDROP), firehol-netset or plain with prefix per line
+	Format string `json:"format"`
+
+	// Local file, please download it with cron
+	Path string `json:"path"`
+}
+
+var block_feed_formats = []string{"spamhaus-drop", "firehol-netset", "plain"}
+
+// Single network from feed
+type BlockFeedEntry struct {
+	Prefix netip.Prefix
+
+	// Comment from same line, Spamhaus keeps SBL reference there
+	Comment string
+}
+
+func validate_block_feeds(feeds []BlockFeedConfiguration) error {
+	names := []string{}
+
+	for index, feed := range feeds {
+		if feed.Name == "" {
+			return fmt.Errorf("Block feed %d does not have name", index)
+		}
+
+		if slices.Contains(names, feed.Name) {
+			return fmt.Errorf("We have multiple block feeds with name %s", feed.Name)
+		}
+
+		names = append(names, feed.Name)
+
+		if !slices.Contains(block_feed_formats, feed.Format) {
+			return fmt.Errorf("Unknown format %s for block feed %s, please use one of %v", feed.Format, feed.Name, block_feed_formats)
+		}
+
+		if feed.Path == "" {
+			return fmt.Errorf("Path for block feed %s is not set", feed.Name)
+		}
+	}
+
+	return nil
+}
+
+// Reads IPv4 networks from feed file
+func load_block_feed(feed BlockFeedConfiguration) ([]BlockFeedEntry, error) {
+	file, err := os.Open(feed.Path)
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open block feed %s: %w", feed.Name, err)
+	}
+
+	defer file.Close()
+
+	// Spamhaus uses ; for comments and FireHOL and plain lists use #
+	comment_separator := "#"
+
+	if feed.Format == "spamhaus-drop" {
+		comment_separator = ";"
+	}
+
+	entries := []BlockFeedEntry{}
+	skipped_ipv6_entries := 0
+
+	scanner := bufio.NewScanner(file)
+	line_number := 0
+
+	for scanner.Scan() {
+		line_number++
+
+		line := strings.TrimSpace(scanner.Text())
+		comment := ""
+
+		// Newer Spamhaus files are in JSON format with object per line
+		if feed.Format == "spamhaus-drop" && strings.HasPrefix(line, "{") {
+			line, comment, err = parse_spamhaus_json_line(line)
+
+			if err != nil {
+				return nil, fmt.Errorf("Cannot parse line %d of block feed %s: %w", line_number, feed.Name, err)
+			}
+		} else {
+			line, comment, _ = strings.Cut(line, comment_separator)
+
+			line = strings.TrimSpace(line)
+			comment = strings.TrimSpace(comment)
+		}
+
+		if line == "" {
+			continue
+		}
+
+		prefix, err := parse_prefix_or_address(line)
+
+		if err != nil {
+			return nil, fmt.Errorf("Cannot parse line %d of block feed %s: %w", line_number, feed.Name, err)
+		}
+
+		if !prefix.Addr().Is4() {
+			skipped_ipv6_entries++
+			continue
+		}
+
+		entries = append(entries, BlockFeedEntry{Prefix: prefix, Comment: comment})
+	}
+
+	if scanner.Err() != nil {
+		return nil, fmt.Errorf("Cannot read block feed %s: %w", feed.Name, scanner.Err())
+	}
+
+	slog.Info("Loaded block feed", "name", feed.Name, "path", feed.Path, "prefixes", len(entries), "skipped_ipv6", skipped_ipv6_entries)
+
+	return entries, nil
+}
+
+// Returns prefix and SBL reference from line of drop_v4.json, we return empty prefix for metadata line
+func parse_spamhaus_json_line(line string) (string, string, error) {
+	record := struct {
+		CIDR  string `json:"cidr"`
+		SBLID string `json:"sblid"`
+	}{}
+
+	err := json.Unmarshal([]byte(line), &record)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	return record.CIDR, record.SBLID, nil
+}
+
+// Loads all configured feeds, we stop on any error to avoid withdrawal of feed prefixes because of broken file
+func load_block_feeds(feeds []BlockFeedConfiguration) (map[string][]BlockFeedEntry, error) {
+	entries_by_feed := make(map[string][]BlockFeedEntry)
+
+	for _, feed := range feeds {
+		entries, err := load_block_feed(feed)
+
+		if err != nil {
+			return nil, err
+		}
+
+		entries_by_feed[feed.Name] = entries
+	}
+
+	return entries_by_feed, nil
+}
+
+func get_block_feed_prefixes(entries []BlockFeedEntry) []netip.Prefix {
+	prefixes := []netip.Prefix{}
+
+	for _, entry := range entries {
+		prefixes = append(prefixes, entry.Prefix)
+	}
+
+	return prefixes
+}
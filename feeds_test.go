@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func write_test_feed(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "feed")
+
+	err := os.WriteFile(path, []byte(content), 0644)
+
+	if err != nil {
+		t.Fatalf("Cannot write feed: %v", err)
+	}
+
+	return path
+}
+
+func get_feed_prefixes(t *testing.T, feed BlockFeedConfiguration) []netip.Prefix {
+	t.Helper()
+
+	entries, err := load_block_feed(feed)
+
+	if err != nil {
+		t.Fatalf("Cannot load block feed %s: %v", feed.Name, err)
+	}
+
+	return get_block_feed_prefixes(entries)
+}
+
+func TestLoadSpamhausDrop(t *testing.T) {
+	text_feed := BlockFeedConfiguration{Name: "drop", Format: "spamhaus-drop", Path: write_test_feed(t, `; Spamhaus DROP List 2026/10/18
+; Last-Modified: Sun, 18 Oct 2026 10:00:00 GMT
+
+10.0.0.0/24 ; SBL000001
+10.0.1.0/25 ; SBL000002
+2001:db8::/32 ; SBL000003
+`)}
+
+	entries, err := load_block_feed(text_feed)
+
+	if err != nil {
+		t.Fatalf("Cannot load block feed: %v", err)
+	}
+
+	expected := []BlockFeedEntry{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Comment: "SBL000001"},
+		{Prefix: netip.MustParsePrefix("10.0.1.0/25"), Comment: "SBL000002"},
+	}
+
+	if !slices.Equal(entries, expected) {
+		t.Errorf("Unexpected entries: %v", entries)
+	}
+
+	// Newer format with JSON object per line and metadata at the end
+	json_feed := BlockFeedConfiguration{Name: "drop", Format: "spamhaus-drop", Path: write_test_feed(t, `{"cidr":"10.0.0.0/24","sblid":"SBL000001","rir":"ripencc"}
+{"cidr":"10.0.1.0/25","sblid":"SBL000002","rir":"arin"}
+{"type":"metadata","timestamp":1792317600,"size":2,"records":2}
+`)}
+
+	entries, err = load_block_feed(json_feed)
+
+	if err != nil {
+		t.Fatalf("Cannot load block feed in JSON format: %v", err)
+	}
+
+	if !slices.Equal(entries, expected) {
+		t.Errorf("Unexpected entries from JSON: %v", entries)
+	}
+}
+
+func TestLoadNetsetFeeds(t *testing.T) {
+	content := `#
+# firehol_level1
+#
+10.0.0.0/24
+10.0.1.1 # single address
+10.0.2.7/24
+`
+
+	expected := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/24"),
+		netip.MustParsePrefix("10.0.1.1/32"),
+		netip.MustParsePrefix("10.0.2.0/24"),
+	}
+
+	for _, format := range []string{"firehol-netset", "plain"} {
+		feed := BlockFeedConfiguration{Name: format, Format: format, Path: write_test_feed(t, content)}
+
+		if prefixes := get_feed_prefixes(t, feed); !slices.Equal(prefixes, expected) {
+			t.Errorf("Unexpected prefixes from %s: %v", format, prefixes)
+		}
+	}
+}
+
+func TestBrokenBlockFeeds(t *testing.T) {
+	broken_feeds := []BlockFeedConfiguration{
+		{Name: "prefix", Format: "plain", Path: write_test_feed(t, "10.0.0.0/24\n10.0.0.0/33\n")},
+		{Name: "json", Format: "spamhaus-drop", Path: write_test_feed(t, "{\"cidr\": \n")},
+		// Spamhaus comments start with ; and # does not work there
+		{Name: "comment", Format: "spamhaus-drop", Path: write_test_feed(t, "# comment\n")},
+		{Name: "missing", Format: "plain", Path: filepath.Join(t.TempDir(), "missing")},
+	}
+
+	for _, feed := range broken_feeds {
+		if _, err := load_block_feed(feed); err == nil {
+			t.Errorf("We must fail on broken feed %s", feed.Name)
+		}
+	}
+
+	if err := validate_block_feeds([]BlockFeedConfiguration{{Name: "drop", Format: "csv", Path: "drop.csv"}}); err == nil {
+		t.Errorf("We must reject unknown format")
+	}
+}
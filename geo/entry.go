@@ -0,0 +1,180 @@
+package geo
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Entry of block list: country (UA), subdivision by ISO code (UA-43) or by English name (UA:Crimea)
+type BlockListEntry struct {
+	Country         string
+	SubdivisionCode string
+	SubdivisionName string
+}
+
+func ParseBlockListEntry(value string) (BlockListEntry, error) {
+	if country_code, subdivision_name, found := strings.Cut(value, ":"); found {
+		if country_code == "" || subdivision_name == "" {
+			return BlockListEntry{}, fmt.Errorf("Cannot parse %s, please use format UA:Crimea", value)
+		}
+
+		if !is_country_code(country_code) {
+			return BlockListEntry{}, fmt.Errorf("Cannot parse %s, country must be two letter ISO code", value)
+		}
+
+		return BlockListEntry{Country: strings.ToUpper(country_code), SubdivisionName: subdivision_name}, nil
+	}
+
+	if country_code, subdivision_code, found := strings.Cut(value, "-"); found {
+		if country_code == "" || subdivision_code == "" {
+			return BlockListEntry{}, fmt.Errorf("Cannot parse %s, please use format UA-43", value)
+		}
+
+		if !is_country_code(country_code) {
+			return BlockListEntry{}, fmt.Errorf("Cannot parse %s, country must be two letter ISO code", value)
+		}
+
+		return BlockListEntry{Country: strings.ToUpper(country_code), SubdivisionCode: strings.ToUpper(subdivision_code)}, nil
+	}
+
+	if !is_country_code(value) {
+		return BlockListEntry{}, fmt.Errorf("Cannot parse %s, please use two letter ISO code of country", value)
+	}
+
+	return BlockListEntry{Country: strings.ToUpper(value)}, nil
+}
+
+// Checks that value looks like ISO 3166-1 alpha-2 code
+func is_country_code(value string) bool {
+	if len(value) != 2 {
+		return false
+	}
+
+	for _, letter := range value {
+		if (letter < 'A' || letter > 'Z') && (letter < 'a' || letter > 'z') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Merged sources do not have subdivisions and we cannot match them
+func is_merged_source(source Source) bool {
+	switch s := source.(type) {
+	case *MergedSource:
+		return true
+	case *OverrideSource:
+		return is_merged_source(s.Source())
+	}
+
+	return false
+}
+
+// Returns canonical form of entry: UA, UA-43 or UA:Crimea
+func (entry BlockListEntry) String() string {
+	if entry.SubdivisionCode != "" {
+		return entry.Country + "-" + entry.SubdivisionCode
+	}
+
+	if entry.SubdivisionName != "" {
+		return entry.Country + ":" + entry.SubdivisionName
+	}
+
+	return entry.Country
+}
+
+func (entry BlockListEntry) HasSubdivision() bool {
+	return entry.SubdivisionCode != "" || entry.SubdivisionName != ""
+}
+
+// Checks that network belongs to country or subdivision from entry
+func (entry BlockListEntry) Matches(record Record) bool {
+	if record.Country != entry.Country {
+		return false
+	}
+
+	if !entry.HasSubdivision() {
+		return true
+	}
+
+	for _, subdivision := range record.Subdivisions {
+		if entry.SubdivisionCode != "" && strings.EqualFold(subdivision.Code, entry.SubdivisionCode) {
+			return true
+		}
+
+		if entry.SubdivisionName != "" && strings.EqualFold(subdivision.Name, entry.SubdivisionName) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Parses entry and checks that source can match it
+func ParseSourceEntry(source Source, value string) (BlockListEntry, error) {
+	entry, err := ParseBlockListEntry(value)
+
+	if err != nil {
+		return entry, err
+	}
+
+	if entry.HasSubdivision() && is_merged_source(source) {
+		return entry, fmt.Errorf("Subdivision %s cannot be used with multiple geo sources, they keep only countries after merge", value)
+	}
+
+	return entry, nil
+}
+
+// Loads all networks for country with specific ISO code
+// Luckily for us Hong Kong has HK code here and China has CN
+// Also accepts subdivisions like UA-43 or UA:Crimea
+func LoadNetworks(source Source, country_iso_code string) ([]netip.Prefix, error) {
+	networks_by_entry, err := LoadNetworksByEntry(source, []string{country_iso_code})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return networks_by_entry[country_iso_code], nil
+}
+
+// Loads networks for multiple countries and subdivisions during single walk over source
+// Every walk over large database takes a while and we do not walk it for every country
+func LoadNetworksByEntry(source Source, values []string) (map[string][]netip.Prefix, error) {
+	entries := []BlockListEntry{}
+	entry_values := []string{}
+	networks_by_entry := make(map[string][]netip.Prefix)
+
+	for _, value := range values {
+		if _, ok := networks_by_entry[value]; ok {
+			continue
+		}
+
+		entry, err := ParseSourceEntry(source, value)
+
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+		entry_values = append(entry_values, value)
+		networks_by_entry[value] = []netip.Prefix{}
+	}
+
+	err := source.WalkIPv4Networks(func(record Record) {
+		// Check that network belongs to countries we're interested in
+		for i, entry := range entries {
+			if entry.Matches(record) {
+				networks_by_entry[entry_values[i]] = append(networks_by_entry[entry_values[i]], record.Network)
+			}
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return networks_by_entry, nil
+}
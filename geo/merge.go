@@ -0,0 +1,508 @@
+package geo
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"go4.org/netipx"
+
+	"bitbucket.org/fastnetmon/country_lockdown/blockset"
+)
+
+// How we combine countries from multiple geo sources
+var MergeStrategies = []string{"union", "intersection", "primary-with-fallback"}
+
+// Multiple sources combined with merge strategy
+type MergedSource struct {
+	strategy string
+	names    []string
+	sources  []Source
+
+	// We calculate it on first walk because source may be walked multiple times, e.g. for stats and conflicts
+	merged_sets   map[string]*netipx.IPSet
+	country_names map[string]string
+
+	// Sorted ranges with registered country, first source which has it wins
+	registered_ranges []registered_range
+}
+
+type registered_range struct {
+	ip_range netipx.IPRange
+	country  string
+}
+
+// Combines already opened sources, names are used in errors and reports
+func NewMergedSource(strategy string, names []string, sources []Source) *MergedSource {
+	return &MergedSource{strategy: strategy, names: names, sources: sources, country_names: make(map[string]string)}
+}
+
+func (s *MergedSource) Strategy() string {
+	return s.strategy
+}
+
+func (s *MergedSource) Names() []string {
+	return s.names
+}
+
+func (s *MergedSource) Sources() []Source {
+	return s.sources
+}
+
+// We report newest build of all sources
+func (s *MergedSource) BuildEpoch() uint {
+	build_epoch := uint(0)
+
+	for _, source := range s.sources {
+		build_epoch = max(build_epoch, source.BuildEpoch())
+	}
+
+	return build_epoch
+}
+
+func (s *MergedSource) DatabaseType() string {
+	database_types := []string{}
+
+	for _, source := range s.sources {
+		database_types = append(database_types, source.DatabaseType())
+	}
+
+	return strings.Join(database_types, "+")
+}
+
+func (s *MergedSource) Close() error {
+	var close_err error
+
+	for _, source := range s.sources {
+		err := source.Close()
+
+		if err != nil {
+			close_err = err
+		}
+	}
+
+	return close_err
+}
+
+// Combines countries from all sources according to strategy
+func (s *MergedSource) merge() error {
+	if s.merged_sets != nil {
+		return nil
+	}
+
+	sets_by_source := []map[string]*netipx.IPSet{}
+	registered_sets_by_source := []map[string]*netipx.IPSet{}
+
+	for index, source := range s.sources {
+		sets, registered_sets, err := sets_by_country(source, s.country_names, true)
+
+		if err != nil {
+			return fmt.Errorf("Cannot load networks from geo source %s: %w", s.names[index], err)
+		}
+
+		sets_by_source = append(sets_by_source, sets)
+		registered_sets_by_source = append(registered_sets_by_source, registered_sets)
+	}
+
+	s.merged_sets = MergeSetsByCountry(s.strategy, sets_by_source)
+
+	// Registered country does not depend on strategy as we do not block by it
+	s.registered_ranges = get_registered_ranges(MergeSetsByCountry("primary-with-fallback", registered_sets_by_source))
+
+	return nil
+}
+
+func get_registered_ranges(registered_sets map[string]*netipx.IPSet) []registered_range {
+	registered_ranges := []registered_range{}
+
+	for country_code, set := range registered_sets {
+		for _, ip_range := range set.Ranges() {
+			registered_ranges = append(registered_ranges, registered_range{ip_range: ip_range, country: country_code})
+		}
+	}
+
+	sort.Slice(registered_ranges, func(i, j int) bool {
+		return registered_ranges[i].ip_range.From().Less(registered_ranges[j].ip_range.From())
+	})
+
+	return registered_ranges
+}
+
+// Splits network into parts with same registered country, parts without it have empty country
+func (s *MergedSource) split_by_registered_country(prefix netip.Prefix, callback func(network netip.Prefix, registered_country string)) {
+	prefix_range := netipx.RangeOfPrefix(prefix)
+
+	emit := func(from netip.Addr, to netip.Addr, registered_country string) {
+		for _, network := range netipx.IPRangeFrom(from, to).Prefixes() {
+			callback(network, registered_country)
+		}
+	}
+
+	// First range which ends inside of network or after it
+	index := sort.Search(len(s.registered_ranges), func(i int) bool {
+		return !s.registered_ranges[i].ip_range.To().Less(prefix_range.From())
+	})
+
+	next := prefix_range.From()
+
+	for ; index < len(s.registered_ranges); index++ {
+		ip_range := s.registered_ranges[index].ip_range
+
+		if prefix_range.To().Less(ip_range.From()) {
+			break
+		}
+
+		from := ip_range.From()
+
+		if from.Less(next) {
+			from = next
+		}
+
+		to := ip_range.To()
+
+		if prefix_range.To().Less(to) {
+			to = prefix_range.To()
+		}
+
+		if next.Less(from) {
+			emit(next, from.Prev(), "")
+		}
+
+		emit(from, to, s.registered_ranges[index].country)
+
+		if to == prefix_range.To() {
+			return
+		}
+
+		next = to.Next()
+	}
+
+	emit(next, prefix_range.To(), "")
+}
+
+// Returns network in every country which it belongs to after merge, with union one network may belong to multiple countries
+func (s *MergedSource) WalkIPv4Networks(callback func(record Record)) error {
+	err := s.merge()
+
+	if err != nil {
+		return err
+	}
+
+	// Subdivisions differ between sources and we do not keep them after merge
+	for country_code, set := range s.merged_sets {
+		for _, prefix := range set.Prefixes() {
+			s.split_by_registered_country(prefix, func(network netip.Prefix, registered_country string) {
+				callback(Record{Network: network, Country: country_code, CountryName: s.country_names[country_code], RegisteredCountry: registered_country})
+			})
+		}
+	}
+
+	return nil
+}
+
+// Returns country for address after merge, with union we return country from first source which has it
+func (s *MergedSource) Lookup(addr netip.Addr) (*Record, error) {
+	err := s.merge()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, source := range s.sources {
+		record, err := source.Lookup(addr)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if record == nil || record.Country == "" {
+			continue
+		}
+
+		merged_set, ok := s.merged_sets[record.Country]
+
+		if !ok || !merged_set.Contains(addr) {
+			continue
+		}
+
+		return record, nil
+	}
+
+	return nil, nil
+}
+
+// Loads all IPv4 networks from source grouped by country, networks without country are under empty code
+// Optionally collects names of countries
+func SetsByCountry(geo_source Source, country_names map[string]string) (map[string]*netipx.IPSet, error) {
+	sets, _, err := sets_by_country(geo_source, country_names, false)
+
+	return sets, err
+}
+
+// Same as SetsByCountry and also groups networks by registered country during same walk when asked
+func sets_by_country(geo_source Source, country_names map[string]string, with_registered bool) (map[string]*netipx.IPSet, map[string]*netipx.IPSet, error) {
+	builders := make(map[string]*netipx.IPSetBuilder)
+	registered_builders := make(map[string]*netipx.IPSetBuilder)
+
+	add_network := func(builders map[string]*netipx.IPSetBuilder, country_code string, network netip.Prefix) {
+		builder, ok := builders[country_code]
+
+		if !ok {
+			builder = &netipx.IPSetBuilder{}
+			builders[country_code] = builder
+		}
+
+		builder.AddPrefix(network)
+	}
+
+	err := geo_source.WalkIPv4Networks(func(record Record) {
+		add_network(builders, record.Country, record.Network)
+
+		if with_registered && record.RegisteredCountry != "" {
+			add_network(registered_builders, record.RegisteredCountry, record.Network)
+		}
+
+		if country_names != nil && record.CountryName != "" && country_names[record.Country] == "" {
+			country_names[record.Country] = record.CountryName
+		}
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sets, err := build_sets(builders)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	registered_sets, err := build_sets(registered_builders)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return sets, registered_sets, nil
+}
+
+func build_sets(builders map[string]*netipx.IPSetBuilder) (map[string]*netipx.IPSet, error) {
+	sets := make(map[string]*netipx.IPSet)
+
+	for country_code, builder := range builders {
+		set, err := builder.IPSet()
+
+		if err != nil {
+			return nil, fmt.Errorf("Cannot build set of networks for country %s: %w", country_code, err)
+		}
+
+		sets[country_code] = set
+	}
+
+	return sets, nil
+}
+
+// Combines sets of networks by country from multiple sources:
+// union: network belongs to country when any source says so
+// intersection: network belongs to country when all sources say so
+// primary-with-fallback: we use first source which has country for network
+func MergeSetsByCountry(strategy string, sets_by_source []map[string]*netipx.IPSet) map[string]*netipx.IPSet {
+	builders := make(map[string]*netipx.IPSetBuilder)
+
+	get_builder := func(country_code string) *netipx.IPSetBuilder {
+		builder, ok := builders[country_code]
+
+		if !ok {
+			builder = &netipx.IPSetBuilder{}
+			builders[country_code] = builder
+		}
+
+		return builder
+	}
+
+	switch strategy {
+	case "union":
+		for _, sets := range sets_by_source {
+			for country_code, set := range sets {
+				get_builder(country_code).AddSet(set)
+			}
+		}
+	case "intersection":
+		for country_code, set := range sets_by_source[0] {
+			builder := get_builder(country_code)
+			builder.AddSet(set)
+
+			for _, sets := range sets_by_source[1:] {
+				other_set, ok := sets[country_code]
+
+				if !ok {
+					other_set = &netipx.IPSet{}
+				}
+
+				builder.Intersect(other_set)
+			}
+		}
+	case "primary-with-fallback":
+		// Networks which have country in previous sources
+		var covered_networks netipx.IPSetBuilder
+
+		for _, sets := range sets_by_source {
+			covered_set := blockset.BuildSet(&covered_networks)
+
+			for country_code, set := range sets {
+				if country_code == "" {
+					continue
+				}
+
+				var fallback_networks netipx.IPSetBuilder
+
+				fallback_networks.AddSet(set)
+				fallback_networks.RemoveSet(covered_set)
+
+				get_builder(country_code).AddSet(blockset.BuildSet(&fallback_networks))
+			}
+
+			for country_code, set := range sets {
+				if country_code != "" {
+					covered_networks.AddSet(set)
+				}
+			}
+		}
+	}
+
+	merged_sets := make(map[string]*netipx.IPSet)
+
+	for country_code, builder := range builders {
+		set := blockset.BuildSet(builder)
+
+		// Networks without country are not interesting after merge
+		if country_code == "" || len(set.Prefixes()) == 0 {
+			continue
+		}
+
+		merged_sets[country_code] = set
+	}
+
+	return merged_sets
+}
+
+// Networks for which sources report different countries
+type Conflict struct {
+	Prefixes  []netip.Prefix `json:"prefixes"`
+	Addresses uint64         `json:"addresses"`
+
+	// Country from every source by name of source, empty when source does not have country for network
+	Countries map[string]string `json:"countries"`
+}
+
+// Finds networks where at least one source says that they belong to one of countries and others disagree
+func FindConflicts(names []string, sets_by_source []map[string]*netipx.IPSet, countries []string) []Conflict {
+	// Networks in any of countries according to at least one source but not all of them
+	var disputed_networks netipx.IPSetBuilder
+
+	for _, country_code := range countries {
+		var any_source netipx.IPSetBuilder
+		var all_sources netipx.IPSetBuilder
+
+		for index, sets := range sets_by_source {
+			set := sets[country_code]
+
+			if set == nil {
+				set = &netipx.IPSet{}
+			}
+
+			any_source.AddSet(set)
+
+			if index == 0 {
+				all_sources.AddSet(set)
+			} else {
+				all_sources.Intersect(set)
+			}
+		}
+
+		any_source.RemoveSet(blockset.BuildSet(&all_sources))
+
+		disputed_networks.AddSet(blockset.BuildSet(&any_source))
+	}
+
+	// We split disputed networks into groups with same country in every source
+	groups := map[string]*netipx.IPSet{"": blockset.BuildSet(&disputed_networks)}
+	group_countries := map[string]map[string]string{"": {}}
+
+	for index, sets := range sets_by_source {
+		next_groups := make(map[string]*netipx.IPSet)
+		next_group_countries := make(map[string]map[string]string)
+
+		for group_key, group_set := range groups {
+			// Networks which do not have country in this source
+			var remaining_networks netipx.IPSetBuilder
+			remaining_networks.AddSet(group_set)
+
+			for country_code, set := range sets {
+				if country_code == "" {
+					continue
+				}
+
+				prefixes := blockset.Intersect(group_set, set)
+
+				if len(prefixes) == 0 {
+					continue
+				}
+
+				var group_networks netipx.IPSetBuilder
+
+				for _, prefix := range prefixes {
+					group_networks.AddPrefix(prefix)
+				}
+
+				remaining_networks.RemoveSet(blockset.BuildSet(&group_networks))
+
+				next_group_key := group_key + "|" + country_code
+				next_groups[next_group_key] = blockset.BuildSet(&group_networks)
+				next_group_countries[next_group_key] = copy_with_country(group_countries[group_key], names[index], country_code)
+			}
+
+			remaining_set := blockset.BuildSet(&remaining_networks)
+
+			if len(remaining_set.Prefixes()) > 0 {
+				next_group_key := group_key + "|"
+				next_groups[next_group_key] = remaining_set
+				next_group_countries[next_group_key] = copy_with_country(group_countries[group_key], names[index], "")
+			}
+		}
+
+		groups = next_groups
+		group_countries = next_group_countries
+	}
+
+	conflicts := []Conflict{}
+
+	for group_key, group_set := range groups {
+		prefixes := group_set.Prefixes()
+
+		conflicts = append(conflicts, Conflict{
+			Prefixes:  prefixes,
+			Addresses: blockset.CountAddresses(prefixes),
+			Countries: group_countries[group_key],
+		})
+	}
+
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].Addresses > conflicts[j].Addresses
+	})
+
+	return conflicts
+}
+
+func copy_with_country(countries map[string]string, name string, country_code string) map[string]string {
+	result := make(map[string]string)
+
+	for key, value := range countries {
+		result[key] = value
+	}
+
+	result[name] = country_code
+
+	return result
+}
@@ -0,0 +1,146 @@
+package geo
+
+import (
+	"maps"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"go4.org/netipx"
+
+	"bitbucket.org/fastnetmon/country_lockdown/internal/mmdbtest"
+)
+
+// Two sources which disagree about 10.0.1.0/24 and where second one has network missing in first one
+func open_test_sources(t *testing.T) []Source {
+	primary := open_test_database(t, "maxmind", "GeoLite2-Country", []mmdbtest.Network{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Record: mmdbtest.Country("TV", "Tuvalu")},
+		{Prefix: netip.MustParsePrefix("10.0.1.0/24"), Record: mmdbtest.Country("TV", "Tuvalu")},
+	}, Options{})
+
+	secondary := open_test_database(t, "dbip", "DBIP-Country-Lite", []mmdbtest.Network{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Record: mmdbtest.Country("TV", "Tuvalu")},
+		{Prefix: netip.MustParsePrefix("10.0.1.0/24"), Record: mmdbtest.Country("NR", "Nauru")},
+		{Prefix: netip.MustParsePrefix("10.0.2.0/24"), Record: mmdbtest.Country("TV", "Tuvalu")},
+	}, Options{})
+
+	return []Source{primary, secondary}
+}
+
+func TestMergeStrategies(t *testing.T) {
+	expected_by_strategy := map[string][]string{
+		"union":                 {"10.0.0.0/23", "10.0.2.0/24"},
+		"intersection":          {"10.0.0.0/24"},
+		"primary-with-fallback": {"10.0.0.0/23", "10.0.2.0/24"},
+	}
+
+	for _, strategy := range MergeStrategies {
+		merged := NewMergedSource(strategy, []string{"maxmind", "dbip"}, open_test_sources(t))
+
+		expected := []netip.Prefix{}
+
+		for _, value := range expected_by_strategy[strategy] {
+			expected = append(expected, netip.MustParsePrefix(value))
+		}
+
+		if networks := load_networks(t, merged, "TV"); !slices.Equal(networks, expected) {
+			t.Errorf("Unexpected networks for TV with %s: %v, expected %v", strategy, networks, expected)
+		}
+	}
+
+	// Union keeps network in both countries
+	merged := NewMergedSource("union", []string{"maxmind", "dbip"}, open_test_sources(t))
+
+	if networks := load_networks(t, merged, "NR"); !slices.Equal(networks, []netip.Prefix{netip.MustParsePrefix("10.0.1.0/24")}) {
+		t.Errorf("Unexpected networks for NR with union: %v", networks)
+	}
+
+	// Primary source wins for disputed network
+	merged = NewMergedSource("primary-with-fallback", []string{"maxmind", "dbip"}, open_test_sources(t))
+
+	if networks := load_networks(t, merged, "NR"); len(networks) != 0 {
+		t.Errorf("Unexpected networks for NR with primary-with-fallback: %v", networks)
+	}
+}
+
+func TestFindConflicts(t *testing.T) {
+	sets_by_source := []map[string]*netipx.IPSet{}
+
+	for _, source := range open_test_sources(t) {
+		sets, err := SetsByCountry(source, nil)
+
+		if err != nil {
+			t.Fatalf("Cannot load sets: %v", err)
+		}
+
+		sets_by_source = append(sets_by_source, sets)
+	}
+
+	conflicts := FindConflicts([]string{"maxmind", "dbip"}, sets_by_source, []string{"TV"})
+
+	if len(conflicts) != 2 {
+		t.Fatalf("Unexpected conflicts: %+v", conflicts)
+	}
+
+	for _, conflict := range conflicts {
+		switch conflict.Countries["dbip"] {
+		case "NR":
+			if conflict.Countries["maxmind"] != "TV" || !slices.Equal(conflict.Prefixes, []netip.Prefix{netip.MustParsePrefix("10.0.1.0/24")}) {
+				t.Errorf("Unexpected conflict: %+v", conflict)
+			}
+		case "TV":
+			if conflict.Countries["maxmind"] != "" || !slices.Equal(conflict.Prefixes, []netip.Prefix{netip.MustParsePrefix("10.0.2.0/24")}) {
+				t.Errorf("Unexpected conflict: %+v", conflict)
+			}
+		default:
+			t.Errorf("Unexpected conflict: %+v", conflict)
+		}
+	}
+}
+
+func TestMergedSourceKeepsRegisteredCountry(t *testing.T) {
+	registered_in := func(record map[string]any, country_code string) map[string]any {
+		record["registered_country"] = map[string]any{"iso_code": country_code}
+
+		return record
+	}
+
+	primary := open_test_database(t, "maxmind", "GeoLite2-Country", []mmdbtest.Network{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/25"), Record: registered_in(mmdbtest.Country("TV", "Tuvalu"), "NR")},
+		{Prefix: netip.MustParsePrefix("10.0.0.128/25"), Record: mmdbtest.Country("TV", "Tuvalu")},
+	}, Options{})
+
+	secondary := open_test_database(t, "dbip", "DBIP-Country-Lite", []mmdbtest.Network{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Record: mmdbtest.Country("TV", "Tuvalu")},
+	}, Options{})
+
+	merged := NewMergedSource("union", []string{"maxmind", "dbip"}, []Source{primary, secondary})
+
+	registered := map[netip.Prefix]string{}
+
+	err := merged.WalkIPv4Networks(func(record Record) {
+		registered[record.Network] = record.RegisteredCountry
+	})
+
+	if err != nil {
+		t.Fatalf("Cannot walk merged source: %v", err)
+	}
+
+	expected := map[netip.Prefix]string{
+		netip.MustParsePrefix("10.0.0.0/25"):   "NR",
+		netip.MustParsePrefix("10.0.0.128/25"): "",
+	}
+
+	if !maps.Equal(registered, expected) {
+		t.Errorf("Unexpected registered countries: %v, expected %v", registered, expected)
+	}
+
+	// We do not have subdivisions after merge
+	if _, err := LoadNetworks(merged, "UA-43"); err == nil {
+		t.Errorf("Merged source must reject subdivisions")
+	}
+
+	if _, err := LoadNetworks(NewOverrideSource(merged, nil), "UA:Crimea"); err == nil {
+		t.Errorf("Merged source with overrides must reject subdivisions")
+	}
+}
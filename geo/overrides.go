@@ -0,0 +1,372 @@
+package geo
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"go4.org/netipx"
+
+	"bitbucket.org/fastnetmon/country_lockdown/blockset"
+)
+
+// Local fix for network which geo source places in wrong country
+type Override struct {
+	Prefix  netip.Prefix `json:"prefix"`
+	Country string       `json:"country"`
+	Comment string       `json:"comment,omitempty"`
+}
+
+// Networks which changed country because of override
+type OverrideUsage struct {
+	Override    Override `json:"override"`
+	FromCountry string   `json:"from_country"`
+	Addresses   uint64   `json:"addresses"`
+}
+
+type override_usage_key struct {
+	override_prefix netip.Prefix
+	from_country    string
+
+	// Networks from different subdivisions of same country may match different block list entries
+	from_subdivisions string
+}
+
+type override_usage struct {
+	// Country and subdivisions where networks were before override
+	from_record Record
+
+	networks netipx.IPSetBuilder
+}
+
+func get_subdivisions_key(subdivisions []Subdivision) string {
+	key := []string{}
+
+	for _, subdivision := range subdivisions {
+		key = append(key, subdivision.Code+":"+subdivision.Name)
+	}
+
+	return strings.Join(key, ",")
+}
+
+// Reads overrides from JSON file
+func LoadOverrides(path string) ([]Override, error) {
+	overrides_as_json, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read GeoIP overrides: %w", err)
+	}
+
+	overrides := []Override{}
+
+	err = json.Unmarshal(overrides_as_json, &overrides)
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot decode GeoIP overrides %s: %w", path, err)
+	}
+
+	seen_prefixes := make(map[netip.Prefix]bool)
+
+	for i, override := range overrides {
+		if !override.Prefix.IsValid() || !override.Prefix.Addr().Is4() {
+			return nil, fmt.Errorf("GeoIP override %d must have IPv4 prefix", i)
+		}
+
+		if override.Country == "" {
+			return nil, fmt.Errorf("GeoIP override for %s does not have country", override.Prefix)
+		}
+
+		// Typo like Ukraine instead of UA never matches anything and we must not ignore it silently
+		if !is_country_code(override.Country) {
+			return nil, fmt.Errorf("GeoIP override %d for %s has country %s but we expect two letter ISO code", i, override.Prefix, override.Country)
+		}
+
+		overrides[i].Prefix = override.Prefix.Masked()
+		overrides[i].Country = strings.ToUpper(override.Country)
+
+		if seen_prefixes[overrides[i].Prefix] {
+			return nil, fmt.Errorf("We have multiple GeoIP overrides for %s", overrides[i].Prefix)
+		}
+
+		seen_prefixes[overrides[i].Prefix] = true
+	}
+
+	return overrides, nil
+}
+
+// Geo source with local overrides on top of it
+// Overrides always win over source and more specific override wins over less specific one
+type OverrideSource struct {
+	source    Source
+	overrides []Override
+
+	// Part of every override which is not covered by more specific overrides
+	effective_sets []*netipx.IPSet
+
+	// All networks from overrides
+	covered_set *netipx.IPSet
+
+	usage map[override_usage_key]*override_usage
+
+	// Networks of every override which we found in source
+	found_networks []*netipx.IPSetBuilder
+}
+
+func NewOverrideSource(source Source, overrides []Override) *OverrideSource {
+	override_source := &OverrideSource{
+		source:    source,
+		overrides: overrides,
+		usage:     make(map[override_usage_key]*override_usage),
+	}
+
+	var covered_networks netipx.IPSetBuilder
+
+	for _, override := range overrides {
+		var builder netipx.IPSetBuilder
+
+		builder.AddPrefix(override.Prefix)
+
+		// Longest prefix wins
+		for _, other_override := range overrides {
+			if other_override.Prefix.Bits() > override.Prefix.Bits() && override.Prefix.Overlaps(other_override.Prefix) {
+				builder.RemovePrefix(other_override.Prefix)
+			}
+		}
+
+		override_source.effective_sets = append(override_source.effective_sets, blockset.BuildSet(&builder))
+		override_source.found_networks = append(override_source.found_networks, &netipx.IPSetBuilder{})
+
+		covered_networks.AddPrefix(override.Prefix)
+	}
+
+	override_source.covered_set = blockset.BuildSet(&covered_networks)
+
+	return override_source
+}
+
+// Returns source without overrides
+func (s *OverrideSource) Source() Source {
+	return s.source
+}
+
+func (s *OverrideSource) BuildEpoch() uint {
+	return s.source.BuildEpoch()
+}
+
+func (s *OverrideSource) DatabaseType() string {
+	return s.source.DatabaseType()
+}
+
+func (s *OverrideSource) Close() error {
+	return s.source.Close()
+}
+
+func (s *OverrideSource) WalkIPv4Networks(callback func(record Record)) error {
+	// Networks of every override which we found in source during this walk
+	walk_found_networks := make([]netipx.IPSetBuilder, len(s.overrides))
+
+	err := s.source.WalkIPv4Networks(func(record Record) {
+		// Fast path for vast majority of networks
+		if !s.covered_set.OverlapsPrefix(record.Network) {
+			callback(record)
+			return
+		}
+
+		var remaining_networks netipx.IPSetBuilder
+
+		remaining_networks.AddPrefix(record.Network)
+		remaining_networks.RemoveSet(s.covered_set)
+
+		for _, prefix := range blockset.BuildSet(&remaining_networks).Prefixes() {
+			remaining_record := record
+			remaining_record.Network = prefix
+
+			callback(remaining_record)
+		}
+
+		var record_networks netipx.IPSetBuilder
+
+		record_networks.AddPrefix(record.Network)
+
+		record_set := blockset.BuildSet(&record_networks)
+
+		// We track where override moved networks from
+		for i, override := range s.overrides {
+			prefixes := blockset.Intersect(s.effective_sets[i], record_set)
+
+			if len(prefixes) == 0 {
+				continue
+			}
+
+			for _, prefix := range prefixes {
+				s.found_networks[i].AddPrefix(prefix)
+				walk_found_networks[i].AddPrefix(prefix)
+
+				callback(get_override_record(prefix, override, record))
+			}
+
+			if override.Country == record.Country {
+				continue
+			}
+
+			key := override_usage_key{override_prefix: override.Prefix, from_country: record.Country, from_subdivisions: get_subdivisions_key(record.Subdivisions)}
+
+			if s.usage[key] == nil {
+				s.usage[key] = &override_usage{from_record: Record{Country: record.Country, Subdivisions: record.Subdivisions}}
+			}
+
+			for _, prefix := range prefixes {
+				s.usage[key].networks.AddPrefix(prefix)
+			}
+		}
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// Networks which source does not have at all
+	for i, override := range s.overrides {
+		for _, prefix := range blockset.Subtract(s.effective_sets[i], blockset.BuildSet(&walk_found_networks[i])) {
+			callback(Record{Network: prefix, Country: override.Country})
+		}
+	}
+
+	return nil
+}
+
+// Moves network to country of override, we keep subdivisions only when override keeps country
+// Registered country does not depend on location and we always keep it
+func get_override_record(network netip.Prefix, override Override, record Record) Record {
+	override_record := Record{Network: network, Country: override.Country, RegisteredCountry: record.RegisteredCountry}
+
+	if override.Country == record.Country {
+		override_record.CountryName = record.CountryName
+		override_record.Subdivisions = record.Subdivisions
+	}
+
+	return override_record
+}
+
+// Returns most specific override for address or nil
+func (s *OverrideSource) FindOverride(addr netip.Addr) *Override {
+	var best_override *Override
+
+	for i, override := range s.overrides {
+		if !override.Prefix.Contains(addr) {
+			continue
+		}
+
+		if best_override == nil || override.Prefix.Bits() > best_override.Prefix.Bits() {
+			best_override = &s.overrides[i]
+		}
+	}
+
+	return best_override
+}
+
+func (s *OverrideSource) Lookup(addr netip.Addr) (*Record, error) {
+	override := s.FindOverride(addr)
+
+	record, err := s.source.Lookup(addr)
+
+	if override == nil || err != nil {
+		return record, err
+	}
+
+	if record == nil {
+		return &Record{Network: override.Prefix, Country: override.Country}, nil
+	}
+
+	override_record := get_override_record(override.Prefix, *override, *record)
+
+	return &override_record, nil
+}
+
+// Returns networks which changed country because of overrides during walks
+// Only for networks which match countries or subdivisions from entries before or after override
+func (s *OverrideSource) Usage(values []string) []OverrideUsage {
+	entries := []BlockListEntry{}
+
+	for _, value := range values {
+		entry, err := ParseBlockListEntry(value)
+
+		if err == nil {
+			entries = append(entries, entry)
+		}
+	}
+
+	matches_any_entry := func(record Record) bool {
+		return slices.ContainsFunc(entries, func(entry BlockListEntry) bool { return entry.Matches(record) })
+	}
+
+	// We merge networks from different subdivisions of same country into single line of report
+	usage_networks := make(map[override_usage_key]*netipx.IPSetBuilder)
+
+	for key, override_usage := range s.usage {
+		var override Override
+
+		for _, candidate := range s.overrides {
+			if candidate.Prefix == key.override_prefix {
+				override = candidate
+			}
+		}
+
+		if !matches_any_entry(override_usage.from_record) && !matches_any_entry(get_override_record(override.Prefix, override, override_usage.from_record)) {
+			continue
+		}
+
+		report_key := override_usage_key{override_prefix: key.override_prefix, from_country: key.from_country}
+
+		if usage_networks[report_key] == nil {
+			usage_networks[report_key] = &netipx.IPSetBuilder{}
+		}
+
+		usage_networks[report_key].AddSet(blockset.BuildSet(&override_usage.networks))
+	}
+
+	usage := []OverrideUsage{}
+
+	for key, builder := range usage_networks {
+		for _, override := range s.overrides {
+			if override.Prefix != key.override_prefix {
+				continue
+			}
+
+			usage = append(usage, OverrideUsage{
+				Override:    override,
+				FromCountry: key.from_country,
+				Addresses:   blockset.CountAddresses(blockset.BuildSet(builder).Prefixes()),
+			})
+		}
+	}
+
+	// Networks which source does not have at all
+	for i, override := range s.overrides {
+		if !matches_any_entry(Record{Country: override.Country}) {
+			continue
+		}
+
+		missing_prefixes := blockset.Subtract(s.effective_sets[i], blockset.BuildSet(s.found_networks[i]))
+
+		if len(missing_prefixes) == 0 {
+			continue
+		}
+
+		usage = append(usage, OverrideUsage{
+			Override:    override,
+			FromCountry: "",
+			Addresses:   blockset.CountAddresses(missing_prefixes),
+		})
+	}
+
+	sort.Slice(usage, func(i, j int) bool {
+		return usage[i].Override.Prefix.String() < usage[j].Override.Prefix.String()
+	})
+
+	return usage
+}
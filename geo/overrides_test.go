@@ -0,0 +1,153 @@
+package geo
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"bitbucket.org/fastnetmon/country_lockdown/internal/mmdbtest"
+)
+
+func write_overrides(t *testing.T, overrides_as_json string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "geoip_overrides.json")
+
+	err := os.WriteFile(path, []byte(overrides_as_json), 0644)
+
+	if err != nil {
+		t.Fatalf("Cannot write overrides: %v", err)
+	}
+
+	return path
+}
+
+func TestLoadOverridesValidation(t *testing.T) {
+	for _, overrides_as_json := range []string{
+		`[{"prefix": "2001:db8::/32", "country": "TV"}]`,
+		`[{"prefix": "10.0.0.0/24"}]`,
+		`[{"prefix": "10.0.0.0/24", "country": "Ukraine"}]`,
+		`[{"prefix": "10.0.0.0/24", "country": "U1"}]`,
+		`[{"prefix": "10.0.0.0/24", "country": "TV"}, {"prefix": "10.0.0.1/24", "country": "NR"}]`,
+	} {
+		if _, err := LoadOverrides(write_overrides(t, overrides_as_json)); err == nil {
+			t.Errorf("We must not accept overrides %s", overrides_as_json)
+		}
+	}
+
+	overrides, err := LoadOverrides(write_overrides(t, `[{"prefix": "10.0.0.1/24", "country": "tv"}]`))
+
+	if err != nil {
+		t.Fatalf("Cannot load overrides: %v", err)
+	}
+
+	if overrides[0].Prefix != netip.MustParsePrefix("10.0.0.0/24") || overrides[0].Country != "TV" {
+		t.Errorf("Override must be normalised: %+v", overrides[0])
+	}
+}
+
+func TestOverridesLongestPrefixWins(t *testing.T) {
+	source := open_test_database(t, "maxmind", "GeoLite2-Country", []mmdbtest.Network{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Record: mmdbtest.Country("NR", "Nauru")},
+		{Prefix: netip.MustParsePrefix("10.1.0.0/24"), Record: mmdbtest.Country("TV", "Tuvalu")},
+	}, Options{})
+
+	overrides, err := LoadOverrides(write_overrides(t, `[
+		{"prefix": "10.0.0.0/23", "country": "TV", "comment": "moved"},
+		{"prefix": "10.0.1.0/24", "country": "NR"},
+		{"prefix": "192.0.2.0/24", "country": "TV"}
+	]`))
+
+	if err != nil {
+		t.Fatalf("Cannot load overrides: %v", err)
+	}
+
+	override_source := NewOverrideSource(source, overrides)
+
+	expected_tv := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/24"),
+		netip.MustParsePrefix("10.1.0.0/24"),
+		netip.MustParsePrefix("192.0.2.0/24"),
+	}
+
+	if networks := load_networks(t, override_source, "TV"); !slices.Equal(networks, expected_tv) {
+		t.Errorf("Unexpected networks for TV: %v, expected %v", networks, expected_tv)
+	}
+
+	for address, country := range map[string]string{"10.0.0.1": "TV", "10.0.1.1": "NR", "10.0.2.1": "NR", "192.0.2.1": "TV"} {
+		record, err := override_source.Lookup(netip.MustParseAddr(address))
+
+		if err != nil {
+			t.Fatalf("Cannot lookup %s: %v", address, err)
+		}
+
+		if record == nil || record.Country != country {
+			t.Errorf("Unexpected record for %s: %+v, expected %s", address, record, country)
+		}
+	}
+
+	if override := override_source.FindOverride(netip.MustParseAddr("10.0.1.1")); override == nil || override.Prefix != netip.MustParsePrefix("10.0.1.0/24") {
+		t.Errorf("Most specific override must win: %+v", override)
+	}
+
+	usage := override_source.Usage([]string{"TV"})
+
+	// 10.0.0.0/24 moved from NR to TV and 192.0.2.0/24 is missing in database
+	if len(usage) != 2 {
+		t.Fatalf("Unexpected usage: %+v", usage)
+	}
+
+	if usage[0].Override.Prefix != netip.MustParsePrefix("10.0.0.0/23") || usage[0].FromCountry != "NR" || usage[0].Addresses != 256 {
+		t.Errorf("Unexpected usage for 10.0.0.0/23: %+v", usage[0])
+	}
+
+	if usage[1].Override.Prefix != netip.MustParsePrefix("192.0.2.0/24") || usage[1].FromCountry != "" || usage[1].Addresses != 256 {
+		t.Errorf("Unexpected usage for 192.0.2.0/24: %+v", usage[1])
+	}
+}
+
+func TestOverridesKeepSubdivisions(t *testing.T) {
+	source := open_test_database(t, "maxmind", "GeoLite2-City", []mmdbtest.Network{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Record: mmdbtest.City("UA", "Ukraine", "43", "Crimea")},
+		{Prefix: netip.MustParsePrefix("10.0.1.0/24"), Record: mmdbtest.City("UA", "Ukraine", "30", "Kyiv City")},
+	}, Options{})
+
+	// First override keeps country and second one moves network to other country
+	override_source := NewOverrideSource(source, []Override{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/25"), Country: "UA"},
+		{Prefix: netip.MustParsePrefix("10.0.1.0/25"), Country: "TV"},
+	})
+
+	if networks := load_networks(t, override_source, "UA-43"); !slices.Equal(networks, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}) {
+		t.Errorf("Unexpected networks for UA-43: %v", networks)
+	}
+
+	if networks := load_networks(t, override_source, "UA-30"); !slices.Equal(networks, []netip.Prefix{netip.MustParsePrefix("10.0.1.128/25")}) {
+		t.Errorf("Unexpected networks for UA-30: %v", networks)
+	}
+
+	record, err := override_source.Lookup(netip.MustParseAddr("10.0.0.1"))
+
+	if err != nil {
+		t.Fatalf("Cannot lookup: %v", err)
+	}
+
+	if record == nil || len(record.Subdivisions) != 1 || record.Subdivisions[0].Code != "43" {
+		t.Errorf("Override must keep subdivisions: %+v", record)
+	}
+
+	// Network moved from UA-30 to TV
+	for _, values := range [][]string{{"UA-30"}, {"ua:kyiv city"}, {"TV"}} {
+		usage := override_source.Usage(values)
+
+		if len(usage) != 1 || usage[0].FromCountry != "UA" || usage[0].Addresses != 128 {
+			t.Errorf("Unexpected usage for %v: %+v", values, usage)
+		}
+	}
+
+	if usage := override_source.Usage([]string{"UA-43"}); len(usage) != 0 {
+		t.Errorf("Override for UA-30 must not be reported for UA-43: %+v", usage)
+	}
+}
@@ -0,0 +1,667 @@
+// Package geo reads mapping between networks and countries from MaxMind, DB-IP, IPinfo, IP2Location and RIR statistics
+package geo
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"go4.org/netipx"
+)
+
+// Single network from geo source
+type Record struct {
+	Network netip.Prefix
+
+	// ISO code, empty when source does not have country for network
+	Country     string
+	CountryName string
+
+	// Only MaxMind and DB-IP provide it
+	RegisteredCountry string
+
+	// Only City and Enterprise databases provide them
+	Subdivisions []Subdivision
+}
+
+type Subdivision struct {
+	// ISO 3166-2 code without country, e.g. 43 for UA-43
+	Code string
+	Name string
+}
+
+// Common interface for all databases with geolocation
+type Source interface {
+	// Calls callback for every IPv4 network
+	WalkIPv4Networks(callback func(record Record)) error
+
+	// Returns network for address or nil when source does not have it
+	Lookup(addr netip.Addr) (*Record, error)
+
+	BuildEpoch() uint
+	DatabaseType() string
+
+	Close() error
+}
+
+var SourceTypes = []string{"maxmind", "dbip", "ipinfo", "ip2location-csv", "ip2location-bin", "rir-delegated"}
+
+// Settings which apply only to some types of sources
+type Options struct {
+	// Only for GeoIP2-Enterprise: we ignore countries and subdivisions with lower confidence, from 0 to 100
+	MinConfidence uint
+}
+
+// Opens source of specified type
+func Open(source_type string, paths []string, options Options) (Source, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("Path for geo source %s is not set", source_type)
+	}
+
+	if len(paths) > 1 && source_type != "rir-delegated" {
+		return nil, fmt.Errorf("Geo source %s supports only single file", source_type)
+	}
+
+	switch source_type {
+	case "maxmind", "dbip", "ipinfo":
+		return open_mmdb_geo_source(source_type, paths[0], options)
+	case "ip2location-csv":
+		return load_ip2location_csv(paths[0])
+	case "ip2location-bin":
+		return load_ip2location_bin(paths[0])
+	case "rir-delegated":
+		return load_rir_delegated_stats(paths)
+	}
+
+	return nil, fmt.Errorf("Unknown geo source type %s, please use one of %v", source_type, SourceTypes)
+}
+
+// MaxMind DB format which is used by MaxMind, DB-IP and IPinfo
+type MMDBSource struct {
+	source_type string
+	reader      *maxminddb.Reader
+
+	// We ignore countries and subdivisions with lower confidence, only for Enterprise databases
+	min_confidence uint8
+}
+
+// Fields which we need from Country, City and Enterprise databases
+// We do not use geoip2.City or geoip2.Enterprise to avoid decoding of city names for every network
+type MaxMindCountryRecord struct {
+	Country struct {
+		Confidence uint8             `maxminddb:"confidence"`
+		IsoCode    string            `maxminddb:"iso_code"`
+		Names      map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+	Subdivisions []struct {
+		Confidence uint8             `maxminddb:"confidence"`
+		IsoCode    string            `maxminddb:"iso_code"`
+		Names      map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+}
+
+// IPinfo keeps country code in flat field, older databases use country and newer country_code
+type IPinfoCountryRecord struct {
+	Country     string `maxminddb:"country"`
+	CountryCode string `maxminddb:"country_code"`
+	CountryName string `maxminddb:"country_name"`
+}
+
+func open_mmdb_geo_source(source_type string, path string, options Options) (*MMDBSource, error) {
+	reader, err := maxminddb.Open(path)
+
+	if err != nil {
+		return nil, fmt.Errorf("Can't open country mapping file: %v", err)
+	}
+
+	source := &MMDBSource{source_type: source_type, reader: reader}
+
+	// Only Enterprise databases have confidence
+	if reader.Metadata.DatabaseType == "GeoIP2-Enterprise" {
+		source.min_confidence = uint8(options.MinConfidence)
+	}
+
+	// We need to be sure that database has correct type
+	err = CheckDatabaseType(source_type, reader.Metadata.DatabaseType)
+
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+
+	return source, nil
+}
+
+var maxmind_database_types = []string{"GeoIP2-Country", "GeoLite2-Country", "GeoIP2-City", "GeoLite2-City", "GeoIP2-Enterprise"}
+
+// Checks that we can use database of this type
+func CheckDatabaseType(source_type string, database_type string) error {
+	switch source_type {
+	case "maxmind":
+		// City and Enterprise databases have same country data and subdivisions on top
+		if !slices.Contains(maxmind_database_types, database_type) {
+			return fmt.Errorf("Wrong type of GeoIP database %s, please use one of %v", database_type, maxmind_database_types)
+		}
+	case "dbip":
+		if !strings.HasPrefix(database_type, "DBIP-Country") {
+			return fmt.Errorf("Wrong type of DB-IP database %s, please use DBIP-Country or DBIP-Country-Lite", database_type)
+		}
+	case "ipinfo":
+		// IPinfo uses different names for database types and we check only record format
+	default:
+		return fmt.Errorf("Geo source %s does not use MaxMind DB format", source_type)
+	}
+
+	return nil
+}
+
+func (s *MMDBSource) BuildEpoch() uint {
+	return s.reader.Metadata.BuildEpoch
+}
+
+func (s *MMDBSource) DatabaseType() string {
+	return s.reader.Metadata.DatabaseType
+}
+
+func (s *MMDBSource) Close() error {
+	return s.reader.Close()
+}
+
+// Decodes record in format of specific vendor
+func (s *MMDBSource) decode_record(decode func(result any) error) (Record, error) {
+	if s.source_type == "ipinfo" {
+		record := IPinfoCountryRecord{}
+
+		err := decode(&record)
+
+		if err != nil {
+			return Record{}, err
+		}
+
+		country_code := record.CountryCode
+
+		if country_code == "" {
+			country_code = record.Country
+		}
+
+		return Record{Country: country_code, CountryName: record.CountryName}, nil
+	}
+
+	// All fields https://github.com/oschwald/geoip2-golang/blob/main/reader.go#L139
+	record := MaxMindCountryRecord{}
+
+	err := decode(&record)
+
+	if err != nil {
+		return Record{}, err
+	}
+
+	geo_record := Record{RegisteredCountry: record.RegisteredCountry.IsoCode}
+
+	// Network without country is not blocked
+	if record.Country.Confidence < s.min_confidence {
+		return geo_record, nil
+	}
+
+	geo_record.Country = record.Country.IsoCode
+	geo_record.CountryName = record.Country.Names["en"]
+
+	for _, subdivision := range record.Subdivisions {
+		if subdivision.Confidence < s.min_confidence {
+			continue
+		}
+
+		geo_record.Subdivisions = append(geo_record.Subdivisions, Subdivision{Code: subdivision.IsoCode, Name: subdivision.Names["en"]})
+	}
+
+	return geo_record, nil
+}
+
+func (s *MMDBSource) WalkIPv4Networks(callback func(record Record)) error {
+	// We use SkipAliasedNetworks because it's recommended in official documentation:
+	// https://pkg.go.dev/github.com/oschwald/maxminddb-golang#SkipAliasedNetworks
+
+	// Please note that a MaxMind DB may map IPv4 networks into several locations
+	// in an IPv6 database. This iterator will iterate over all of these locations
+	// separately. To only iterate over the IPv4 networks once, use the
+	// SkipAliasedNetworks option.
+	networks := s.reader.Networks(maxminddb.SkipAliasedNetworks)
+
+	for networks.Next() {
+		var subnet *net.IPNet
+
+		record, err := s.decode_record(func(result any) error {
+			var err error
+			subnet, err = networks.Network(result)
+			return err
+		})
+
+		if err != nil {
+			return fmt.Errorf("Cannot decode field in dataset: %v", err)
+		}
+
+		// Filter out IPv6 networks
+		// Well, it's IPNet and we need to use some fancy custom logic to find out type of it
+		if subnet.IP.To4() == nil {
+			continue
+		}
+
+		// TODO:
+		// We do not expect private ranges here but we have to be sure
+		// Well, I do not think that we have any functions to do so for prefixes
+		// Skip for now
+
+		// Parse it into fancy netip.Prefix
+		prefix, err := netip.ParsePrefix(subnet.String())
+
+		if err != nil {
+			slog.Warn("Cannot parse network from GeoIP database as prefix", "prefix", subnet.String(), "error", err)
+			// Well, we accept some malformed prefixes and do not return error in this case
+			continue
+		}
+
+		record.Network = prefix
+
+		callback(record)
+	}
+
+	if networks.Err() != nil {
+		return fmt.Errorf("Cannot correctly iterate over all available networks %w", networks.Err())
+	}
+
+	return nil
+}
+
+func (s *MMDBSource) Lookup(addr netip.Addr) (*Record, error) {
+	var network *net.IPNet
+	var found bool
+
+	record, err := s.decode_record(func(result any) error {
+		var err error
+		network, found, err = s.reader.LookupNetwork(net.IP(addr.AsSlice()), result)
+		return err
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot lookup %s: %v", addr, err)
+	}
+
+	if !found {
+		return nil, nil
+	}
+
+	prefix, ok := netipx.FromStdIPNet(network)
+
+	if !ok {
+		return nil, fmt.Errorf("Cannot parse network %s", network)
+	}
+
+	record.Network = prefix.Masked()
+
+	return &record, nil
+}
+
+// Source which we load into memory completely from CSV and text files
+type ListSource struct {
+	database_type string
+	build_epoch   uint
+
+	records []Record
+}
+
+func (s *ListSource) BuildEpoch() uint {
+	return s.build_epoch
+}
+
+func (s *ListSource) DatabaseType() string {
+	return s.database_type
+}
+
+func (s *ListSource) Close() error {
+	return nil
+}
+
+func (s *ListSource) WalkIPv4Networks(callback func(record Record)) error {
+	for _, record := range s.records {
+		callback(record)
+	}
+
+	return nil
+}
+
+func (s *ListSource) Lookup(addr netip.Addr) (*Record, error) {
+	for _, record := range s.records {
+		if record.Network.Contains(addr) {
+			return &record, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Splits range of addresses into prefixes and adds them with country
+func (s *ListSource) add_range(from netip.Addr, to netip.Addr, country_code string, country_name string) {
+	ip_range := netipx.IPRangeFrom(from, to)
+
+	if !ip_range.IsValid() {
+		slog.Warn("Skip invalid range in geo source", "from", from, "to", to)
+		return
+	}
+
+	for _, prefix := range ip_range.Prefixes() {
+		s.records = append(s.records, Record{Network: prefix, Country: country_code, CountryName: country_name})
+	}
+}
+
+// Returns modification time of file, we use it as build time for formats without it
+func get_file_modification_epoch(path string) uint {
+	file_info, err := os.Stat(path)
+
+	if err != nil {
+		return 0
+	}
+
+	return uint(file_info.ModTime().Unix())
+}
+
+// IP2Location keeps addresses as decimal numbers, in IPv6 files IPv4 addresses are mapped into ::ffff:0:0/96
+func parse_ip2location_address(value string) (netip.Addr, bool) {
+	number, ok := new(big.Int).SetString(value, 10)
+
+	if !ok || number.Sign() < 0 {
+		return netip.Addr{}, false
+	}
+
+	if number.IsUint64() && number.Uint64() <= 0xffffffff {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(number.Uint64()))
+
+		return netip.AddrFrom4([4]byte(b)), true
+	}
+
+	if number.BitLen() > 128 {
+		return netip.Addr{}, false
+	}
+
+	b := make([]byte, 16)
+	number.FillBytes(b)
+
+	addr := netip.AddrFrom16([16]byte(b))
+
+	// We support only IPv4 for now
+	if !addr.Is4In6() {
+		return netip.Addr{}, false
+	}
+
+	return addr.Unmap(), true
+}
+
+// Loads IP2Location CSV: "ip_from","ip_to","country_code","country_name"
+func load_ip2location_csv(path string) (*ListSource, error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open IP2Location database: %w", err)
+	}
+
+	defer file.Close()
+
+	source := &ListSource{database_type: "IP2Location-CSV", build_epoch: get_file_modification_epoch(path)}
+
+	reader := csv.NewReader(bufio.NewReader(file))
+
+	// Some databases have more columns than country
+	reader.FieldsPerRecord = -1
+
+	for {
+		fields, err := reader.Read()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Cannot parse IP2Location database: %w", err)
+		}
+
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("IP2Location database must have at least 4 columns but we have %d", len(fields))
+		}
+
+		from, from_ok := parse_ip2location_address(fields[0])
+		to, to_ok := parse_ip2location_address(fields[1])
+
+		if !from_ok || !to_ok {
+			continue
+		}
+
+		// They use - for networks without country
+		if fields[2] == "-" {
+			continue
+		}
+
+		source.add_range(from, to, fields[2], fields[3])
+	}
+
+	return source, nil
+}
+
+// Loads IP2Location BIN database
+// Format is described in official libraries: https://github.com/ip2location/ip2location-go
+func load_ip2location_bin(path string) (*ListSource, error) {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open IP2Location database: %w", err)
+	}
+
+	if len(data) < 64 {
+		return nil, fmt.Errorf("IP2Location database is too short")
+	}
+
+	// All offsets in header and rows start from 1
+	read_uint32 := func(position uint32) (uint32, error) {
+		if position == 0 || uint64(position)+3 > uint64(len(data)) {
+			return 0, fmt.Errorf("Offset %d is outside of IP2Location database", position)
+		}
+
+		return binary.LittleEndian.Uint32(data[position-1:]), nil
+	}
+
+	// But offsets of strings start from 0 and first byte keeps length
+	read_string := func(position uint32) (string, error) {
+		if uint64(position) >= uint64(len(data)) {
+			return "", fmt.Errorf("Offset %d is outside of IP2Location database", position)
+		}
+
+		length := uint32(data[position])
+
+		if uint64(position)+1+uint64(length) > uint64(len(data)) {
+			return "", fmt.Errorf("String at offset %d is outside of IP2Location database", position)
+		}
+
+		return string(data[position+1 : position+1+length]), nil
+	}
+
+	columns := uint32(data[1])
+	build_date := time.Date(2000+int(data[2]), time.Month(data[3]), int(data[4]), 0, 0, 0, 0, time.UTC)
+
+	ipv4_count, err := read_uint32(6)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ipv4_address, err := read_uint32(10)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if columns < 2 {
+		return nil, fmt.Errorf("IP2Location database must have country column")
+	}
+
+	source := &ListSource{database_type: fmt.Sprintf("IP2Location-BIN-DB%d", data[0]), build_epoch: uint(build_date.Unix())}
+
+	row_size := columns * 4
+
+	for row := uint32(0); row < ipv4_count; row++ {
+		row_address := ipv4_address + row*row_size
+
+		from, err := read_uint32(row_address)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// Start of next row is end of current one
+		next_from, err := read_uint32(row_address + row_size)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// Country is second column in all types of databases
+		country_position, err := read_uint32(row_address + 4)
+
+		if err != nil {
+			return nil, err
+		}
+
+		country_code, err := read_string(country_position)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if country_code == "-" || next_from <= from {
+			continue
+		}
+
+		// Full name follows two letter code
+		country_name, err := read_string(country_position + 3)
+
+		if err != nil {
+			return nil, err
+		}
+
+		source.add_range(netip.AddrFrom4(uint32_to_ipv4(from)), netip.AddrFrom4(uint32_to_ipv4(next_from-1)), country_code, country_name)
+	}
+
+	return source, nil
+}
+
+func uint32_to_ipv4(value uint32) [4]byte {
+	b := [4]byte{}
+	binary.BigEndian.PutUint32(b[:], value)
+
+	return b
+}
+
+// Loads delegated-*-extended statistics from RIRs
+// Format: https://www.apnic.net/about-apnic/corporate-documents/documents/resource-guidelines/rir-statistics-exchange-format/
+func load_rir_delegated_stats(paths []string) (*ListSource, error) {
+	source := &ListSource{database_type: "RIR-Delegated-Extended"}
+
+	for _, path := range paths {
+		build_epoch := get_file_modification_epoch(path)
+
+		if build_epoch > source.build_epoch {
+			source.build_epoch = build_epoch
+		}
+
+		err := load_rir_delegated_stats_file(source, path)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return source, nil
+}
+
+func load_rir_delegated_stats_file(source *ListSource, path string) error {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return fmt.Errorf("Cannot open RIR statistics: %w", err)
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	line_number := 0
+
+	for scanner.Scan() {
+		line_number++
+
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// registry|cc|type|start|value|date|status[|opaque-id]
+		fields := strings.Split(line, "|")
+
+		// Header and summary lines have less fields or * instead of country
+		if len(fields) < 7 || fields[1] == "*" || fields[2] != "ipv4" {
+			continue
+		}
+
+		// We do not need available and reserved blocks
+		if fields[6] != "allocated" && fields[6] != "assigned" {
+			continue
+		}
+
+		start, err := netip.ParseAddr(fields[3])
+
+		if err != nil || !start.Is4() {
+			slog.Warn("Cannot parse start address in RIR statistics", "path", path, "line", line_number, "error", err)
+			continue
+		}
+
+		count, err := strconv.ParseUint(fields[4], 10, 32)
+
+		if err != nil || count == 0 {
+			slog.Warn("Cannot parse number of addresses in RIR statistics", "path", path, "line", line_number, "error", err)
+			continue
+		}
+
+		start_as_uint64 := uint64(binary.BigEndian.Uint32(start.AsSlice()))
+
+		if start_as_uint64+count-1 > 0xffffffff {
+			slog.Warn("Block in RIR statistics is outside of IPv4 address space", "path", path, "line", line_number)
+			continue
+		}
+
+		end_as_uint32 := uint32(start_as_uint64 + count - 1)
+
+		source.add_range(start, netip.AddrFrom4(uint32_to_ipv4(end_as_uint32)), strings.ToUpper(fields[1]), "")
+	}
+
+	err = scanner.Err()
+
+	if err != nil {
+		return fmt.Errorf("Cannot read RIR statistics %s: %w", path, err)
+	}
+
+	return nil
+}
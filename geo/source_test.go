@@ -0,0 +1,306 @@
+package geo
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"go4.org/netipx"
+
+	"bitbucket.org/fastnetmon/country_lockdown/blockset"
+	"bitbucket.org/fastnetmon/country_lockdown/internal/mmdbtest"
+)
+
+// Aggregated prefixes for comparison, walk order and splits depend on source
+func aggregate(prefixes []netip.Prefix) []netip.Prefix {
+	var builder netipx.IPSetBuilder
+
+	for _, prefix := range prefixes {
+		builder.AddPrefix(prefix)
+	}
+
+	return blockset.BuildSet(&builder).Prefixes()
+}
+
+func load_networks(t *testing.T, source Source, entry string) []netip.Prefix {
+	t.Helper()
+
+	prefixes, err := LoadNetworks(source, entry)
+
+	if err != nil {
+		t.Fatalf("Cannot load networks for %s: %v", entry, err)
+	}
+
+	return aggregate(prefixes)
+}
+
+func open_test_database(t *testing.T, source_type string, database_type string, networks []mmdbtest.Network, options Options) Source {
+	t.Helper()
+
+	path := mmdbtest.WriteTemp(t, database_type, networks)
+
+	source, err := Open(source_type, []string{path}, options)
+
+	if err != nil {
+		t.Fatalf("Cannot open test database: %v", err)
+	}
+
+	t.Cleanup(func() { source.Close() })
+
+	return source
+}
+
+func TestMMDBWalkAndLookup(t *testing.T) {
+	source := open_test_database(t, "maxmind", "GeoLite2-Country", []mmdbtest.Network{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Record: mmdbtest.Country("TV", "Tuvalu")},
+		{Prefix: netip.MustParsePrefix("10.0.1.0/24"), Record: mmdbtest.Country("NR", "Nauru")},
+		{Prefix: netip.MustParsePrefix("10.0.2.0/23"), Record: mmdbtest.Country("TV", "Tuvalu")},
+		{Prefix: netip.MustParsePrefix("2001:db8::/32"), Record: mmdbtest.Country("TV", "Tuvalu")},
+	}, Options{})
+
+	// IPv6 networks are not interesting for us
+	tv_networks := load_networks(t, source, "TV")
+	expected := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24"), netip.MustParsePrefix("10.0.2.0/23")}
+
+	if !slices.Equal(tv_networks, expected) {
+		t.Errorf("Unexpected networks for TV: %v, expected %v", tv_networks, expected)
+	}
+
+	record, err := source.Lookup(netip.MustParseAddr("10.0.1.5"))
+
+	if err != nil {
+		t.Fatalf("Cannot lookup address: %v", err)
+	}
+
+	if record == nil || record.Country != "NR" || record.CountryName != "Nauru" || record.Network != netip.MustParsePrefix("10.0.1.0/24") {
+		t.Errorf("Unexpected record for 10.0.1.5: %+v", record)
+	}
+
+	record, err = source.Lookup(netip.MustParseAddr("192.0.2.1"))
+
+	if err != nil {
+		t.Fatalf("Cannot lookup address: %v", err)
+	}
+
+	if record != nil {
+		t.Errorf("We do not expect record for 192.0.2.1: %+v", record)
+	}
+
+	if source.BuildEpoch() == 0 || source.DatabaseType() != "GeoLite2-Country" {
+		t.Errorf("Unexpected metadata: %d %s", source.BuildEpoch(), source.DatabaseType())
+	}
+}
+
+func TestMMDBRejectsWrongDatabaseType(t *testing.T) {
+	path := mmdbtest.WriteTemp(t, "GeoLite2-ASN", []mmdbtest.Network{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Record: mmdbtest.ASN(64500, "Example")},
+	})
+
+	_, err := Open("maxmind", []string{path}, Options{})
+
+	if err == nil {
+		t.Fatalf("We must not accept ASN database as country database")
+	}
+}
+
+func TestIPinfoRecords(t *testing.T) {
+	source := open_test_database(t, "ipinfo", "ipinfo country.mmdb", []mmdbtest.Network{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Record: map[string]any{"country": "TV", "country_name": "Tuvalu"}},
+		{Prefix: netip.MustParsePrefix("10.0.1.0/24"), Record: map[string]any{"country_code": "NR"}},
+	}, Options{})
+
+	if networks := load_networks(t, source, "NR"); !slices.Equal(networks, []netip.Prefix{netip.MustParsePrefix("10.0.1.0/24")}) {
+		t.Errorf("Unexpected networks for NR: %v", networks)
+	}
+
+	if networks := load_networks(t, source, "TV"); !slices.Equal(networks, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}) {
+		t.Errorf("Unexpected networks for TV: %v", networks)
+	}
+}
+
+func TestSubdivisionsWithConfidence(t *testing.T) {
+	// Enterprise database tells how sure it is about location
+	with_confidence := func(record map[string]any, country_confidence uint16, subdivision_confidence uint16) map[string]any {
+		record["country"].(map[string]any)["confidence"] = country_confidence
+		record["subdivisions"].([]any)[0].(map[string]any)["confidence"] = subdivision_confidence
+
+		return record
+	}
+
+	crimea := with_confidence(mmdbtest.City("UA", "Ukraine", "43", "Crimea"), 90, 80)
+	kyiv := with_confidence(mmdbtest.City("UA", "Ukraine", "30", "Kyiv City"), 90, 80)
+	uncertain := with_confidence(mmdbtest.City("UA", "Ukraine", "43", "Crimea"), 30, 20)
+
+	networks := []mmdbtest.Network{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Record: crimea},
+		{Prefix: netip.MustParsePrefix("10.0.1.0/24"), Record: kyiv},
+		{Prefix: netip.MustParsePrefix("10.0.2.0/24"), Record: uncertain},
+	}
+
+	source := open_test_database(t, "maxmind", "GeoIP2-Enterprise", networks, Options{})
+
+	expected := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24"), netip.MustParsePrefix("10.0.2.0/24")}
+
+	for _, entry := range []string{"UA-43", "ua:crimea"} {
+		if networks := load_networks(t, source, entry); !slices.Equal(networks, expected) {
+			t.Errorf("Unexpected networks for %s: %v, expected %v", entry, networks, expected)
+		}
+	}
+
+	if networks := load_networks(t, source, "UA"); !slices.Equal(networks, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/23"), netip.MustParsePrefix("10.0.2.0/24")}) {
+		t.Errorf("Unexpected networks for UA: %v", networks)
+	}
+
+	confident_source := open_test_database(t, "maxmind", "GeoIP2-Enterprise", networks, Options{MinConfidence: 50})
+
+	if networks := load_networks(t, confident_source, "UA-43"); !slices.Equal(networks, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}) {
+		t.Errorf("Unexpected networks for UA-43 with confidence: %v", networks)
+	}
+
+	if networks := load_networks(t, confident_source, "UA"); !slices.Equal(networks, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/23")}) {
+		t.Errorf("Unexpected networks for UA with confidence: %v", networks)
+	}
+}
+
+func TestParseBlockListEntry(t *testing.T) {
+	for _, value := range []string{"UA-", "UA:", ":Crimea", "-43", "", "Ukraine", "U1", "UKR-43"} {
+		if _, err := ParseBlockListEntry(value); err == nil {
+			t.Errorf("We must not accept entry %q", value)
+		}
+	}
+
+	entry, err := ParseBlockListEntry("ua-43")
+
+	if err != nil {
+		t.Fatalf("Cannot parse entry: %v", err)
+	}
+
+	if !entry.HasSubdivision() || entry.Country != "UA" || entry.SubdivisionCode != "43" {
+		t.Errorf("Unexpected entry: %+v", entry)
+	}
+}
+
+func TestLoadNetworksByEntry(t *testing.T) {
+	source := open_test_database(t, "maxmind", "GeoLite2-City", []mmdbtest.Network{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Record: mmdbtest.City("UA", "Ukraine", "43", "Crimea")},
+		{Prefix: netip.MustParsePrefix("10.0.1.0/24"), Record: mmdbtest.City("UA", "Ukraine", "30", "Kyiv City")},
+		{Prefix: netip.MustParsePrefix("10.0.2.0/24"), Record: mmdbtest.Country("TV", "Tuvalu")},
+	}, Options{})
+
+	networks_by_entry, err := LoadNetworksByEntry(source, []string{"UA", "UA-43", "TV", "NR", "UA"})
+
+	if err != nil {
+		t.Fatalf("Cannot load networks: %v", err)
+	}
+
+	expected := map[string][]netip.Prefix{
+		"UA":    {netip.MustParsePrefix("10.0.0.0/23")},
+		"UA-43": {netip.MustParsePrefix("10.0.0.0/24")},
+		"TV":    {netip.MustParsePrefix("10.0.2.0/24")},
+		"NR":    {},
+	}
+
+	for entry, expected_networks := range expected {
+		if networks := aggregate(networks_by_entry[entry]); !slices.Equal(networks, expected_networks) {
+			t.Errorf("Unexpected networks for %s: %v, expected %v", entry, networks, expected_networks)
+		}
+	}
+
+	if _, err := LoadNetworksByEntry(source, []string{"UA", "Ukraine"}); err == nil {
+		t.Errorf("We must not accept broken entry")
+	}
+}
+
+// Builds IP2Location DB1 BIN database with rows of start address and country
+// Strings go after rows: country code and name, each with length in first byte
+func build_ip2location_bin(rows []netip.Addr, countries [][2]string) []byte {
+	const header_size = 64
+	const row_size = 8
+
+	data := make([]byte, header_size+len(rows)*row_size)
+
+	data[0] = 1
+	data[1] = 2
+	data[2], data[3], data[4] = 26, 10, 18
+
+	// Last row keeps only end of last range. Addresses in header are 1-based
+	binary.LittleEndian.PutUint32(data[5:], uint32(len(rows)-1))
+	binary.LittleEndian.PutUint32(data[9:], header_size+1)
+
+	for i, from := range rows {
+		row := data[header_size+i*row_size:]
+
+		binary.LittleEndian.PutUint32(row, binary.BigEndian.Uint32(from.AsSlice()))
+
+		if i < len(countries) {
+			// Offsets of strings are 0-based
+			binary.LittleEndian.PutUint32(row[4:], uint32(len(data)))
+
+			for _, value := range countries[i] {
+				data = append(data, byte(len(value)))
+				data = append(data, value...)
+			}
+		}
+	}
+
+	return data
+}
+
+func TestIP2LocationBin(t *testing.T) {
+	data := build_ip2location_bin([]netip.Addr{
+		netip.MustParseAddr("10.0.0.0"),
+		netip.MustParseAddr("10.0.1.0"),
+		netip.MustParseAddr("10.0.2.0"),
+		// End of NR range
+		netip.MustParseAddr("10.0.4.0"),
+	}, [][2]string{{"TV", "Tuvalu"}, {"-", "-"}, {"NR", "Nauru"}})
+
+	path := filepath.Join(t.TempDir(), "IP2LOCATION-LITE-DB1.BIN")
+
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Cannot write database: %v", err)
+	}
+
+	source, err := Open("ip2location-bin", []string{path}, Options{})
+
+	if err != nil {
+		t.Fatalf("Cannot open database: %v", err)
+	}
+
+	defer source.Close()
+
+	if source.DatabaseType() != "IP2Location-BIN-DB1" {
+		t.Errorf("Unexpected database type: %s", source.DatabaseType())
+	}
+
+	if networks := load_networks(t, source, "TV"); !slices.Equal(networks, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}) {
+		t.Errorf("Unexpected networks for TV: %v", networks)
+	}
+
+	if networks := load_networks(t, source, "NR"); !slices.Equal(networks, []netip.Prefix{netip.MustParsePrefix("10.0.2.0/23")}) {
+		t.Errorf("Unexpected networks for NR: %v", networks)
+	}
+
+	record, err := source.Lookup(netip.MustParseAddr("10.0.3.1"))
+
+	if err != nil || record == nil || record.Country != "NR" || record.CountryName != "Nauru" {
+		t.Errorf("Unexpected lookup result: %+v %v", record, err)
+	}
+
+	// Range without country
+	if record, err := source.Lookup(netip.MustParseAddr("10.0.1.1")); err != nil || record != nil {
+		t.Errorf("Unexpected lookup result for range without country: %+v %v", record, err)
+	}
+
+	// Name of last country is cut
+	if err := os.WriteFile(path, data[:len(data)-3], 0644); err != nil {
+		t.Fatalf("Cannot write database: %v", err)
+	}
+
+	if _, err := Open("ip2location-bin", []string{path}, Options{}); err == nil {
+		t.Errorf("We must fail on truncated database")
+	}
+}
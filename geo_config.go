@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+
+	"go4.org/netipx"
+
+	"bitbucket.org/fastnetmon/country_lockdown/blockset"
+	"bitbucket.org/fastnetmon/country_lockdown/geo"
+)
+
+// Where we take mapping between networks and countries
+type GeoSourceConfiguration struct {
+	// Used in reports for multiple sources, type by default
+	Name string `json:"name"`
+
+	// maxmind, dbip, ipinfo, ip2location-csv, ip2location-bin or rir-delegated
+	Type string `json:"type"`
+
+	// We use geoip_path when it's empty
+	Path string `json:"path"`
+
+	// Additional files, we use it for statistics from multiple RIRs
+	Paths []string `json:"paths"`
+}
+
+// Returns paths for source with geoip_path as default
+func get_geo_source_paths(source_conf GeoSourceConfiguration) []string {
+	paths := []string{}
+
+	if source_conf.Path != "" {
+		paths = append(paths, source_conf.Path)
+	}
+
+	paths = append(paths, source_conf.Paths...)
+
+	if len(paths) == 0 {
+		paths = append(paths, conf.GeoIPPath)
+	}
+
+	return paths
+}
+
+func get_geo_source_options() geo.Options {
+	return geo.Options{MinConfidence: conf.GeoIPMinConfidence}
+}
+
+// Returns name of source for reports, we use type by default
+func get_geo_source_name(source_conf GeoSourceConfiguration) string {
+	if source_conf.Name != "" {
+		return source_conf.Name
+	}
+
+	return source_conf.Type
+}
+
+// Checks geo_source or geo_sources from configuration
+func validate_geo_sources() error {
+	if len(conf.GeoSources) == 0 {
+		if conf.GeoSource.Type == "" {
+			conf.GeoSource.Type = "maxmind"
+		}
+
+		if !slices.Contains(geo.SourceTypes, conf.GeoSource.Type) {
+			return fmt.Errorf("Unknown geo source type %s, please use one of %v", conf.GeoSource.Type, geo.SourceTypes)
+		}
+
+		if conf.GeoIPUpdate.Enabled && conf.GeoSource.Type != "maxmind" {
+			return fmt.Errorf("GeoIP updater supports only maxmind geo source")
+		}
+
+		return nil
+	}
+
+	if conf.GeoSource.Type != "" || conf.GeoSource.Path != "" || len(conf.GeoSource.Paths) > 0 {
+		return fmt.Errorf("Please use geo_source or geo_sources but not both")
+	}
+
+	if conf.GeoSourcesMerge == "" {
+		conf.GeoSourcesMerge = "union"
+	}
+
+	if !slices.Contains(geo.MergeStrategies, conf.GeoSourcesMerge) {
+		return fmt.Errorf("Unknown merge strategy %s for geo sources, please use one of %v", conf.GeoSourcesMerge, geo.MergeStrategies)
+	}
+
+	names := []string{}
+
+	for index, source_conf := range conf.GeoSources {
+		if !slices.Contains(geo.SourceTypes, source_conf.Type) {
+			return fmt.Errorf("Unknown type %s for geo source %d, please use one of %v", source_conf.Type, index, geo.SourceTypes)
+		}
+
+		// Paths for additional sources have no sensible default
+		if index > 0 && source_conf.Path == "" && len(source_conf.Paths) == 0 {
+			return fmt.Errorf("Path for geo source %s is not set", get_geo_source_name(source_conf))
+		}
+
+		name := get_geo_source_name(source_conf)
+
+		if slices.Contains(names, name) {
+			return fmt.Errorf("We have multiple geo sources with name %s, please set unique names for them", name)
+		}
+
+		names = append(names, name)
+	}
+
+	if conf.GeoIPUpdate.Enabled && get_geoip_update_path() == "" {
+		return fmt.Errorf("GeoIP updater requires maxmind geo source")
+	}
+
+	return nil
+}
+
+// Returns path of MaxMind database which we keep up to date
+func get_geoip_update_path() string {
+	if len(conf.GeoSources) == 0 {
+		return get_geo_source_paths(conf.GeoSource)[0]
+	}
+
+	for _, source_conf := range conf.GeoSources {
+		if source_conf.Type == "maxmind" {
+			return get_geo_source_paths(source_conf)[0]
+		}
+	}
+
+	return ""
+}
+
+// Returns paths of all configured sources for logs
+func get_configured_geo_source_paths() []string {
+	if len(conf.GeoSources) == 0 {
+		return get_geo_source_paths(conf.GeoSource)
+	}
+
+	paths := []string{}
+
+	for _, source_conf := range conf.GeoSources {
+		paths = append(paths, get_geo_source_paths(source_conf)...)
+	}
+
+	return paths
+}
+
+// Opens all sources from geo_sources, closes already opened ones when something goes wrong
+func open_geo_sources(source_confs []GeoSourceConfiguration) ([]geo.Source, error) {
+	sources := []geo.Source{}
+
+	for _, source_conf := range source_confs {
+		source, err := geo.Open(source_conf.Type, get_geo_source_paths(source_conf), get_geo_source_options())
+
+		if err != nil {
+			for _, opened_source := range sources {
+				opened_source.Close()
+			}
+
+			return nil, fmt.Errorf("Cannot open geo source %s: %w", get_geo_source_name(source_conf), err)
+		}
+
+		sources = append(sources, source)
+	}
+
+	return sources, nil
+}
+
+// Opens source from configuration
+func open_configured_geo_source() (geo.Source, error) {
+	if len(conf.GeoSources) == 0 {
+		return geo.Open(conf.GeoSource.Type, get_geo_source_paths(conf.GeoSource), get_geo_source_options())
+	}
+
+	sources, err := open_geo_sources(conf.GeoSources)
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+
+	for _, source_conf := range conf.GeoSources {
+		names = append(names, get_geo_source_name(source_conf))
+	}
+
+	return geo.NewMergedSource(conf.GeoSourcesMerge, names, sources), nil
+}
+
+// Opens configured geo source and applies overrides from geoip_overrides_path when it's set
+func open_configured_geo_source_with_overrides() (geo.Source, error) {
+	geo_source, err := open_configured_geo_source()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.GeoIPOverridesPath == "" {
+		return geo_source, nil
+	}
+
+	overrides, err := geo.LoadOverrides(conf.GeoIPOverridesPath)
+
+	if err != nil {
+		geo_source.Close()
+		return nil, err
+	}
+
+	return geo.NewOverrideSource(geo_source, overrides), nil
+}
+
+// Parses country or subdivision and checks that configured geo source can find it
+func parse_block_list_entry(value string) (geo.BlockListEntry, error) {
+	entry, err := geo.ParseBlockListEntry(value)
+
+	if err != nil {
+		return entry, err
+	}
+
+	// Merged sources keep only countries
+	if entry.HasSubdivision() && len(conf.GeoSources) > 0 {
+		return entry, fmt.Errorf("Subdivision %s can be used only with single geo_source", value)
+	}
+
+	return entry, nil
+}
+
+// Checks entries of country_block_list, profiles and scheduled blocks and brings them to canonical form
+// We use entries as keys for statistics, metrics and API and cn from configuration must be same as CN
+func validate_block_list_entries() error {
+	lists := []*[]string{&conf.CountryBlockList}
+
+	for i := range conf.Profiles {
+		lists = append(lists, &conf.Profiles[i].CountryBlockList)
+	}
+
+	for i := range conf.ScheduledCountryBlocks {
+		lists = append(lists, &conf.ScheduledCountryBlocks[i].Countries)
+	}
+
+	for _, list := range lists {
+		for i, value := range *list {
+			entry, err := parse_block_list_entry(value)
+
+			if err != nil {
+				return err
+			}
+
+			(*list)[i] = entry.String()
+		}
+	}
+
+	if conf.GeoIPMinConfidence > 100 {
+		return fmt.Errorf("geoip_min_confidence must be between 0 and 100")
+	}
+
+	return nil
+}
+
+type GeoSourcesConflictsReport struct {
+	Sources   []string       `json:"sources"`
+	Strategy  string         `json:"strategy"`
+	Countries []string       `json:"countries"`
+	Conflicts []geo.Conflict `json:"conflicts"`
+}
+
+// Prints networks where configured geo sources disagree about countries which we may block
+func run_geo_sources_conflicts(countries []string, format string) error {
+	if len(conf.GeoSources) < 2 {
+		return fmt.Errorf("Please configure at least two sources in geo_sources")
+	}
+
+	if len(countries) == 0 {
+		countries = get_all_configured_countries()
+	}
+
+	if len(countries) == 0 {
+		return fmt.Errorf("We do not have any countries in configuration")
+	}
+
+	sources, err := open_geo_sources(conf.GeoSources)
+
+	if err != nil {
+		return err
+	}
+
+	names := []string{}
+	sets_by_source := []map[string]*netipx.IPSet{}
+
+	for index, source := range sources {
+		defer source.Close()
+
+		names = append(names, get_geo_source_name(conf.GeoSources[index]))
+
+		sets, err := geo.SetsByCountry(source, nil)
+
+		if err != nil {
+			return fmt.Errorf("Cannot load networks from geo source %s: %w", names[index], err)
+		}
+
+		sets_by_source = append(sets_by_source, sets)
+	}
+
+	report := GeoSourcesConflictsReport{
+		Sources:   names,
+		Strategy:  conf.GeoSourcesMerge,
+		Countries: countries,
+		Conflicts: geo.FindConflicts(names, sets_by_source, countries),
+	}
+
+	if format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "    ")
+
+		return encoder.Encode(report)
+	}
+
+	if format != "table" {
+		return fmt.Errorf("Unknown format %s, please use table or json", format)
+	}
+
+	fmt.Printf("%-20s %12s", "Prefix", "Addresses")
+
+	for _, name := range names {
+		fmt.Printf(" %16s", name)
+	}
+
+	fmt.Printf("\n")
+
+	for _, conflict := range report.Conflicts {
+		for _, prefix := range conflict.Prefixes {
+			fmt.Printf("%-20s %12d", prefix, blockset.CountAddresses([]netip.Prefix{prefix}))
+
+			for _, name := range names {
+				fmt.Printf(" %16s", format_geo_source_country(conflict.Countries[name]))
+			}
+
+			fmt.Printf("\n")
+		}
+	}
+
+	return nil
+}
+
+func format_geo_source_country(country_code string) string {
+	if country_code == "" {
+		return "-"
+	}
+
+	return country_code
+}
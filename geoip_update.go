@@ -0,0 +1,252 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+
+	"bitbucket.org/fastnetmon/country_lockdown/geo"
+)
+
+// Downloads GeoIP database from MaxMind or compatible mirror
+type GeoIPUpdateConfiguration struct {
+	Enabled bool `json:"enabled"`
+
+	AccountID  string `json:"account_id"`
+	LicenseKey string `json:"license_key"`
+
+	// GeoIP2-Country by default
+	EditionID string `json:"edition_id"`
+
+	// https://updates.maxmind.com by default
+	BaseURL string `json:"base_url"`
+
+	// How often we check for updates in daemon mode, seconds. 86400 by default
+	Interval uint `json:"interval"`
+}
+
+// MD5 which MaxMind expects when we do not have database yet
+const geoip_update_empty_md5 = "00000000000000000000000000000000"
+
+// Returns MD5 of file in hex or MD5 for missing database
+func get_file_md5(path string) (string, error) {
+	file, err := os.Open(path)
+
+	if os.IsNotExist(err) {
+		return geoip_update_empty_md5, nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	defer file.Close()
+
+	hash := md5.New()
+
+	_, err = io.Copy(hash, file)
+
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Checks that database is correct and has type we support
+func verify_geoip_database(path string) error {
+	geoip_db, err := maxminddb.Open(path)
+
+	if err != nil {
+		return fmt.Errorf("Cannot open database: %w", err)
+	}
+
+	defer geoip_db.Close()
+
+	err = geoip_db.Verify()
+
+	if err != nil {
+		return fmt.Errorf("Database verification failed: %w", err)
+	}
+
+	return geo.CheckDatabaseType("maxmind", geoip_db.Metadata.DatabaseType)
+}
+
+// Downloads new version of database when it's available and replaces geoip_path with it
+// Returns true when database was replaced
+func update_geoip_database(ctx context.Context, update_conf GeoIPUpdateConfiguration, geoip_path string) (bool, error) {
+	if update_conf.AccountID == "" || update_conf.LicenseKey == "" {
+		return false, fmt.Errorf("Account ID and license key for GeoIP updates are not set")
+	}
+
+	current_md5, err := get_file_md5(geoip_path)
+
+	if err != nil {
+		return false, fmt.Errorf("Cannot calculate MD5 for current database: %w", err)
+	}
+
+	// Protocol used by geoipupdate: https://github.com/maxmind/geoipupdate
+	update_url := fmt.Sprintf("%s/geoip/databases/%s/update?db_md5=%s",
+		strings.TrimSuffix(update_conf.BaseURL, "/"), url.PathEscape(update_conf.EditionID), current_md5)
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, update_url, nil)
+
+	if err != nil {
+		return false, fmt.Errorf("Cannot create request: %w", err)
+	}
+
+	request.SetBasicAuth(update_conf.AccountID, update_conf.LicenseKey)
+
+	client := &http.Client{Timeout: 10 * time.Minute}
+
+	response, err := client.Do(request)
+
+	if err != nil {
+		return false, fmt.Errorf("Cannot download database: %w", err)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotModified {
+		slog.Info("GeoIP database is up to date", "edition_id", update_conf.EditionID, "md5", current_md5)
+		return false, nil
+	}
+
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return false, fmt.Errorf("Unexpected response %s from update server: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+
+	expected_md5 := response.Header.Get("X-Database-MD5")
+
+	if expected_md5 == "" {
+		return false, fmt.Errorf("Update server did not return X-Database-MD5 header")
+	}
+
+	// We keep temporary file in same folder to replace database with rename
+	temporary_file, err := os.CreateTemp(filepath.Dir(geoip_path), filepath.Base(geoip_path)+".*.tmp")
+
+	if err != nil {
+		return false, fmt.Errorf("Cannot create temporary file: %w", err)
+	}
+
+	temporary_path := temporary_file.Name()
+
+	// We remove it when something goes wrong and old database stays in place
+	defer os.Remove(temporary_path)
+
+	err = download_gzipped_database(response.Body, temporary_file, expected_md5)
+
+	close_err := temporary_file.Close()
+
+	if err != nil {
+		return false, err
+	}
+
+	if close_err != nil {
+		return false, fmt.Errorf("Cannot write temporary file: %w", close_err)
+	}
+
+	err = verify_geoip_database(temporary_path)
+
+	if err != nil {
+		return false, fmt.Errorf("Downloaded database is broken, we keep old one: %w", err)
+	}
+
+	err = os.Chmod(temporary_path, 0644)
+
+	if err != nil {
+		return false, fmt.Errorf("Cannot change permissions for temporary file: %w", err)
+	}
+
+	err = os.Rename(temporary_path, geoip_path)
+
+	if err != nil {
+		return false, fmt.Errorf("Cannot replace database: %w", err)
+	}
+
+	slog.Info("GeoIP database was updated", "edition_id", update_conf.EditionID, "path", geoip_path, "md5", expected_md5)
+
+	return true, nil
+}
+
+// Decompresses database into file and checks MD5 of decompressed content
+func download_gzipped_database(body io.Reader, file *os.File, expected_md5 string) error {
+	gzip_reader, err := gzip.NewReader(body)
+
+	if err != nil {
+		return fmt.Errorf("Cannot decompress database: %w", err)
+	}
+
+	defer gzip_reader.Close()
+
+	hash := md5.New()
+
+	_, err = io.Copy(io.MultiWriter(file, hash), gzip_reader)
+
+	if err != nil {
+		return fmt.Errorf("Cannot download database: %w", err)
+	}
+
+	err = file.Sync()
+
+	if err != nil {
+		return fmt.Errorf("Cannot write temporary file: %w", err)
+	}
+
+	actual_md5 := hex.EncodeToString(hash.Sum(nil))
+
+	if !strings.EqualFold(actual_md5, expected_md5) {
+		return fmt.Errorf("MD5 mismatch for downloaded database: expected %s but got %s", expected_md5, actual_md5)
+	}
+
+	return nil
+}
+
+// Checks for updates periodically and requests sync when database changed
+func run_geoip_updater(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(conf.GeoIPUpdate.Interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		updated, err := update_geoip_database(ctx, conf.GeoIPUpdate, get_geoip_update_path())
+
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				slog.Error("Cannot update GeoIP database", "error", err)
+			}
+
+			continue
+		}
+
+		if !updated {
+			continue
+		}
+
+		// Daemon loop will recalculate block list with new database
+		select {
+		case sync_requests <- make(chan error, 1):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// TLS settings for gRPC connection to gobgpd
+type GoBGPTLSConfiguration struct {
+	Enabled bool `json:"enabled"`
+
+	// CA certificate to verify gobgpd, we use system pool when it's empty
+	CAPath string `json:"ca_path"`
+
+	// Client certificate and key for mutual TLS
+	CertPath string `json:"cert_path"`
+	KeyPath  string `json:"key_path"`
+
+	// Overrides name which we expect in gobgpd certificate
+	ServerName string `json:"server_name"`
+}
+
+// gRPC allows only 5 attempts in total for retry policy
+const gobgp_api_max_retries = 4
+
+// Connects to gobgpd API. Address may be host:port or unix:///path/to/socket
+// Please note that connection is lazy and errors will be reported only during first call
+func connect_to_gobgp(address string, tls_conf GoBGPTLSConfiguration, timeout uint, retries uint) (*grpc.ClientConn, error) {
+	var opts []grpc.DialOption
+
+	if tls_conf.Enabled {
+		tls_config, err := build_gobgp_tls_config(tls_conf)
+
+		if err != nil {
+			return nil, err
+		}
+
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tls_config)))
+	} else {
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+
+	if retries > gobgp_api_max_retries {
+		retries = gobgp_api_max_retries
+	}
+
+	// We use service config to set deadline for every call and retry calls when gobgpd is temporarily unavailable
+	// https://github.com/grpc/grpc/blob/master/doc/service_config.md
+	method_config := fmt.Sprintf(`"name": [{"service": "apipb.GobgpApi"}], "timeout": "%ds"`, timeout)
+
+	if retries > 0 {
+		method_config += fmt.Sprintf(`, "retryPolicy": {
+			"maxAttempts": %d,
+			"initialBackoff": "1s",
+			"maxBackoff": "10s",
+			"backoffMultiplier": 2.0,
+			"retryableStatusCodes": ["UNAVAILABLE"]
+		}`, retries+1)
+	}
+
+	opts = append(opts, grpc.WithDefaultServiceConfig(`{"methodConfig": [{`+method_config+`}]}`))
+
+	conn, err := grpc.NewClient(address, opts...)
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot create gRPC client for GoBGP API %s: %w", address, err)
+	}
+
+	return conn, nil
+}
+
+// Loads certificates for TLS connection to gobgpd
+func build_gobgp_tls_config(tls_conf GoBGPTLSConfiguration) (*tls.Config, error) {
+	tls_config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: tls_conf.ServerName,
+	}
+
+	if tls_conf.CAPath != "" {
+		ca_pem, err := os.ReadFile(tls_conf.CAPath)
+
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read GoBGP API CA certificate: %w", err)
+		}
+
+		ca_pool := x509.NewCertPool()
+
+		if !ca_pool.AppendCertsFromPEM(ca_pem) {
+			return nil, fmt.Errorf("Cannot find any PEM certificates in %s", tls_conf.CAPath)
+		}
+
+		tls_config.RootCAs = ca_pool
+	}
+
+	if tls_conf.CertPath != "" || tls_conf.KeyPath != "" {
+		if tls_conf.CertPath == "" || tls_conf.KeyPath == "" {
+			return nil, fmt.Errorf("Both cert_path and key_path must be set for mutual TLS")
+		}
+
+		client_certificate, err := tls.LoadX509KeyPair(tls_conf.CertPath, tls_conf.KeyPath)
+
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load GoBGP API client certificate: %w", err)
+		}
+
+		tls_config.Certificates = []tls.Certificate{client_certificate}
+	}
+
+	return tls_config, nil
+}
+
+// Adds human friendly explanation to errors returned by gobgpd API
+func describe_gobgp_error(address string, err error) error {
+	// Errors which were not returned by gRPC do not need any explanation
+	if _, ok := status.FromError(err); !ok {
+		return err
+	}
+
+	switch status.Code(err) {
+	case codes.Unavailable:
+		if strings.Contains(err.Error(), "authentication handshake failed") {
+			return fmt.Errorf("TLS handshake with GoBGP API %s failed: %w", address, err)
+		}
+
+		return fmt.Errorf("GoBGP API %s is unavailable, please check that gobgpd is running: %w", address, err)
+	case codes.DeadlineExceeded:
+		return fmt.Errorf("GoBGP API %s did not reply in time: %w", address, err)
+	case codes.Canceled:
+		return fmt.Errorf("Call to GoBGP API %s was cancelled: %w", address, err)
+	}
+
+	return fmt.Errorf("GoBGP API %s returned error: %w", address, err)
+}
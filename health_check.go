@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"slices"
+
+	apb "google.golang.org/protobuf/types/known/anypb"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+
+	"bitbucket.org/fastnetmon/country_lockdown/announcer"
+)
+
+// Checks that our announces actually reach BGP peers
+type BGPHealthCheckConfiguration struct {
+	Enabled bool `json:"enabled"`
+
+	// How many peers must be in ESTABLISHED state, 1 by default
+	MinEstablishedPeers uint `json:"min_established_peers"`
+
+	// Families which must be negotiated with peers in gobgp notation, ipv4-unicast or l3vpn-ipv4-unicast by default
+	// and ipv6-unicast or l3vpn-ipv6-unicast too when block list has IPv6 prefixes
+	RequiredFamilies []string `json:"required_families"`
+
+	// Check that every established peer advertises all our prefixes after sync
+	CheckAdjOut bool `json:"check_adj_out"`
+
+	// Do not touch announces at all when pre-flight check fails
+	AbortOnFailure bool `json:"abort_on_failure"`
+}
+
+// Checks that gobgpd is running and has enough established peers with required families
+// Returns addresses of healthy peers
+func check_bgp_peers(ctx context.Context, logger *slog.Logger, gobgp_client apipb.GobgpApiClient, health_check BGPHealthCheckConfiguration, prefixes_to_block []netip.Prefix) ([]string, error) {
+	bgp_info, err := gobgp_client.GetBgp(ctx, &apipb.GetBgpRequest{})
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get BGP information: %w", err)
+	}
+
+	if bgp_info.Global == nil || bgp_info.Global.Asn == 0 {
+		return nil, fmt.Errorf("BGP is not started in gobgpd")
+	}
+
+	logger.Debug("gobgpd is running", "asn", bgp_info.Global.Asn, "router_id", bgp_info.Global.RouterId)
+
+	required_families := health_check.RequiredFamilies
+
+	if len(required_families) == 0 {
+		required_families = get_announce_families(prefixes_to_block)
+	}
+
+	for _, family_name := range required_families {
+		if _, ok := bgp_families_by_name[family_name]; !ok {
+			return nil, fmt.Errorf("Unknown address family %s in health check configuration", family_name)
+		}
+	}
+
+	peers, err := list_bgp_peers(ctx, gobgp_client)
+
+	if err != nil {
+		return nil, err
+	}
+
+	healthy_peers := []string{}
+
+	for _, peer := range peers {
+		peer_address := peer.State.NeighborAddress
+
+		if peer.State.SessionState != apipb.PeerState_ESTABLISHED {
+			logger.Warn("Peer is not established", "peer", peer_address, "state", peer.State.SessionState.String())
+			continue
+		}
+
+		negotiated_families := get_negotiated_families(peer.State)
+
+		missing_families := []string{}
+
+		for _, family_name := range required_families {
+			if !negotiated_families[family_name] {
+				missing_families = append(missing_families, family_name)
+			}
+		}
+
+		if len(missing_families) > 0 {
+			logger.Warn("Peer is established but did not negotiate families", "peer", peer_address, "missing_families", missing_families)
+			continue
+		}
+
+		logger.Debug("Peer is established and healthy", "peer", peer_address)
+		healthy_peers = append(healthy_peers, peer_address)
+	}
+
+	min_established_peers := health_check.MinEstablishedPeers
+
+	if min_established_peers == 0 {
+		min_established_peers = 1
+	}
+
+	if uint(len(healthy_peers)) < min_established_peers {
+		return healthy_peers, fmt.Errorf("Only %d of %d configured peers are established with families %v but we need at least %d",
+			len(healthy_peers), len(peers), required_families, min_established_peers)
+	}
+
+	return healthy_peers, nil
+}
+
+// Returns families in gobgp notation which we use to announce prefixes
+func get_announce_families(prefixes []netip.Prefix) []string {
+	ipv4_family, ipv6_family := "ipv4-unicast", "ipv6-unicast"
+
+	if conf.L3VPN.Enabled {
+		ipv4_family, ipv6_family = "l3vpn-ipv4-unicast", "l3vpn-ipv6-unicast"
+	}
+
+	families := []string{ipv4_family}
+
+	if slices.ContainsFunc(prefixes, func(prefix netip.Prefix) bool { return prefix.Addr().Is6() }) {
+		families = append(families, ipv6_family)
+	}
+
+	return families
+}
+
+// Returns all configured peers with their state
+func list_bgp_peers(ctx context.Context, gobgp_client apipb.GobgpApiClient) ([]*apipb.Peer, error) {
+	stream, err := gobgp_client.ListPeer(ctx, &apipb.ListPeerRequest{})
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list peers: %w", err)
+	}
+
+	peers := []*apipb.Peer{}
+
+	for {
+		r, err := stream.Recv()
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Cannot list peers: %w", err)
+		}
+
+		if r.Peer == nil || r.Peer.State == nil {
+			continue
+		}
+
+		peers = append(peers, r.Peer)
+	}
+
+	return peers, nil
+}
+
+// Returns families which were announced by both sides in OPEN message
+func get_negotiated_families(peer_state *apipb.PeerState) map[string]bool {
+	local_families := get_multiprotocol_families(peer_state.LocalCap)
+	remote_families := get_multiprotocol_families(peer_state.RemoteCap)
+
+	negotiated_families := make(map[string]bool)
+
+	for family_name := range local_families {
+		if remote_families[family_name] {
+			negotiated_families[family_name] = true
+		}
+	}
+
+	return negotiated_families
+}
+
+// Extracts families from multiprotocol capabilities
+func get_multiprotocol_families(capabilities []*apb.Any) map[string]bool {
+	families := make(map[string]bool)
+
+	multiprotocol_found := false
+
+	for _, capability := range capabilities {
+		multiprotocol := apipb.MultiProtocolCapability{}
+
+		if !capability.MessageIs(&multiprotocol) {
+			continue
+		}
+
+		err := capability.UnmarshalTo(&multiprotocol)
+
+		if err != nil {
+			slog.Warn("Cannot decode multiprotocol capability", "error", err)
+			continue
+		}
+
+		multiprotocol_found = true
+
+		for family_name, family := range bgp_families_by_name {
+			if multiprotocol.Family.GetAfi() == family.Afi && multiprotocol.Family.GetSafi() == family.Safi {
+				families[family_name] = true
+			}
+		}
+	}
+
+	// Speakers without multiprotocol capability support only IPv4 unicast: RFC 4760
+	if !multiprotocol_found && len(capabilities) > 0 {
+		families["ipv4-unicast"] = true
+	}
+
+	return families
+}
+
+// Checks that all peers advertise all prefixes we have to block
+func check_adj_out(ctx context.Context, logger *slog.Logger, gobgp_client apipb.GobgpApiClient, peers []string, prefixes_to_block []netip.Prefix) error {
+	peers_with_problems := 0
+
+	var l3vpn_attributes *announcer.L3VPN
+
+	// Even routes from VRF reach peers as VPN routes
+	if conf.L3VPN.Enabled {
+		var err error
+
+		l3vpn_attributes, err = parse_l3vpn_attributes(conf.L3VPN)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, peer_address := range peers {
+		advertised_prefixes := make(map[string]bool)
+
+		for _, family_name := range get_announce_families(prefixes_to_block) {
+			err := list_advertised_prefixes(ctx, gobgp_client, peer_address, bgp_families_by_name[family_name], l3vpn_attributes, advertised_prefixes)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		missing_prefixes := []string{}
+
+		for _, prefix := range prefixes_to_block {
+			if !advertised_prefixes[prefix.String()] {
+				missing_prefixes = append(missing_prefixes, prefix.String())
+			}
+		}
+
+		if len(missing_prefixes) > 0 {
+			logger.Warn("Peer does not advertise all prefixes", "peer", peer_address, "missing", len(missing_prefixes), "prefixes", len(prefixes_to_block))
+
+			logger.Debug("Prefixes missing in Adj-RIB-Out", "peer", peer_address, "prefix_list", missing_prefixes)
+			peers_with_problems++
+			continue
+		}
+
+		logger.Debug("Peer advertises all prefixes", "peer", peer_address, "prefixes", len(prefixes_to_block))
+	}
+
+	if peers_with_problems > 0 {
+		return fmt.Errorf("%d of %d peers do not advertise all our prefixes", peers_with_problems, len(peers))
+	}
+
+	return nil
+}
+
+// Adds prefixes which gobgpd advertises to peer in family
+func list_advertised_prefixes(ctx context.Context, gobgp_client apipb.GobgpApiClient, peer_address string, family *apipb.Family, l3vpn_attributes *announcer.L3VPN, advertised_prefixes map[string]bool) error {
+	stream, err := gobgp_client.ListPath(ctx, &apipb.ListPathRequest{
+		TableType: apipb.TableType_ADJ_OUT,
+		Name:      peer_address,
+		Family:    family,
+	})
+
+	if err != nil {
+		return fmt.Errorf("Cannot list advertised paths for peer %s: %w", peer_address, err)
+	}
+
+	for {
+		r, err := stream.Recv()
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Cannot list advertised paths for peer %s: %w", peer_address, err)
+		}
+
+		if l3vpn_attributes != nil {
+			prefix, ok := announcer.VPNPrefix(r.Destination, l3vpn_attributes.RouteDistinguisher)
+
+			if ok {
+				advertised_prefixes[prefix] = true
+			}
+
+			continue
+		}
+
+		advertised_prefixes[r.Destination.Prefix] = true
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+
+	apb "google.golang.org/protobuf/types/known/anypb"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+)
+
+func build_multiprotocol_capabilities(t *testing.T, family_names ...string) []*apb.Any {
+	t.Helper()
+
+	// Speakers send other capabilities too and we must skip them
+	route_refresh, err := apb.New(&apipb.RouteRefreshCapability{})
+
+	if err != nil {
+		t.Fatalf("Cannot encode capability: %v", err)
+	}
+
+	capabilities := []*apb.Any{route_refresh}
+
+	for _, family_name := range family_names {
+		capability, err := apb.New(&apipb.MultiProtocolCapability{Family: bgp_families_by_name[family_name]})
+
+		if err != nil {
+			t.Fatalf("Cannot encode capability: %v", err)
+		}
+
+		capabilities = append(capabilities, capability)
+	}
+
+	return capabilities
+}
+
+func TestGetAnnounceFamilies(t *testing.T) {
+	saved_conf := conf
+	t.Cleanup(func() { conf = saved_conf })
+
+	ipv4_prefixes := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}
+	mixed_prefixes := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24"), netip.MustParsePrefix("2001:db8::/32")}
+
+	conf = CountryLockdownConfiguration{}
+
+	if families := get_announce_families(ipv4_prefixes); !slices.Equal(families, []string{"ipv4-unicast"}) {
+		t.Errorf("Unexpected families for IPv4: %v", families)
+	}
+
+	if families := get_announce_families(mixed_prefixes); !slices.Equal(families, []string{"ipv4-unicast", "ipv6-unicast"}) {
+		t.Errorf("Unexpected families for IPv4 and IPv6: %v", families)
+	}
+
+	conf.L3VPN = L3VPNConfiguration{Enabled: true, RouteDistinguisher: "65000:100"}
+
+	if families := get_announce_families(ipv4_prefixes); !slices.Equal(families, []string{"l3vpn-ipv4-unicast"}) {
+		t.Errorf("Unexpected families for IPv4 in L3VPN: %v", families)
+	}
+
+	if families := get_announce_families(mixed_prefixes); !slices.Equal(families, []string{"l3vpn-ipv4-unicast", "l3vpn-ipv6-unicast"}) {
+		t.Errorf("Unexpected families for IPv4 and IPv6 in L3VPN: %v", families)
+	}
+}
+
+func TestGetNegotiatedFamilies(t *testing.T) {
+	peer_state := &apipb.PeerState{
+		LocalCap:  build_multiprotocol_capabilities(t, "ipv4-unicast", "ipv6-unicast", "l3vpn-ipv4-unicast"),
+		RemoteCap: build_multiprotocol_capabilities(t, "ipv4-unicast", "l3vpn-ipv4-unicast", "l3vpn-ipv6-unicast"),
+	}
+
+	negotiated_families := get_negotiated_families(peer_state)
+
+	if len(negotiated_families) != 2 || !negotiated_families["ipv4-unicast"] || !negotiated_families["l3vpn-ipv4-unicast"] {
+		t.Errorf("Only families from both sides must be negotiated: %v", negotiated_families)
+	}
+
+	// Speaker without multiprotocol capability supports IPv4 unicast only
+	peer_state.RemoteCap = build_multiprotocol_capabilities(t)
+
+	negotiated_families = get_negotiated_families(peer_state)
+
+	if len(negotiated_families) != 1 || !negotiated_families["ipv4-unicast"] {
+		t.Errorf("Unexpected families for peer without multiprotocol capability: %v", negotiated_families)
+	}
+
+	// But we do not know anything about peer without capabilities at all, e.g. before OPEN message
+	peer_state.RemoteCap = nil
+
+	if negotiated_families := get_negotiated_families(peer_state); len(negotiated_families) != 0 {
+		t.Errorf("Unexpected families for peer without capabilities: %v", negotiated_families)
+	}
+}
@@ -0,0 +1,285 @@
+// Package gobgpfake provides in-memory gobgpd API for tests
+// It keeps paths in tables without any best path selection and advertises everything to all peers
+package gobgpfake
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+)
+
+type Server struct {
+	apipb.UnimplementedGobgpApiServer
+
+	mutex sync.Mutex
+
+	paths []stored_path
+	vrfs  []*apipb.Vrf
+	peers []*apipb.Peer
+
+	// We return this error from AddPath when it's set
+	add_path_error error
+
+	grpc_server *grpc.Server
+	listener    net.Listener
+}
+
+// Path in global table or VRF
+type stored_path struct {
+	// Empty for global table
+	vrf  string
+	path *apipb.Path
+}
+
+// Starts server on random port of loopback interface
+func Start() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot listen for fake gobgp API: %w", err)
+	}
+
+	s := &Server{
+		grpc_server: grpc.NewServer(),
+		listener:    listener,
+	}
+
+	apipb.RegisterGobgpApiServer(s.grpc_server, s)
+
+	go s.grpc_server.Serve(listener)
+
+	return s, nil
+}
+
+// Address for connection in host:port format
+func (s *Server) Address() string {
+	return s.listener.Addr().String()
+}
+
+func (s *Server) Stop() {
+	s.grpc_server.Stop()
+}
+
+// Returns copies of all paths from global table and VRFs
+func (s *Server) Paths() []*apipb.Path {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	paths := []*apipb.Path{}
+
+	for _, stored := range s.paths {
+		paths = append(paths, proto.Clone(stored.path).(*apipb.Path))
+	}
+
+	return paths
+}
+
+// Sets peers which we return from ListPeer
+func (s *Server) SetPeers(peers []*apipb.Peer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.peers = peers
+}
+
+// Makes all following calls of AddPath fail, nil resets it
+func (s *Server) SetAddPathError(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.add_path_error = err
+}
+
+// Same NLRI with same identifier in same table replaces previous path as in gobgp
+func is_same_path(a stored_path, vrf string, path *apipb.Path) bool {
+	return a.vrf == vrf &&
+		a.path.Identifier == path.Identifier &&
+		proto.Equal(a.path.Family, path.Family) &&
+		proto.Equal(a.path.Nlri, path.Nlri)
+}
+
+func (s *Server) AddPath(ctx context.Context, request *apipb.AddPathRequest) (*apipb.AddPathResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.add_path_error != nil {
+		return nil, s.add_path_error
+	}
+
+	if request.Path == nil || request.Path.Nlri == nil {
+		return nil, status.Error(codes.InvalidArgument, "path without nlri")
+	}
+
+	vrf := ""
+
+	if request.TableType == apipb.TableType_VRF {
+		if !s.has_vrf(request.VrfId) {
+			return nil, status.Errorf(codes.NotFound, "vrf %s not found", request.VrfId)
+		}
+
+		vrf = request.VrfId
+	}
+
+	path := proto.Clone(request.Path).(*apipb.Path)
+	path.IsWithdraw = false
+
+	paths := []stored_path{}
+
+	for _, stored := range s.paths {
+		if !is_same_path(stored, vrf, path) {
+			paths = append(paths, stored)
+		}
+	}
+
+	if !request.Path.IsWithdraw {
+		paths = append(paths, stored_path{vrf: vrf, path: path})
+	}
+
+	s.paths = paths
+
+	return &apipb.AddPathResponse{}, nil
+}
+
+func (s *Server) ListPath(request *apipb.ListPathRequest, stream apipb.GobgpApi_ListPathServer) error {
+	s.mutex.Lock()
+
+	vrf := ""
+
+	switch request.TableType {
+	case apipb.TableType_GLOBAL:
+	case apipb.TableType_VRF:
+		vrf = request.Name
+	case apipb.TableType_ADJ_OUT:
+		// We advertise everything from global table to all peers
+	default:
+		s.mutex.Unlock()
+		return status.Errorf(codes.Unimplemented, "table type %s is not supported", request.TableType)
+	}
+
+	destinations := []*apipb.Destination{}
+	destinations_by_prefix := make(map[string]*apipb.Destination)
+
+	for _, stored := range s.paths {
+		if stored.vrf != vrf || !proto.Equal(stored.path.Family, request.Family) {
+			continue
+		}
+
+		prefix := get_nlri_prefix(stored.path)
+
+		destination, ok := destinations_by_prefix[prefix]
+
+		if !ok {
+			destination = &apipb.Destination{Prefix: prefix}
+			destinations_by_prefix[prefix] = destination
+			destinations = append(destinations, destination)
+		}
+
+		destination.Paths = append(destination.Paths, proto.Clone(stored.path).(*apipb.Path))
+	}
+
+	s.mutex.Unlock()
+
+	for _, destination := range destinations {
+		err := stream.Send(&apipb.ListPathResponse{Destination: destination})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns prefix of path in same format as gobgp
+func get_nlri_prefix(path *apipb.Path) string {
+	prefix := apipb.IPAddressPrefix{}
+
+	if path.Nlri.UnmarshalTo(&prefix) == nil {
+		return fmt.Sprintf("%s/%d", prefix.Prefix, prefix.PrefixLen)
+	}
+
+	vpn_prefix := apipb.LabeledVPNIPAddressPrefix{}
+
+	if path.Nlri.UnmarshalTo(&vpn_prefix) == nil {
+		// gobgp adds route distinguisher in front of prefix and we do not parse it anyway
+		return fmt.Sprintf("%s:%s/%d", vpn_prefix.Rd.String(), vpn_prefix.Prefix, vpn_prefix.PrefixLen)
+	}
+
+	return path.Nlri.String()
+}
+
+func (s *Server) ListPeer(request *apipb.ListPeerRequest, stream apipb.GobgpApi_ListPeerServer) error {
+	s.mutex.Lock()
+	peers := s.peers
+	s.mutex.Unlock()
+
+	for _, peer := range peers {
+		if request.Address != "" && peer.GetConf().GetNeighborAddress() != request.Address {
+			continue
+		}
+
+		err := stream.Send(&apipb.ListPeerResponse{Peer: peer})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) has_vrf(name string) bool {
+	for _, vrf := range s.vrfs {
+		if vrf.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Server) AddVrf(ctx context.Context, request *apipb.AddVrfRequest) (*emptypb.Empty, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if request.Vrf == nil || request.Vrf.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "vrf without name")
+	}
+
+	if s.has_vrf(request.Vrf.Name) {
+		return nil, status.Errorf(codes.AlreadyExists, "vrf %s already exists", request.Vrf.Name)
+	}
+
+	s.vrfs = append(s.vrfs, proto.Clone(request.Vrf).(*apipb.Vrf))
+
+	return &emptypb.Empty{}, nil
+}
+
+func (s *Server) ListVrf(request *apipb.ListVrfRequest, stream apipb.GobgpApi_ListVrfServer) error {
+	s.mutex.Lock()
+	vrfs := s.vrfs
+	s.mutex.Unlock()
+
+	for _, vrf := range vrfs {
+		if request.Name != "" && vrf.Name != request.Name {
+			continue
+		}
+
+		err := stream.Send(&apipb.ListVrfResponse{Vrf: vrf})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,323 @@
+// Package mmdbtest writes small MaxMind DB files for tests
+// Format: https://maxmind.github.io/MaxMind-DB/
+package mmdbtest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// Network with record which we return for it
+// Record may have string, float64, uint16, uint32, int, uint64, bool, lists and maps with string keys
+type Network struct {
+	Prefix netip.Prefix
+	Record map[string]any
+}
+
+// Record in format of MaxMind and DB-IP country databases
+func Country(iso_code string, name string) map[string]any {
+	return map[string]any{
+		"country": map[string]any{
+			"iso_code": iso_code,
+			"names":    map[string]any{"en": name},
+		},
+	}
+}
+
+// Record in format of MaxMind City database with single subdivision
+func City(iso_code string, name string, subdivision_code string, subdivision_name string) map[string]any {
+	record := Country(iso_code, name)
+
+	record["subdivisions"] = []any{
+		map[string]any{
+			"iso_code": subdivision_code,
+			"names":    map[string]any{"en": subdivision_name},
+		},
+	}
+
+	return record
+}
+
+// Record in format of ASN database
+func ASN(asn uint32, organization string) map[string]any {
+	return map[string]any{
+		"autonomous_system_number":       asn,
+		"autonomous_system_organization": organization,
+	}
+}
+
+// Writes database into temporary directory of test and returns path to it
+func WriteTemp(t testing.TB, database_type string, networks []Network) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), database_type+".mmdb")
+
+	err := Write(path, database_type, 1700000000, networks)
+
+	if err != nil {
+		t.Fatalf("Cannot write test database: %v", err)
+	}
+
+	return path
+}
+
+// Node of search tree, we keep IPv4 networks in ::/96 part of IPv6 tree
+type node struct {
+	children [2]*node
+
+	// Offset of record in data section or -1 when we do not have record
+	data [2]int
+}
+
+func new_node() *node {
+	return &node{data: [2]int{-1, -1}}
+}
+
+// Writes database with 24 bit records
+func Write(path string, database_type string, build_epoch uint64, networks []Network) error {
+	root := new_node()
+
+	var data bytes.Buffer
+
+	for _, network := range networks {
+		offset := data.Len()
+
+		err := encode_value(&data, network.Record)
+
+		if err != nil {
+			return err
+		}
+
+		prefix := network.Prefix.Masked()
+
+		address := prefix.Addr().As16()
+		bits := prefix.Bits()
+
+		// IPv4 networks live in ::/96 and not in IPv4-mapped ::ffff:0:0/96
+		if prefix.Addr().Is4() {
+			ipv4_address := prefix.Addr().As4()
+
+			address = [16]byte{}
+			copy(address[12:], ipv4_address[:])
+
+			bits += 96
+		}
+
+		if bits == 0 {
+			return fmt.Errorf("Cannot add network %s without bits", prefix)
+		}
+
+		current := root
+
+		for i := 0; i < bits; i++ {
+			bit := (address[i/8] >> (7 - uint(i%8))) & 1
+
+			if i == bits-1 {
+				current.data[bit] = offset
+				break
+			}
+
+			if current.children[bit] == nil {
+				current.children[bit] = new_node()
+			}
+
+			current = current.children[bit]
+		}
+	}
+
+	// We number nodes in breadth first order and root has number zero
+	nodes := []*node{root}
+	node_numbers := map[*node]int{root: 0}
+
+	for i := 0; i < len(nodes); i++ {
+		for _, child := range nodes[i].children {
+			if child != nil {
+				node_numbers[child] = len(nodes)
+				nodes = append(nodes, child)
+			}
+		}
+	}
+
+	node_count := len(nodes)
+
+	var out bytes.Buffer
+
+	write_record := func(value int) {
+		out.Write([]byte{byte(value >> 16), byte(value >> 8), byte(value)})
+	}
+
+	for _, n := range nodes {
+		for bit := 0; bit < 2; bit++ {
+			switch {
+			case n.children[bit] != nil:
+				write_record(node_numbers[n.children[bit]])
+			case n.data[bit] >= 0:
+				// Pointers to data skip 16 byte separator after tree
+				write_record(node_count + 16 + n.data[bit])
+			default:
+				// Node count means that we do not have data for network
+				write_record(node_count)
+			}
+		}
+	}
+
+	out.Write(make([]byte, 16))
+	out.Write(data.Bytes())
+	out.WriteString("\xAB\xCD\xEFMaxMind.com")
+
+	err := encode_value(&out, map[string]any{
+		"node_count":                  uint32(node_count),
+		"record_size":                 uint16(24),
+		"ip_version":                  uint16(6),
+		"database_type":               database_type,
+		"languages":                   []any{"en"},
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 build_epoch,
+		"description":                 map[string]any{"en": "Test database"},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, out.Bytes(), 0644)
+}
+
+// Data types from specification
+const (
+	type_string  = 2
+	type_double  = 3
+	type_map     = 7
+	type_uint16  = 5
+	type_uint32  = 6
+	type_uint64  = 9
+	type_array   = 11
+	type_boolean = 14
+)
+
+// Writes control byte with type and size
+func encode_control(buf *bytes.Buffer, type_id int, size int) {
+	var control byte
+
+	extended := type_id > 7
+
+	if !extended {
+		control = byte(type_id << 5)
+	}
+
+	var size_bytes []byte
+
+	switch {
+	case size < 29:
+		control |= byte(size)
+	case size < 285:
+		control |= 29
+		size_bytes = []byte{byte(size - 29)}
+	case size < 65821:
+		control |= 30
+		size_bytes = []byte{byte((size - 285) >> 8), byte(size - 285)}
+	default:
+		control |= 31
+		size_bytes = []byte{byte((size - 65821) >> 16), byte((size - 65821) >> 8), byte(size - 65821)}
+	}
+
+	buf.WriteByte(control)
+
+	if extended {
+		buf.WriteByte(byte(type_id - 7))
+	}
+
+	buf.Write(size_bytes)
+}
+
+// Unsigned integers use as few bytes as possible
+func encode_uint(buf *bytes.Buffer, type_id int, value uint64) {
+	b := binary.BigEndian.AppendUint64(nil, value)
+
+	i := 0
+
+	for i < len(b) && b[i] == 0 {
+		i++
+	}
+
+	encode_control(buf, type_id, len(b)-i)
+	buf.Write(b[i:])
+}
+
+func encode_value(buf *bytes.Buffer, value any) error {
+	switch v := value.(type) {
+	case string:
+		encode_control(buf, type_string, len(v))
+		buf.WriteString(v)
+	case float64:
+		encode_control(buf, type_double, 8)
+		buf.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(v)))
+	case uint16:
+		encode_uint(buf, type_uint16, uint64(v))
+	case uint32:
+		encode_uint(buf, type_uint32, uint64(v))
+	case int:
+		encode_uint(buf, type_uint32, uint64(v))
+	case uint64:
+		encode_uint(buf, type_uint64, v)
+	case bool:
+		size := 0
+
+		if v {
+			size = 1
+		}
+
+		encode_control(buf, type_boolean, size)
+	case []any:
+		encode_control(buf, type_array, len(v))
+
+		for _, element := range v {
+			err := encode_value(buf, element)
+
+			if err != nil {
+				return err
+			}
+		}
+	case []string:
+		encode_control(buf, type_array, len(v))
+
+		for _, element := range v {
+			encode_control(buf, type_string, len(element))
+			buf.WriteString(element)
+		}
+	case map[string]any:
+		encode_control(buf, type_map, len(v))
+
+		// Stable order makes files reproducible
+		keys := make([]string, 0, len(v))
+
+		for key := range v {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			encode_control(buf, type_string, len(key))
+			buf.WriteString(key)
+
+			err := encode_value(buf, v[key])
+
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("Cannot encode value of type %T", value)
+	}
+
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	apb "google.golang.org/protobuf/types/known/anypb"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+
+	"bitbucket.org/fastnetmon/country_lockdown/announcer"
+)
+
+// Announces into VPNv4 / VPNv6 for MPLS networks without blackholing in global table
+type L3VPNConfiguration struct {
+	Enabled bool `json:"enabled"`
+
+	// In form of 65000:100, 4200000000:100 or 10.0.0.1:100
+	RouteDistinguisher string `json:"route_distinguisher"`
+
+	// Added as extended communities to every announce, same formats as for route distinguisher
+	RouteTargets []string `json:"route_targets"`
+
+	// MPLS label for our announces
+	Label uint32 `json:"label"`
+
+	// When set we create VRF in gobgp and announce into it instead of global VPN table
+	VRF   string `json:"vrf"`
+	VRFID uint32 `json:"vrf_id"`
+}
+
+// Parses route distinguisher and route targets from configuration
+func parse_l3vpn_attributes(l3vpn_conf L3VPNConfiguration) (*announcer.L3VPN, error) {
+	if l3vpn_conf.RouteDistinguisher == "" {
+		return nil, fmt.Errorf("Route distinguisher for L3VPN is not set")
+	}
+
+	route_distinguisher, err := parse_route_distinguisher(l3vpn_conf.RouteDistinguisher)
+
+	if err != nil {
+		return nil, err
+	}
+
+	attributes := &announcer.L3VPN{
+		RouteDistinguisher: route_distinguisher,
+		Label:              l3vpn_conf.Label,
+		VRF:                l3vpn_conf.VRF,
+	}
+
+	for _, route_target_as_string := range l3vpn_conf.RouteTargets {
+		route_target, err := parse_route_target(route_target_as_string)
+
+		if err != nil {
+			return nil, err
+		}
+
+		attributes.RouteTargets = append(attributes.RouteTargets, route_target)
+	}
+
+	return attributes, nil
+}
+
+// Returns L3VPN attributes for announces or nil when we announce into global table
+func get_configured_l3vpn() (*announcer.L3VPN, error) {
+	if !conf.L3VPN.Enabled {
+		return nil, nil
+	}
+
+	return parse_l3vpn_attributes(conf.L3VPN)
+}
+
+// Splits value in form admin:assigned
+func split_administrator_and_assigned(value string) (string, uint64, error) {
+	separator := strings.LastIndex(value, ":")
+
+	if separator == -1 {
+		return "", 0, fmt.Errorf("%s must be in form administrator:assigned number", value)
+	}
+
+	assigned, err := strconv.ParseUint(value[separator+1:], 10, 32)
+
+	if err != nil {
+		return "", 0, fmt.Errorf("Cannot parse assigned number in %s: %v", value, err)
+	}
+
+	return value[:separator], assigned, nil
+}
+
+// Parses route distinguisher into one of three types from RFC 4364
+func parse_route_distinguisher(value string) (*apb.Any, error) {
+	administrator, assigned, err := split_administrator_and_assigned(value)
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse route distinguisher: %w", err)
+	}
+
+	if addr, err := netip.ParseAddr(administrator); err == nil {
+		if !addr.Is4() || assigned > 0xffff {
+			return nil, fmt.Errorf("Route distinguisher %s must have IPv4 address and 16 bit assigned number", value)
+		}
+
+		return apb.New(&apipb.RouteDistinguisherIPAddress{Admin: addr.String(), Assigned: uint32(assigned)})
+	}
+
+	asn, err := strconv.ParseUint(administrator, 10, 32)
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse ASN in route distinguisher %s: %v", value, err)
+	}
+
+	if asn <= 0xffff {
+		return apb.New(&apipb.RouteDistinguisherTwoOctetASN{Admin: uint32(asn), Assigned: uint32(assigned)})
+	}
+
+	if assigned > 0xffff {
+		return nil, fmt.Errorf("Route distinguisher %s with 32 bit ASN must have 16 bit assigned number", value)
+	}
+
+	return apb.New(&apipb.RouteDistinguisherFourOctetASN{Admin: uint32(asn), Assigned: uint32(assigned)})
+}
+
+// Parses route target into transitive extended community
+func parse_route_target(value string) (*apb.Any, error) {
+	// Sub type for route target: https://www.iana.org/assignments/bgp-extended-communities
+	const route_target_sub_type = 0x02
+
+	administrator, assigned, err := split_administrator_and_assigned(value)
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse route target: %w", err)
+	}
+
+	if addr, err := netip.ParseAddr(administrator); err == nil {
+		if !addr.Is4() || assigned > 0xffff {
+			return nil, fmt.Errorf("Route target %s must have IPv4 address and 16 bit assigned number", value)
+		}
+
+		return apb.New(&apipb.IPv4AddressSpecificExtended{
+			IsTransitive: true,
+			SubType:      route_target_sub_type,
+			Address:      addr.String(),
+			LocalAdmin:   uint32(assigned),
+		})
+	}
+
+	asn, err := strconv.ParseUint(administrator, 10, 32)
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse ASN in route target %s: %v", value, err)
+	}
+
+	if asn <= 0xffff {
+		return apb.New(&apipb.TwoOctetAsSpecificExtended{
+			IsTransitive: true,
+			SubType:      route_target_sub_type,
+			Asn:          uint32(asn),
+			LocalAdmin:   uint32(assigned),
+		})
+	}
+
+	if assigned > 0xffff {
+		return nil, fmt.Errorf("Route target %s with 32 bit ASN must have 16 bit assigned number", value)
+	}
+
+	return apb.New(&apipb.FourOctetAsSpecificExtended{
+		IsTransitive: true,
+		SubType:      route_target_sub_type,
+		Asn:          uint32(asn),
+		LocalAdmin:   uint32(assigned),
+	})
+}
+
+// Creates VRF in gobgp unless it exists already
+func ensure_vrf(ctx context.Context, gobgp_client apipb.GobgpApiClient, l3vpn_conf L3VPNConfiguration, l3vpn_attributes *announcer.L3VPN) error {
+	stream, err := gobgp_client.ListVrf(ctx, &apipb.ListVrfRequest{Name: l3vpn_conf.VRF})
+
+	if err != nil {
+		return fmt.Errorf("Cannot list VRFs: %w", err)
+	}
+
+	for {
+		r, err := stream.Recv()
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Cannot list VRFs: %w", err)
+		}
+
+		if r.Vrf.GetName() != l3vpn_conf.VRF {
+			continue
+		}
+
+		if !proto.Equal(r.Vrf.Rd, l3vpn_attributes.RouteDistinguisher) {
+			return fmt.Errorf("VRF %s exists but has different route distinguisher", l3vpn_conf.VRF)
+		}
+
+		return nil
+	}
+
+	slog.Info("Creating VRF", "vrf", l3vpn_conf.VRF, "route_distinguisher", l3vpn_conf.RouteDistinguisher)
+
+	_, err = gobgp_client.AddVrf(ctx, &apipb.AddVrfRequest{
+		Vrf: &apipb.Vrf{
+			Name:     l3vpn_conf.VRF,
+			Id:       l3vpn_conf.VRFID,
+			Rd:       l3vpn_attributes.RouteDistinguisher,
+			ImportRt: l3vpn_attributes.RouteTargets,
+			ExportRt: l3vpn_attributes.RouteTargets,
+		},
+	})
+
+	if err != nil {
+		return fmt.Errorf("Cannot create VRF %s: %w", l3vpn_conf.VRF, err)
+	}
+
+	return nil
+}
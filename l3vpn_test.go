@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	apb "google.golang.org/protobuf/types/known/anypb"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+)
+
+func check_any(t *testing.T, value *apb.Any, expected proto.Message) {
+	t.Helper()
+
+	message, err := value.UnmarshalNew()
+
+	if err != nil {
+		t.Fatalf("Cannot decode %v: %v", value, err)
+	}
+
+	if !proto.Equal(message, expected) {
+		t.Errorf("Unexpected value %v, expected %v", message, expected)
+	}
+}
+
+func TestParseRouteDistinguisher(t *testing.T) {
+	// All three types from RFC 4364
+	route_distinguishers := map[string]proto.Message{
+		"65000:100":        &apipb.RouteDistinguisherTwoOctetASN{Admin: 65000, Assigned: 100},
+		"65000:4000000000": &apipb.RouteDistinguisherTwoOctetASN{Admin: 65000, Assigned: 4000000000},
+		"4200000000:100":   &apipb.RouteDistinguisherFourOctetASN{Admin: 4200000000, Assigned: 100},
+		"10.0.0.1:100":     &apipb.RouteDistinguisherIPAddress{Admin: "10.0.0.1", Assigned: 100},
+		"10.0.0.1:65535":   &apipb.RouteDistinguisherIPAddress{Admin: "10.0.0.1", Assigned: 65535},
+		"4200000000:65535": &apipb.RouteDistinguisherFourOctetASN{Admin: 4200000000, Assigned: 65535},
+		"65535:4294967295": &apipb.RouteDistinguisherTwoOctetASN{Admin: 65535, Assigned: 4294967295},
+	}
+
+	for value, expected := range route_distinguishers {
+		route_distinguisher, err := parse_route_distinguisher(value)
+
+		if err != nil {
+			t.Errorf("Cannot parse route distinguisher %s: %v", value, err)
+			continue
+		}
+
+		check_any(t, route_distinguisher, expected)
+	}
+
+	broken_route_distinguishers := []string{"", "65000", "65000:", "as65000:100", "65000:4294967296", "4200000000:65536", "10.0.0.1:65536", "2001:db8::1:100", "4294967296:1"}
+
+	for _, value := range broken_route_distinguishers {
+		if _, err := parse_route_distinguisher(value); err == nil {
+			t.Errorf("We must reject route distinguisher %s", value)
+		}
+	}
+}
+
+func TestParseRouteTarget(t *testing.T) {
+	route_targets := map[string]proto.Message{
+		"65000:100":      &apipb.TwoOctetAsSpecificExtended{IsTransitive: true, SubType: 0x02, Asn: 65000, LocalAdmin: 100},
+		"4200000000:100": &apipb.FourOctetAsSpecificExtended{IsTransitive: true, SubType: 0x02, Asn: 4200000000, LocalAdmin: 100},
+		"10.0.0.1:100":   &apipb.IPv4AddressSpecificExtended{IsTransitive: true, SubType: 0x02, Address: "10.0.0.1", LocalAdmin: 100},
+	}
+
+	for value, expected := range route_targets {
+		route_target, err := parse_route_target(value)
+
+		if err != nil {
+			t.Errorf("Cannot parse route target %s: %v", value, err)
+			continue
+		}
+
+		check_any(t, route_target, expected)
+	}
+
+	for _, value := range []string{"65000", "4200000000:65536", "10.0.0.1:65536", "target:1"} {
+		if _, err := parse_route_target(value); err == nil {
+			t.Errorf("We must reject route target %s", value)
+		}
+	}
+}
+
+func TestParseL3VPNAttributes(t *testing.T) {
+	attributes, err := parse_l3vpn_attributes(L3VPNConfiguration{
+		Enabled:            true,
+		RouteDistinguisher: "65000:100",
+		RouteTargets:       []string{"65000:1", "10.0.0.1:2"},
+		Label:              16,
+		VRF:                "blackhole",
+	})
+
+	if err != nil {
+		t.Fatalf("Cannot parse L3VPN attributes: %v", err)
+	}
+
+	if len(attributes.RouteTargets) != 2 || attributes.Label != 16 || attributes.VRF != "blackhole" {
+		t.Fatalf("Unexpected attributes: %+v", attributes)
+	}
+
+	check_any(t, attributes.RouteDistinguisher, &apipb.RouteDistinguisherTwoOctetASN{Admin: 65000, Assigned: 100})
+	check_any(t, attributes.RouteTargets[1], &apipb.IPv4AddressSpecificExtended{IsTransitive: true, SubType: 0x02, Address: "10.0.0.1", LocalAdmin: 2})
+
+	broken_configurations := []L3VPNConfiguration{
+		{Enabled: true},
+		{Enabled: true, RouteDistinguisher: "65000"},
+		{Enabled: true, RouteDistinguisher: "65000:100", RouteTargets: []string{"65000:1", "65000"}},
+	}
+
+	for _, l3vpn_conf := range broken_configurations {
+		if _, err := parse_l3vpn_attributes(l3vpn_conf); err == nil {
+			t.Errorf("We must reject L3VPN configuration %+v", l3vpn_conf)
+		}
+	}
+}
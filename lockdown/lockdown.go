@@ -0,0 +1,201 @@
+// Package lockdown turns list of countries and allow list into aggregated prefixes and announces them
+// It's same logic which country_lockdown CLI uses and we keep this API stable for other tools:
+//
+//	result, err := lockdown.Compute(ctx, lockdown.Config{
+//		GeoSourcePaths: []string{"/usr/share/GeoIP/GeoIP2-Country.mmdb"},
+//		Countries:      []string{"KP", "UA-43"},
+//		Allow:          []netip.Prefix{netip.MustParsePrefix("1.2.3.4/32")},
+//	})
+//
+//	reconcile_result, err := lockdown.Reconcile(ctx, announcer.NewGoBGP(client, attributes), result)
+package lockdown
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+
+	"bitbucket.org/fastnetmon/country_lockdown/announcer"
+	"bitbucket.org/fastnetmon/country_lockdown/blockset"
+	"bitbucket.org/fastnetmon/country_lockdown/geo"
+	"bitbucket.org/fastnetmon/country_lockdown/reconciler"
+)
+
+// What we block and what we exempt
+type Config struct {
+	// Already opened source, we do not close it. When it's nil we open source from type and paths
+	GeoSource geo.Source
+
+	// maxmind by default, please check geo.SourceTypes for all types
+	GeoSourceType  string
+	GeoSourcePaths []string
+
+	// Only for GeoIP2-Enterprise: we ignore countries and subdivisions with lower confidence, from 0 to 100
+	MinConfidence uint
+
+	// Local fixes for networks which geo source places in wrong country
+	GeoIPOverrides []geo.Override
+
+	// Countries (KP), subdivisions by ISO code (UA-43) or by English name (UA:Crimea)
+	Countries []string
+
+	// We return error when we cannot load some of countries, with it we skip them with warning in diagnostics
+	AllowPartial bool
+
+	// Networks of ASNs and reputation lists which we block in addition to countries
+	ASNs  map[uint][]netip.Prefix
+	Feeds map[string][]netip.Prefix
+
+	// Networks without category, e.g. manual entries
+	Extra []netip.Prefix
+
+	// We never block these networks
+	Allow []netip.Prefix
+}
+
+// Block list with details for every category after applying allow list
+type Result struct {
+	Prefixes  []netip.Prefix `json:"prefixes"`
+	Addresses uint64         `json:"addresses"`
+
+	Countries         map[string]blockset.Stats `json:"countries"`
+	PrefixesByCountry map[string][]netip.Prefix `json:"prefixes_by_country"`
+	ASNs              map[uint]blockset.Stats   `json:"asns,omitempty"`
+	Feeds             map[string]blockset.Stats `json:"feeds,omitempty"`
+
+	Diagnostics Diagnostics `json:"diagnostics"`
+}
+
+// Details about data which we used
+type Diagnostics struct {
+	GeoIPBuildEpoch   uint   `json:"geoip_build_epoch"`
+	GeoIPDatabaseType string `json:"geoip_database_type"`
+
+	// Networks of blocked countries which changed country because of overrides
+	GeoIPOverrides []geo.OverrideUsage `json:"geoip_overrides,omitempty"`
+
+	// Entries which we skipped, e.g. countries which we cannot load
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// Opens geo source from configuration and applies overrides on top of it
+func open_geo_source(config Config) (geo.Source, bool, error) {
+	source := config.GeoSource
+	opened := false
+
+	if source == nil {
+		source_type := config.GeoSourceType
+
+		if source_type == "" {
+			source_type = "maxmind"
+		}
+
+		var err error
+
+		source, err = geo.Open(source_type, config.GeoSourcePaths, geo.Options{MinConfidence: config.MinConfidence})
+
+		if err != nil {
+			return nil, false, err
+		}
+
+		opened = true
+	}
+
+	if len(config.GeoIPOverrides) > 0 {
+		source = geo.NewOverrideSource(source, config.GeoIPOverrides)
+	}
+
+	return source, opened, nil
+}
+
+// Loads networks for all countries and calculates aggregated block list
+func Compute(ctx context.Context, config Config) (Result, error) {
+	geo_source, opened, err := open_geo_source(config)
+
+	if err != nil {
+		return Result{}, err
+	}
+
+	if opened {
+		defer geo_source.Close()
+	}
+
+	diagnostics := Diagnostics{
+		GeoIPBuildEpoch:   geo_source.BuildEpoch(),
+		GeoIPDatabaseType: geo_source.DatabaseType(),
+		GeoIPOverrides:    []geo.OverrideUsage{},
+	}
+
+	input := blockset.Input{
+		Countries: make(map[string][]netip.Prefix),
+		ASNs:      config.ASNs,
+		Feeds:     config.Feeds,
+		Extra:     config.Extra,
+		Allow:     config.Allow,
+	}
+
+	countries := []string{}
+
+	for _, country_code := range config.Countries {
+		_, err := geo.ParseSourceEntry(geo_source, country_code)
+
+		if err == nil {
+			countries = append(countries, country_code)
+			continue
+		}
+
+		if !config.AllowPartial {
+			return Result{}, fmt.Errorf("Cannot load prefixes for country %s: %w", country_code, err)
+		}
+
+		slog.Error("Cannot load prefixes for country", "country", country_code, "error", err)
+		diagnostics.Warnings = append(diagnostics.Warnings, fmt.Sprintf("Cannot load prefixes for country %s: %v", country_code, err))
+	}
+
+	// Walk over large database takes a while
+	if ctx.Err() != nil {
+		return Result{}, ctx.Err()
+	}
+
+	prefixes_by_country, err := geo.LoadNetworksByEntry(geo_source, countries)
+
+	if err != nil {
+		return Result{}, fmt.Errorf("Cannot load prefixes for countries: %w", err)
+	}
+
+	for _, country_code := range countries {
+		country_prefix_list := prefixes_by_country[country_code]
+
+		slog.Info("Loaded prefixes for country", "country", country_code, "prefixes", len(country_prefix_list))
+
+		slog.Debug("Country prefixes", "country", country_code, "prefix_list", country_prefix_list)
+
+		if len(country_prefix_list) == 0 {
+			diagnostics.Warnings = append(diagnostics.Warnings, fmt.Sprintf("Geo source does not have networks for %s", country_code))
+		}
+
+		input.Countries[country_code] = country_prefix_list
+	}
+
+	block_set := blockset.Compute(input)
+
+	if override_source, ok := geo_source.(*geo.OverrideSource); ok {
+		diagnostics.GeoIPOverrides = override_source.Usage(config.Countries)
+	}
+
+	return Result{
+		Prefixes:          block_set.Prefixes,
+		Addresses:         blockset.CountAddresses(block_set.Prefixes),
+		Countries:         block_set.Countries,
+		PrefixesByCountry: block_set.PrefixesByCountry,
+		ASNs:              block_set.ASNs,
+		Feeds:             block_set.Feeds,
+		Diagnostics:       diagnostics,
+	}, nil
+}
+
+// Announces prefixes from result which we do not announce yet and withdraws our announces which are not in result
+func Reconcile(ctx context.Context, a announcer.Announcer, result Result) (reconciler.Result, error) {
+	return reconciler.Reconcile(ctx, slog.Default(), a, result.Prefixes)
+}
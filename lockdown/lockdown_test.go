@@ -0,0 +1,153 @@
+package lockdown
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+
+	"bitbucket.org/fastnetmon/country_lockdown/announcer"
+	"bitbucket.org/fastnetmon/country_lockdown/geo"
+	"bitbucket.org/fastnetmon/country_lockdown/internal/gobgpfake"
+	"bitbucket.org/fastnetmon/country_lockdown/internal/mmdbtest"
+)
+
+func write_test_database(t *testing.T) string {
+	return mmdbtest.WriteTemp(t, "GeoLite2-Country", []mmdbtest.Network{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Record: mmdbtest.Country("TV", "Tuvalu")},
+		{Prefix: netip.MustParsePrefix("10.0.1.0/24"), Record: mmdbtest.Country("NR", "Nauru")},
+		{Prefix: netip.MustParsePrefix("10.0.2.0/24"), Record: mmdbtest.Country("KI", "Kiribati")},
+	})
+}
+
+func TestCompute(t *testing.T) {
+	result, err := Compute(context.Background(), Config{
+		GeoSourcePaths: []string{write_test_database(t)},
+		GeoIPOverrides: []geo.Override{{Prefix: netip.MustParsePrefix("10.0.2.0/25"), Country: "TV"}},
+		Countries:      []string{"TV", "NR", "AQ"},
+		Allow:          []netip.Prefix{netip.MustParsePrefix("10.0.1.0/25")},
+	})
+
+	if err != nil {
+		t.Fatalf("Cannot compute block list: %v", err)
+	}
+
+	expected := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/24"),
+		netip.MustParsePrefix("10.0.1.128/25"),
+		netip.MustParsePrefix("10.0.2.0/25"),
+	}
+
+	if !slices.Equal(result.Prefixes, expected) {
+		t.Fatalf("Unexpected prefixes %v, expected %v", result.Prefixes, expected)
+	}
+
+	if result.Addresses != 512 {
+		t.Errorf("Unexpected number of addresses: %d", result.Addresses)
+	}
+
+	if !slices.Equal(result.PrefixesByCountry["NR"], []netip.Prefix{netip.MustParsePrefix("10.0.1.128/25")}) {
+		t.Errorf("Unexpected prefixes for NR: %v", result.PrefixesByCountry["NR"])
+	}
+
+	if result.Countries["TV"].Addresses != 384 {
+		t.Errorf("Unexpected stats for TV: %+v", result.Countries["TV"])
+	}
+
+	if len(result.Diagnostics.GeoIPOverrides) != 1 || result.Diagnostics.GeoIPOverrides[0].FromCountry != "KI" {
+		t.Errorf("Unexpected usage of overrides: %+v", result.Diagnostics.GeoIPOverrides)
+	}
+
+	// Antarctica does not have networks in our database
+	if len(result.Diagnostics.Warnings) != 1 {
+		t.Errorf("Unexpected warnings: %v", result.Diagnostics.Warnings)
+	}
+
+	if result.Diagnostics.GeoIPDatabaseType != "GeoLite2-Country" {
+		t.Errorf("Unexpected database type: %s", result.Diagnostics.GeoIPDatabaseType)
+	}
+}
+
+func TestComputeFailsOnBrokenCountry(t *testing.T) {
+	config := Config{
+		GeoSourcePaths: []string{write_test_database(t)},
+		Countries:      []string{"TV", "Tuvalu"},
+	}
+
+	if _, err := Compute(context.Background(), config); err == nil {
+		t.Fatalf("Compute must fail when we cannot load country")
+	}
+
+	config.AllowPartial = true
+
+	result, err := Compute(context.Background(), config)
+
+	if err != nil {
+		t.Fatalf("Cannot compute partial block list: %v", err)
+	}
+
+	if !slices.Equal(result.Prefixes, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}) || len(result.Diagnostics.Warnings) != 1 {
+		t.Errorf("Unexpected partial result: %v %v", result.Prefixes, result.Diagnostics.Warnings)
+	}
+}
+
+func TestComputeStopsOnCancelledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := Compute(ctx, Config{
+		GeoSourcePaths: []string{write_test_database(t)},
+		Countries:      []string{"TV"},
+	})
+
+	if err == nil {
+		t.Fatalf("Compute must fail with cancelled context")
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+
+	server, err := gobgpfake.Start()
+
+	if err != nil {
+		t.Fatalf("Cannot start fake gobgp: %v", err)
+	}
+
+	defer server.Stop()
+
+	conn, err := grpc.NewClient(server.Address(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+
+	if err != nil {
+		t.Fatalf("Cannot connect to fake gobgp: %v", err)
+	}
+
+	defer conn.Close()
+
+	a := announcer.NewGoBGP(apipb.NewGobgpApiClient(conn), announcer.Attributes{NextHop: netip.MustParseAddr("192.0.2.1")})
+
+	result, err := Compute(ctx, Config{
+		GeoSourcePaths: []string{write_test_database(t)},
+		Countries:      []string{"TV", "NR"},
+	})
+
+	if err != nil {
+		t.Fatalf("Cannot compute block list: %v", err)
+	}
+
+	reconcile_result, err := Reconcile(ctx, a, result)
+
+	if err != nil {
+		t.Fatalf("Cannot reconcile: %v", err)
+	}
+
+	// Adjacent networks are aggregated into single prefix
+	if reconcile_result.Announced != 1 || len(server.Paths()) != 1 {
+		t.Errorf("Unexpected result: %+v", reconcile_result)
+	}
+}
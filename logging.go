@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+
+	gobgp_log "github.com/osrg/gobgp/v3/pkg/log"
+)
+
+// Configures default logger, format is text or json, level is debug, info, warn or error
+func setup_logging(format string, level string) error {
+	var log_level slog.Level
+
+	err := log_level.UnmarshalText([]byte(level))
+
+	if err != nil {
+		return fmt.Errorf("Unknown log level %s", level)
+	}
+
+	handler_options := &slog.HandlerOptions{Level: log_level}
+
+	var handler slog.Handler
+
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, handler_options)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, handler_options)
+	default:
+		return fmt.Errorf("Unknown log format %s, please use text or json", format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+
+	return nil
+}
+
+// Passes logs from embedded gobgp server into our logger
+type GoBGPLogger struct {
+	logger *slog.Logger
+}
+
+func (l *GoBGPLogger) log(level slog.Level, msg string, fields gobgp_log.Fields) {
+	keys := []string{}
+
+	for key := range fields {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	args := []any{}
+
+	for _, key := range keys {
+		args = append(args, key, fields[key])
+	}
+
+	l.logger.Log(context.Background(), level, msg, args...)
+}
+
+func (l *GoBGPLogger) Panic(msg string, fields gobgp_log.Fields) {
+	l.log(slog.LevelError, msg, fields)
+	panic(msg)
+}
+
+func (l *GoBGPLogger) Fatal(msg string, fields gobgp_log.Fields) {
+	l.log(slog.LevelError, msg, fields)
+	os.Exit(1)
+}
+
+func (l *GoBGPLogger) Error(msg string, fields gobgp_log.Fields) {
+	l.log(slog.LevelError, msg, fields)
+}
+
+func (l *GoBGPLogger) Warn(msg string, fields gobgp_log.Fields) {
+	l.log(slog.LevelWarn, msg, fields)
+}
+
+func (l *GoBGPLogger) Info(msg string, fields gobgp_log.Fields) {
+	l.log(slog.LevelInfo, msg, fields)
+}
+
+func (l *GoBGPLogger) Debug(msg string, fields gobgp_log.Fields) {
+	l.log(slog.LevelDebug, msg, fields)
+}
+
+// Level is controlled by our configuration
+func (l *GoBGPLogger) SetLevel(level gobgp_log.LogLevel) {
+}
+
+func (l *GoBGPLogger) GetLevel() gobgp_log.LogLevel {
+	if l.logger.Enabled(context.Background(), slog.LevelDebug) {
+		return gobgp_log.DebugLevel
+	}
+
+	return gobgp_log.InfoLevel
+}
+
+// Logs error and stops process
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
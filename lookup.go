@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"strings"
+
+	apb "google.golang.org/protobuf/types/known/anypb"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+
+	"bitbucket.org/fastnetmon/country_lockdown/announcer"
+	"bitbucket.org/fastnetmon/country_lockdown/geo"
+)
+
+// Explains why address is blocked or not
+func run_lookup(ctx context.Context, address string) error {
+	addr, err := netip.ParseAddr(address)
+
+	if err != nil {
+		return fmt.Errorf("Cannot parse IP address %s: %v", address, err)
+	}
+
+	addr = addr.Unmap()
+
+	err = print_geoip_record(addr)
+
+	if err != nil {
+		return err
+	}
+
+	if conf.ASNPath != "" {
+		err = print_asn_record(addr)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, profile := range get_blocking_profiles() {
+		block_list, err := compute_block_list(ctx, profile)
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Println()
+
+		if len(conf.Profiles) > 0 {
+			fmt.Printf("Profile:             %s (marker %s)\n", profile.Name, profile.MarkerCommunity)
+		}
+
+		blocking_prefix_found := false
+
+		for _, prefix := range block_list.Prefixes {
+			if prefix.Contains(addr) {
+				fmt.Printf("Block list:          blocked via aggregated prefix %s\n", prefix)
+				blocking_prefix_found = true
+				break
+			}
+		}
+
+		if !blocking_prefix_found {
+			fmt.Printf("Block list:          not blocked\n")
+		}
+
+		err = print_matching_list_entries(addr, profile)
+
+		if err != nil {
+			return err
+		}
+
+		for _, target := range get_gobgp_targets(profile) {
+			err = print_rib_entries(ctx, profile, target, addr)
+
+			if err != nil {
+				fmt.Printf("RIB of %s: %v\n", target.Name, describe_gobgp_error(target.Address, err))
+			}
+		}
+	}
+
+	return nil
+}
+
+// Prints network and countries for address from GeoIP database
+func print_geoip_record(addr netip.Addr) error {
+	geo_source, err := open_configured_geo_source_with_overrides()
+
+	if err != nil {
+		return err
+	}
+
+	defer geo_source.Close()
+
+	record, err := geo_source.Lookup(addr)
+
+	if err != nil {
+		return fmt.Errorf("Cannot lookup %s in GeoIP database: %v", addr, err)
+	}
+
+	fmt.Printf("Address:             %s\n", addr)
+	fmt.Printf("GeoIP database:      %s %s\n", strings.Join(get_configured_geo_source_paths(), ","), geo_source.DatabaseType())
+
+	override_source, has_overrides := geo_source.(*geo.OverrideSource)
+
+	source_without_overrides := geo_source
+
+	if has_overrides {
+		source_without_overrides = override_source.Source()
+	}
+
+	// We show what every source says when we merge them
+	if merged_source, ok := source_without_overrides.(*geo.MergedSource); ok {
+		fmt.Printf("Merge strategy:      %s\n", merged_source.Strategy())
+
+		for index, source := range merged_source.Sources() {
+			source_record, err := source.Lookup(addr)
+
+			if err != nil {
+				return fmt.Errorf("Cannot lookup %s in geo source %s: %v", addr, merged_source.Names()[index], err)
+			}
+
+			if source_record == nil {
+				fmt.Printf("Source %-12s not found\n", merged_source.Names()[index]+":")
+				continue
+			}
+
+			fmt.Printf("Source %-12s %s %s\n", merged_source.Names()[index]+":", source_record.Network, format_country(source_record.Country, source_record.CountryName))
+		}
+	}
+
+	if record == nil {
+		fmt.Printf("GeoIP network:       not found\n")
+		return nil
+	}
+
+	fmt.Printf("GeoIP network:       %s\n", record.Network)
+	fmt.Printf("Country:             %s\n", format_country(record.Country, record.CountryName))
+
+	for _, subdivision := range record.Subdivisions {
+		fmt.Printf("Subdivision:         %s\n", format_country(record.Country+"-"+subdivision.Code, subdivision.Name))
+	}
+
+	if record.RegisteredCountry != "" {
+		fmt.Printf("Registered country:  %s\n", format_country(record.RegisteredCountry, ""))
+	}
+
+	if !has_overrides {
+		return nil
+	}
+
+	override := override_source.FindOverride(addr)
+
+	if override == nil {
+		return nil
+	}
+
+	source_record, err := override_source.Source().Lookup(addr)
+
+	if err != nil {
+		return fmt.Errorf("Cannot lookup %s in GeoIP database: %v", addr, err)
+	}
+
+	source_country := "not in database"
+
+	if source_record != nil {
+		source_country = fmt.Sprintf("%s in %s", format_country(source_record.Country, source_record.CountryName), source_record.Network)
+	}
+
+	fmt.Printf("GeoIP override:      %s sets %s instead of %s%s\n", override.Prefix, override.Country, source_country, format_geoip_override_comment(*override))
+
+	return nil
+}
+
+func format_geoip_override_comment(override geo.Override) string {
+	if override.Comment == "" {
+		return ""
+	}
+
+	return fmt.Sprintf(" (%s)", override.Comment)
+}
+
+// Prints autonomous system for address from ASN database
+func print_asn_record(addr netip.Addr) error {
+	record, network, err := lookup_asn(addr)
+
+	if err != nil {
+		return err
+	}
+
+	if record == nil {
+		fmt.Printf("ASN:                 not found\n")
+		return nil
+	}
+
+	fmt.Printf("ASN:                 AS%d %s (%s)\n", record.AutonomousSystemNumber, record.AutonomousSystemOrganization, network)
+
+	return nil
+}
+
+func format_country(iso_code string, name string) string {
+	if iso_code == "" {
+		return "-"
+	}
+
+	if name == "" {
+		return iso_code
+	}
+
+	return fmt.Sprintf("%s (%s)", iso_code, name)
+}
+
+// Prints entries from configuration of profile and overrides which match address
+func print_matching_list_entries(addr netip.Addr, profile BlockingProfile) error {
+	all_overrides, err := load_overrides()
+
+	if err != nil {
+		return err
+	}
+
+	overrides := get_profile_overrides(all_overrides, profile.Name)
+
+	for _, prefix := range get_ip_allow_list(profile) {
+		if prefix.Contains(addr) {
+			fmt.Printf("Allow list:          exempted by %s from configuration\n", prefix)
+		}
+	}
+
+	if len(profile.ASNBlockList) > 0 || len(profile.ASNAllowList) > 0 {
+		record, _, err := lookup_asn(addr)
+
+		if err != nil {
+			return err
+		}
+
+		if record != nil && slices.Contains(profile.ASNAllowList, record.AutonomousSystemNumber) {
+			fmt.Printf("Allow list:          exempted by AS%d from asn_allow_list\n", record.AutonomousSystemNumber)
+		}
+
+		if record != nil && slices.Contains(profile.ASNBlockList, record.AutonomousSystemNumber) {
+			fmt.Printf("ASN block list:      blocked by AS%d from asn_block_list\n", record.AutonomousSystemNumber)
+		}
+	}
+
+	for _, entry := range overrides.Allow {
+		prefix, err := netip.ParsePrefix(entry.Prefix)
+
+		if err == nil && prefix.Contains(addr) {
+			fmt.Printf("Allow list:          exempted by %s from API overrides%s\n", entry.Prefix, format_override_comment(entry))
+		}
+	}
+
+	allow_entries_by_feed, err := load_allow_feeds(profile.AllowFeeds)
+
+	if err != nil {
+		return err
+	}
+
+	for _, feed := range profile.AllowFeeds {
+		for _, entry := range allow_entries_by_feed[feed.Name] {
+			if entry.Prefix.Contains(addr) {
+				fmt.Printf("Allow list:          exempted by %s from allow feed %s%s\n", entry.Prefix, feed.Name, format_allow_feed_entry(entry))
+			}
+		}
+	}
+
+	entries_by_feed, err := load_block_feeds(profile.BlockFeeds)
+
+	if err != nil {
+		return err
+	}
+
+	for _, feed := range profile.BlockFeeds {
+		for _, entry := range entries_by_feed[feed.Name] {
+			if entry.Prefix.Contains(addr) {
+				fmt.Printf("Block feed:          blocked by %s from %s%s\n", entry.Prefix, feed.Name, format_feed_comment(entry))
+			}
+		}
+	}
+
+	for _, entry := range overrides.Block {
+		if entry.Prefix == "" {
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(entry.Prefix)
+
+		if err == nil && prefix.Contains(addr) {
+			fmt.Printf("Block overrides:     blocked by %s from API overrides%s\n", entry.Prefix, format_override_comment(entry))
+		}
+	}
+
+	return nil
+}
+
+func format_allow_feed_entry(entry AllowFeedEntry) string {
+	details := []string{}
+
+	for _, value := range []string{entry.Service, entry.Region} {
+		if value != "" {
+			details = append(details, value)
+		}
+	}
+
+	if len(details) == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf(" (%s)", strings.Join(details, ", "))
+}
+
+func format_feed_comment(entry BlockFeedEntry) string {
+	if entry.Comment == "" {
+		return ""
+	}
+
+	return fmt.Sprintf(" (%s)", entry.Comment)
+}
+
+func format_override_comment(entry OverrideEntry) string {
+	if entry.Comment == "" {
+		return ""
+	}
+
+	return fmt.Sprintf(" (%s)", entry.Comment)
+}
+
+// Prints routes of profile from gobgpd which cover address
+func print_rib_entries(ctx context.Context, profile BlockingProfile, target GoBGPTarget, addr netip.Addr) error {
+	conn, err := connect_to_target(target)
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	gobgp_client := apipb.NewGobgpApiClient(conn)
+
+	l3vpn_attributes, err := get_configured_l3vpn()
+
+	if err != nil {
+		return err
+	}
+
+	stream, err := gobgp_client.ListPath(ctx, build_lookup_list_path_request(l3vpn_attributes, addr))
+
+	if err != nil {
+		return fmt.Errorf("Cannot list path: %w", err)
+	}
+
+	routes_found := 0
+
+	for {
+		r, err := stream.Recv()
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Cannot list path: %w", err)
+		}
+
+		prefix_as_string := r.Destination.Prefix
+
+		if l3vpn_attributes != nil {
+			vpn_prefix, ok := announcer.VPNPrefix(r.Destination, l3vpn_attributes.RouteDistinguisher)
+
+			if !ok {
+				continue
+			}
+
+			prefix_as_string = vpn_prefix
+		}
+
+		prefix, err := netip.ParsePrefix(prefix_as_string)
+
+		if err != nil || !prefix.Contains(addr) {
+			continue
+		}
+
+		// Same prefix may be announced by other profiles
+		for _, path := range announcer.OwnedPaths(r.Destination, get_profile_marker(profile)) {
+			routes_found++
+
+			fmt.Printf("RIB of %s: %s %s\n", target.Name, prefix, strings.Join(format_path_attributes(path.Pattrs), " "))
+		}
+	}
+
+	if routes_found == 0 {
+		fmt.Printf("RIB of %s: no routes for %s\n", target.Name, addr)
+	}
+
+	return nil
+}
+
+// Returns request for routes which may cover address, we check that they really cover it after decoding
+func build_lookup_list_path_request(l3vpn_attributes *announcer.L3VPN, addr netip.Addr) *apipb.ListPathRequest {
+	list_path_request := announcer.ListPathRequest(l3vpn_attributes, announcer.AFI(addr))
+
+	// VPN destinations in gobgpd start with route distinguisher and plain prefix does not match them
+	// We read whole VPN table instead, fake gobgp in tests ignores lookup prefixes and cannot catch it
+	if l3vpn_attributes != nil {
+		return list_path_request
+	}
+
+	// gobgpd returns only prefixes which cover address and we do not need to read whole RIB
+	list_path_request.Prefixes = []*apipb.TableLookupPrefix{{
+		Prefix: netip.PrefixFrom(addr, addr.BitLen()).String(),
+		Type:   apipb.TableLookupPrefix_SHORTER,
+	}}
+
+	return list_path_request
+}
+
+// Converts BGP attributes into human readable form
+func format_path_attributes(pattrs []*apb.Any) []string {
+	formatted_attributes := []string{}
+
+	for _, attr := range pattrs {
+		message, err := attr.UnmarshalNew()
+
+		if err != nil {
+			formatted_attributes = append(formatted_attributes, attr.TypeUrl)
+			continue
+		}
+
+		switch value := message.(type) {
+		case *apipb.OriginAttribute:
+			formatted_attributes = append(formatted_attributes, fmt.Sprintf("origin: %d", value.Origin))
+		case *apipb.NextHopAttribute:
+			formatted_attributes = append(formatted_attributes, fmt.Sprintf("next hop: %s", value.NextHop))
+		case *apipb.MpReachNLRIAttribute:
+			formatted_attributes = append(formatted_attributes, fmt.Sprintf("next hop: %s", strings.Join(value.NextHops, ",")))
+		case *apipb.CommunitiesAttribute:
+			communities := []string{}
+
+			for _, community := range value.Communities {
+				b := make([]byte, 4)
+				binary.BigEndian.PutUint32(b, community)
+
+				communities = append(communities, fmt.Sprintf("%d:%d", binary.BigEndian.Uint16(b[0:]), binary.BigEndian.Uint16(b[2:])))
+			}
+
+			formatted_attributes = append(formatted_attributes, fmt.Sprintf("communities: %s", strings.Join(communities, ",")))
+		case *apipb.ExtendedCommunitiesAttribute:
+			extended_communities := []string{}
+
+			for _, extended_community := range value.Communities {
+				extended_communities = append(extended_communities, format_extended_community(extended_community))
+			}
+
+			formatted_attributes = append(formatted_attributes, fmt.Sprintf("extended communities: %s", strings.Join(extended_communities, ",")))
+		default:
+			formatted_attributes = append(formatted_attributes, fmt.Sprintf("%s: %v", message.ProtoReflect().Descriptor().Name(), message))
+		}
+	}
+
+	return formatted_attributes
+}
+
+// Formats route targets in same way as we have them in configuration
+func format_extended_community(extended_community *apb.Any) string {
+	message, err := extended_community.UnmarshalNew()
+
+	if err != nil {
+		return extended_community.TypeUrl
+	}
+
+	switch value := message.(type) {
+	case *apipb.TwoOctetAsSpecificExtended:
+		return fmt.Sprintf("rt:%d:%d", value.Asn, value.LocalAdmin)
+	case *apipb.FourOctetAsSpecificExtended:
+		return fmt.Sprintf("rt:%d:%d", value.Asn, value.LocalAdmin)
+	case *apipb.IPv4AddressSpecificExtended:
+		return fmt.Sprintf("rt:%s:%d", value.Address, value.LocalAdmin)
+	}
+
+	return fmt.Sprintf("%v", message)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestLookupListPathRequest(t *testing.T) {
+	addr := netip.MustParseAddr("10.0.0.1")
+
+	list_path_request := build_lookup_list_path_request(nil, addr)
+
+	if len(list_path_request.Prefixes) != 1 || list_path_request.Prefixes[0].Prefix != "10.0.0.1/32" {
+		t.Errorf("Global table lookup must ask gobgpd only for covering prefixes: %v", list_path_request.Prefixes)
+	}
+
+	l3vpn_attributes, err := parse_l3vpn_attributes(L3VPNConfiguration{Enabled: true, RouteDistinguisher: "65000:100"})
+
+	if err != nil {
+		t.Fatalf("Cannot parse L3VPN attributes: %v", err)
+	}
+
+	// Plain prefix does not match VPN destinations with route distinguisher in real gobgpd
+	list_path_request = build_lookup_list_path_request(l3vpn_attributes, addr)
+
+	if len(list_path_request.Prefixes) != 0 {
+		t.Errorf("VPN table lookup must not filter by plain prefix: %v", list_path_request.Prefixes)
+	}
+}
@@ -2,26 +2,22 @@ package main
 
 import (
 	"context"
-	"encoding/binary"
+	"crypto/sha256"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/netip"
-	"strconv"
+	"os"
+	"os/signal"
+	"slices"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
-
-	apb "google.golang.org/protobuf/types/known/anypb"
-
-	apipb "github.com/osrg/gobgp/v3/api"
-
-	"github.com/oschwald/geoip2-golang"
-	"github.com/oschwald/maxminddb-golang"
-	"go4.org/netipx"
+	"bitbucket.org/fastnetmon/country_lockdown/geo"
+	"bitbucket.org/fastnetmon/country_lockdown/lockdown"
 )
 
 type CountryLockdownConfiguration struct {
@@ -31,436 +27,761 @@ type CountryLockdownConfiguration struct {
 	IPAllowList        []string `json:"ip_allow_list"`
 	BGPIPv4NextHop     string   `json:"bgp_ipv4_next_hop"`
 	BGPIPv6Communities []string `json:"bgp_ipv4_communities"`
+
+	// Independent policies with own lists, attributes and targets, we use lists from top level when it's empty
+	Profiles []BlockingProfile `json:"profiles"`
+
+	// Skip countries which we cannot load with error in log instead of failing sync
+	AllowPartialBlockList bool `json:"allow_partial_block_list"`
+
+	// Countries which we block only during specific windows or until some time
+	ScheduledCountryBlocks []ScheduledCountryBlock `json:"scheduled_country_blocks"`
+
+	// Alternative databases with geolocation, we use MaxMind database from geoip_path by default
+	GeoSource GeoSourceConfiguration `json:"geo_source"`
+
+	// Multiple sources instead of geo_source, merge strategy is union, intersection or primary-with-fallback
+	GeoSources      []GeoSourceConfiguration `json:"geo_sources"`
+	GeoSourcesMerge string                   `json:"geo_sources_merge"`
+
+	// Only for GeoIP2-Enterprise: we ignore countries and subdivisions with lower confidence, from 0 to 100
+	GeoIPMinConfidence uint `json:"geoip_min_confidence"`
+
+	// Reputation lists which we block in addition to countries
+	BlockFeeds []BlockFeedConfiguration `json:"block_feeds"`
+
+	// Published ranges of cloud providers and crawlers which we never block
+	AllowFeeds []AllowFeedConfiguration `json:"allow_feeds"`
+
+	// JSON file with local fixes for networks which geo source places in wrong country
+	GeoIPOverridesPath string `json:"geoip_overrides_path"`
+
+	// GeoLite2-ASN or GeoIP2-ISP database, we need it only for ASN lists
+	ASNPath string `json:"asn_path"`
+
+	// We block networks of these ASNs in addition to countries
+	ASNBlockList []uint `json:"asn_block_list"`
+
+	// And exempt networks of these ASNs from any blocks, e.g. CDNs inside blocked countries
+	ASNAllowList []uint `json:"asn_allow_list"`
+
+	// Built-in replacement for geoipupdate
+	GeoIPUpdate GeoIPUpdateConfiguration `json:"geoip_update"`
+
+	// Where we keep BGP sessions: "external" for standalone gobgpd or "embedded" to run gobgp in our process
+	GoBGPMode   string                   `json:"gobgp_mode"`
+	EmbeddedBGP EmbeddedBGPConfiguration `json:"embedded_bgp"`
+
+	// TLS settings, deadline in seconds for every call and number of retries when gobgpd is unavailable
+	GoBGPApiTLS     GoBGPTLSConfiguration `json:"gobgp_api_tls"`
+	GoBGPApiTimeout uint                  `json:"gobgp_api_timeout"`
+	GoBGPApiRetries *uint                 `json:"gobgp_api_retries"`
+
+	BGPHealthCheck BGPHealthCheckConfiguration `json:"bgp_health_check"`
+
+	L3VPN L3VPNConfiguration `json:"l3vpn"`
+
+	// Multiple gobgpd instances which must carry same block list, we use gobgp_api_host when it's empty
+	GoBGPTargets []GoBGPTarget `json:"gobgp_targets"`
+
+	// What to do when some of targets failed: "fail" or "degraded"
+	TargetFailurePolicy string `json:"target_failure_policy"`
+
+	// How often we recalculate block list in daemon mode, seconds
+	SyncInterval uint `json:"sync_interval"`
+
+	// Withdraw all our routes when daemon stops on signal, block exists only while daemon is running
+	WithdrawOnShutdown bool `json:"withdraw_on_shutdown"`
+
+	// Address for Prometheus /metrics endpoint in daemon mode, disabled when empty
+	MetricsListenAddress string `json:"metrics_listen_address"`
+
+	// Output format for logs: text or json
+	LogFormat string `json:"log_format"`
+
+	// debug, info, warn or error. Full lists of prefixes are logged only on debug level
+	LogLevel string `json:"log_level"`
+
+	// Address for management API in daemon mode, disabled when empty. We listen on 127.0.0.1 when host is not set
+	ApiListenAddress string `json:"api_listen_address"`
+
+	// Clients must pass it as bearer token when it's set
+	ApiToken string `json:"api_token"`
+
+	// We keep history of applied block lists here
+	StateDir        string `json:"state_dir"`
+	SnapshotsToKeep uint   `json:"snapshots_to_keep"`
 }
 
 var conf CountryLockdownConfiguration
 
-func main() {
-	conf_file_path := "/etc/country_lockdown.json"
+// SHA256 of configuration file, we keep it in snapshots
+var conf_file_hash string
 
-	file_as_array, err := ioutil.ReadFile(conf_file_path)
+func main() {
+	conf_file_path := flag.String("config", "/etc/country_lockdown.json", "path to configuration file")
+	log_level := flag.String("log-level", "", "overrides log_level from configuration file")
 
-	if err != nil {
-		log.Fatalf("Could not read configuration file %s with error: %v", conf_file_path, err)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] [sync|daemon|withdraw-all|snapshots|rollback [--profile NAME] [--to N]|lookup <ip>|stats [--format table|json]|update-geoip|db-diff [--format table|json] [--countries CN,RU] old.mmdb new.mmdb|geo-conflicts [--format table|json] [--countries CN,RU]]\n", os.Args[0])
+		flag.PrintDefaults()
 	}
 
-	err = json.Unmarshal(file_as_array, &conf)
+	flag.Parse()
 
-	if err != nil {
-		log.Fatalf("Could not decode JSON configuration file %s: %v", conf_file_path, err)
-	}
+	err := load_configuration(*conf_file_path)
 
-	// Unless specified in config use default value
-	if conf.GeoIPPath == "" {
-		conf.GeoIPPath = "/usr/share/GeoIP/GeoIP2-Country.mmdb"
+	if err != nil {
+		fatal("Cannot load configuration", "error", err)
 	}
 
-	// Unless specified in config use default value
-	if conf.GoBGPApiAddress == "" {
-		conf.GoBGPApiAddress = "[::1]:50051"
+	if *log_level != "" {
+		conf.LogLevel = *log_level
 	}
 
-	// GeoIP for countries
-	geoip_country_maxmind_db, err := maxminddb.Open(conf.GeoIPPath)
+	err = setup_logging(conf.LogFormat, conf.LogLevel)
 
 	if err != nil {
-		log.Fatalf("Can't open country mapping file: %v", err)
+		fatal("Cannot configure logging", "error", err)
 	}
 
-	defer geoip_country_maxmind_db.Close()
+	command := flag.Arg(0)
 
-	log.Printf("Loaded GeoIP file: %+v", geoip_country_maxmind_db.Metadata)
+	switch command {
+	case "", "sync":
+		if conf.GoBGPMode == "embedded" {
+			fatal("Embedded BGP speaker keeps routes only while we're running, please use daemon mode")
+		}
 
-	// We need to be sure that database has correct type
-	if geoip_country_maxmind_db.Metadata.DatabaseType != "GeoIP2-Country" && geoip_country_maxmind_db.Metadata.DatabaseType != "GeoLite2-Country"{
-		log.Fatalf("Wrong type of GeoIP database %s, please GeoIP2-Country or GeoLite2-Country type", geoip_country_maxmind_db.Metadata.DatabaseType)
-	}
+		err = run_sync(context.Background())
 
-	log.Printf("GeoIP database has correct format")
+		if err != nil {
+			fatal("Sync failed", "error", err)
+		}
 
-	if conf.BGPIPv4NextHop == "" {
-		log.Fatal("BGP IPv4 next hop is empty")
-	}
+		slog.Info("Success")
+	case "daemon":
+		err = run_daemon()
 
-	next_hop, err := netip.ParseAddr(conf.BGPIPv4NextHop)
+		if err != nil {
+			fatal("Daemon failed", "error", err)
+		}
+	case "withdraw-all":
+		if conf.GoBGPMode == "embedded" {
+			fatal("Embedded BGP speaker withdraws all routes when daemon stops, please stop daemon")
+		}
 
-	if err != nil {
-		log.Fatalf("Cannot parse BGP IPv4 next hop %s: %v", conf.BGPIPv4NextHop, err)
-	}
+		err = run_withdraw_all(context.Background(), "withdraw-all")
 
-	if !next_hop.Is4() {
-		log.Printf("Next hop must be IPv4 address")
-	}
+		if err != nil {
+			fatal("Withdrawal failed", "error", err)
+		}
 
-	log.Printf("Will use next hop: %s", next_hop)
+		slog.Info("Success")
+	case "snapshots":
+		err = print_snapshots()
 
-	// https://pkg.go.dev/go4.org/netipx#IPSetBuilder
-	// https://tailscale.com/blog/netaddr-new-ip-type-for-go/
-	var b netipx.IPSetBuilder
+		if err != nil {
+			fatal("Cannot list snapshots", "error", err)
+		}
+	case "lookup":
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
 
-	log.Printf("We have %d countries in country block list", len(conf.CountryBlockList))
+		err = run_lookup(context.Background(), flag.Arg(1))
 
-	for _, country_code := range conf.CountryBlockList {
-		log.Printf("Loading prefixes for country code: %s", country_code)
+		if err != nil {
+			fatal("Lookup failed", "error", err)
+		}
+	case "update-geoip":
+		updated, err := update_geoip_database(context.Background(), conf.GeoIPUpdate, get_geoip_update_path())
 
-		country_prefix_list, err := load_all_ipv4_networks_for_country(geoip_country_maxmind_db, country_code)
+		if err != nil {
+			fatal("Cannot update GeoIP database", "error", err)
+		}
+
+		if updated {
+			slog.Info("Please run sync to apply new database")
+		}
+	case "db-diff":
+		db_diff_flags := flag.NewFlagSet("db-diff", flag.ExitOnError)
+		db_diff_format := db_diff_flags.String("format", "table", "output format: table or json")
+		db_diff_countries := db_diff_flags.String("countries", "", "comma separated countries, all countries from configuration by default")
+		db_diff_flags.Parse(flag.Args()[1:])
+
+		if db_diff_flags.NArg() != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+
+		countries := []string{}
+
+		if *db_diff_countries != "" {
+			countries = strings.Split(strings.ToUpper(*db_diff_countries), ",")
+		}
+
+		err = run_db_diff(db_diff_flags.Arg(0), db_diff_flags.Arg(1), countries, *db_diff_format)
 
 		if err != nil {
-			log.Printf("Cannot load prefixes for country: %v", err)
-			continue
+			fatal("Cannot compare GeoIP databases", "error", err)
 		}
+	case "stats":
+		stats_flags := flag.NewFlagSet("stats", flag.ExitOnError)
+		stats_format := stats_flags.String("format", "table", "output format: table or json")
+		stats_flags.Parse(flag.Args()[1:])
 
-		log.Printf("Successfully loaded %d prefixes which belong to this country", len(country_prefix_list))
+		err = run_stats(context.Background(), *stats_format)
 
-		log.Printf("Country prefixes: %v", country_prefix_list)
+		if err != nil {
+			fatal("Cannot calculate block list", "error", err)
+		}
+	case "geo-conflicts":
+		conflicts_flags := flag.NewFlagSet("geo-conflicts", flag.ExitOnError)
+		conflicts_format := conflicts_flags.String("format", "table", "output format: table or json")
+		conflicts_countries := conflicts_flags.String("countries", "", "comma separated countries, all countries from configuration by default")
+		conflicts_flags.Parse(flag.Args()[1:])
+
+		countries := []string{}
+
+		if *conflicts_countries != "" {
+			countries = strings.Split(strings.ToUpper(*conflicts_countries), ",")
+		}
+
+		err = run_geo_sources_conflicts(countries, *conflicts_format)
+
+		if err != nil {
+			fatal("Cannot compare geo sources", "error", err)
+		}
+	case "rollback":
+		rollback_flags := flag.NewFlagSet("rollback", flag.ExitOnError)
+		rollback_to := rollback_flags.Int("to", 0, "snapshot version to apply, previous snapshot by default")
+		rollback_profile := rollback_flags.String("profile", "", "profile to roll back, required when we have multiple profiles")
+		rollback_flags.Parse(flag.Args()[1:])
+
+		if conf.GoBGPMode == "embedded" {
+			fatal("Embedded BGP speaker keeps routes only while we're running, rollback can be applied only to external gobgpd")
+		}
 
-		for _, prefix := range country_prefix_list {
-			b.AddPrefix(prefix)
+		err = run_rollback(context.Background(), *rollback_profile, *rollback_to)
+
+		if err != nil {
+			fatal("Rollback failed", "error", err)
 		}
 
+		slog.Info("Success")
+	default:
+		flag.Usage()
+		os.Exit(2)
 	}
+}
 
-	log.Printf("We have %d entries in allow list", len(conf.IPAllowList))
+// Reads configuration from file and populates defaults
+func load_configuration(conf_file_path string) error {
+	file_as_array, err := os.ReadFile(conf_file_path)
 
-	log.Printf("Allow list: %v", conf.IPAllowList)
+	if err != nil {
+		return fmt.Errorf("Could not read configuration file %s with error: %v", conf_file_path, err)
+	}
 
-	log.Printf("We have %d communities in configuration", len(conf.BGPIPv6Communities))
+	conf_file_hash = fmt.Sprintf("%x", sha256.Sum256(file_as_array))
 
-	// Exclude:
-	for _, allow_ip := range conf.IPAllowList {
-		addr, err := netip.ParseAddr(allow_ip)
+	err = json.Unmarshal(file_as_array, &conf)
+
+	if err != nil {
+		return fmt.Errorf("Could not decode JSON configuration file %s: %v", conf_file_path, err)
+	}
+
+	// Unless specified in config use default value
+	if conf.GeoIPPath == "" {
+		conf.GeoIPPath = "/usr/share/GeoIP/GeoIP2-Country.mmdb"
+	}
+
+	// Unless specified in config use default value
+	if conf.GoBGPApiAddress == "" {
+		conf.GoBGPApiAddress = "[::1]:50051"
+	}
+
+	if conf.GoBGPMode == "" {
+		conf.GoBGPMode = "external"
+	}
+
+	if conf.GoBGPMode != "external" && conf.GoBGPMode != "embedded" {
+		return fmt.Errorf("Unknown gobgp_mode %s, please use external or embedded", conf.GoBGPMode)
+	}
+
+	// Embedded speaker exposes gRPC API without TLS and we cannot connect to it with TLS
+	if conf.GoBGPMode == "embedded" && conf.GoBGPApiTLS.Enabled {
+		return fmt.Errorf("Embedded BGP speaker does not support gobgp_api_tls, please disable it or use external gobgpd")
+	}
+
+	if conf.L3VPN.Enabled {
+		_, err := parse_l3vpn_attributes(conf.L3VPN)
 
 		if err != nil {
-			log.Printf("Cannot parse IP address %s", allow_ip)
-			continue
+			return err
 		}
+	}
 
-		// Exclude it from our ranges
-		b.Remove(addr)
+	err = validate_geo_sources()
+
+	if err != nil {
+		return err
 	}
 
-	s, _ := b.IPSet()
+	err = validate_blocking_profiles()
 
-	//fmt.Println(s.Ranges())
+	if err != nil {
+		return err
+	}
 
-	prefixes_to_block := s.Prefixes()
+	err = validate_block_list_entries()
 
-	log.Printf("%d prefixes to block", len(s.Prefixes()))
+	if err != nil {
+		return err
+	}
+
+	if conf.GeoIPOverridesPath != "" {
+		_, err = geo.LoadOverrides(conf.GeoIPOverridesPath)
 
-	log.Printf("Prefixes to block %v", prefixes_to_block)
+		if err != nil {
+			return err
+		}
+	}
 
-	var opts []grpc.DialOption
+	if conf.GeoIPUpdate.EditionID == "" {
+		conf.GeoIPUpdate.EditionID = "GeoIP2-Country"
+	}
 
-	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if conf.GeoIPUpdate.BaseURL == "" {
+		conf.GeoIPUpdate.BaseURL = "https://updates.maxmind.com"
+	}
 
-	conn, err := grpc.Dial(conf.GoBGPApiAddress, opts...)
+	if conf.GeoIPUpdate.Interval == 0 {
+		conf.GeoIPUpdate.Interval = 86400
+	}
+
+	err = validate_scheduled_blocks(conf.ScheduledCountryBlocks)
 
 	if err != nil {
-		log.Fatalf("Cannot connect to gRPC: %v", err)
+		return err
 	}
 
-	defer conn.Close()
+	if conf.TargetFailurePolicy == "" {
+		conf.TargetFailurePolicy = "fail"
+	}
 
-	log.Printf("Successfully connected to GoBGP")
+	if conf.TargetFailurePolicy != "fail" && conf.TargetFailurePolicy != "degraded" {
+		return fmt.Errorf("Unknown target_failure_policy %s, please use fail or degraded", conf.TargetFailurePolicy)
+	}
 
-	gobgp_client := apipb.NewGobgpApiClient(conn)
+	if conf.GoBGPApiTimeout == 0 {
+		conf.GoBGPApiTimeout = 60
+	}
 
-	log.Printf("Load all active announces")
-	active_announces, err := get_all_announced_prefixes(gobgp_client)
+	// We need pointer here to distinguish explicitly disabled retries from missing field
+	if conf.GoBGPApiRetries == nil {
+		default_retries := uint(3)
+		conf.GoBGPApiRetries = &default_retries
+	}
 
-	if err != nil {
-		log.Fatalf("Cannot load announces: %s", err)
+	if conf.SyncInterval == 0 {
+		conf.SyncInterval = 3600
 	}
 
-	log.Printf("Active announces: %s", active_announces)
+	if conf.StateDir == "" {
+		conf.StateDir = "/var/lib/country_lockdown"
+	}
 
-	prefixes_to_block_map := make(map[string]bool)
+	if conf.SnapshotsToKeep == 0 {
+		conf.SnapshotsToKeep = 50
+	}
 
-	for _, prefix := range prefixes_to_block {
-		prefixes_to_block_map[prefix.String()] = true
+	if conf.LogFormat == "" {
+		conf.LogFormat = "text"
 	}
 
-	// Find announces we have to withdraw
-	for _, active_prefix := range active_announces {
-		_, ok := prefixes_to_block_map[active_prefix]
+	if conf.LogLevel == "" {
+		conf.LogLevel = "info"
+	}
 
-		if ok {
-			continue
+	return nil
+}
+
+// Keeps running and recalculates block list periodically
+func run_daemon() error {
+	if conf.GoBGPMode == "embedded" {
+		bgp_server, err := start_embedded_bgp_server(conf.EmbeddedBGP, conf.GoBGPApiAddress)
+
+		if err != nil {
+			return fmt.Errorf("Cannot start embedded BGP speaker: %w", err)
 		}
 
-		// This prefix is not in block list and we have to withdraw it
+		// Stop will close all BGP sessions and our announces will be withdrawn by peers
+		defer bgp_server.Stop()
+	}
 
-		log.Printf("We have to withdraw prefix %s", active_prefix)
+	if conf.MetricsListenAddress != "" {
+		err := start_metrics_server(conf.MetricsListenAddress)
 
-		withdraw_prefix, err := netip.ParsePrefix(active_prefix)
+		if err != nil {
+			return err
+		}
+	}
+
+	if conf.ApiListenAddress != "" {
+		err := start_api_server(conf.ApiListenAddress)
 
 		if err != nil {
-			log.Printf("Cannot parse %s as prefix with error %v", active_prefix, err)
-			// Well, we accept some malformed prefixes and do not return error in this case
-			continue
+			return err
 		}
+	}
 
-		// Withdraw
-		withdraw := true
+	// It will cancel all active calls to gobgpd when we're asked to stop
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-		err = announce_prefix(gobgp_client, withdraw_prefix, next_hop, withdraw)
+	if conf.GeoIPUpdate.Enabled {
+		// We start with old database when update server is not available
+		_, err := update_geoip_database(ctx, conf.GeoIPUpdate, get_geoip_update_path())
 
 		if err != nil {
-			log.Printf("Cannot withdraw prefix %s: %v", withdraw_prefix, err)
-			continue
+			slog.Error("Cannot update GeoIP database", "error", err)
 		}
 
+		go run_geoip_updater(ctx)
 	}
 
-	log.Printf("Finished withdrawal process")
+	// Set when sync was requested via API or updater and someone waits for result
+	var sync_reply chan error
 
-	// Create lookup map for active announces
-	active_announces_map := make(map[string]bool)
+	ticker := time.NewTicker(time.Duration(conf.SyncInterval) * time.Second)
+	defer ticker.Stop()
 
-	for _, prefix := range active_announces {
-		active_announces_map[prefix] = true
-	}
+	slog.Info("Started in daemon mode", "sync_interval", conf.SyncInterval)
+
+	for {
+		err := run_sync(ctx)
+
+		if err != nil {
+			// We will try again on next iteration
+			slog.Error("Sync failed", "error", err)
+		} else {
+			slog.Info("Success")
+		}
 
-	// Prefixes to announce
-	prefixes_to_announce := []netip.Prefix{}
+		if sync_reply != nil {
+			sync_reply <- err
+			sync_reply = nil
+		}
 
-	// Skipped prefixes, we use it for fancy logging
-	skipped_prefixes := []string{}
+		// We need to recalculate block list when scheduled blocks or overrides change state
+		var schedule_timer <-chan time.Time
 
-	// Filter out already active announces
-	for _, prefix := range prefixes_to_block {
-		// Do not announce already active active announces
-		_, ok := active_announces_map[prefix.String()]
+		next_schedule_change := get_next_schedule_change(time.Now())
 
-		if ok {
-			skipped_prefixes = append(skipped_prefixes, prefix.String())
-			continue
+		if !next_schedule_change.IsZero() {
+			slog.Debug("Next change of scheduled blocks", "at", next_schedule_change)
+			schedule_timer = time.After(time.Until(next_schedule_change))
 		}
 
-		prefixes_to_announce = append(prefixes_to_announce, prefix)
+		select {
+		case <-ticker.C:
+		case <-schedule_timer:
+			slog.Info("Scheduled blocks changed state")
+		case sync_reply = <-sync_requests:
+			slog.Info("Sync requested")
+		case <-ctx.Done():
+			slog.Info("Received signal, shutting down")
+
+			if conf.WithdrawOnShutdown {
+				// Context of daemon is already cancelled and calls to gobgpd still have own deadlines
+				err := run_withdraw_all(context.Background(), "shutdown")
+
+				if err != nil {
+					return fmt.Errorf("Cannot withdraw routes on shutdown: %w", err)
+				}
+			}
+
+			return nil
+		}
 	}
+}
 
-	log.Printf("Skipped following prefixes as already active %v", skipped_prefixes)
+// Outcome of sync for single profile
+type ProfileSyncResult struct {
+	Profile   string
+	BlockList *lockdown.Result
+	Results   []TargetSyncResult
+	Err       error
+}
 
-	log.Printf("Prepare to announce prefixes %v", prefixes_to_announce)
+// Calculates block lists for all profiles and syncs them with GoBGP
+// Profiles are independent and failure of one of them does not stop others
+func run_sync(ctx context.Context) (err error) {
+	sync_start := time.Now()
 
-	for _, prefix := range prefixes_to_announce {
-		withdraw := false
+	profile_results := []ProfileSyncResult{}
 
-		err = announce_prefix(gobgp_client, prefix, next_hop, withdraw)
+	defer func() {
+		metric_sync_duration.Observe(time.Since(sync_start).Seconds())
+		record_sync_status(sync_start, profile_results, err)
+	}()
 
-		if err != nil {
-			log.Printf("Cannot announce prefix %s: %v", prefix, err)
-			continue
+	failed_profiles := []string{}
+
+	for _, profile := range get_blocking_profiles() {
+		profile_result := sync_profile(ctx, profile)
+
+		if profile_result.Err != nil {
+			slog.Error("Profile sync failed", "profile", profile.Name, "error", profile_result.Err)
+			failed_profiles = append(failed_profiles, profile.Name)
 		}
+
+		profile_results = append(profile_results, profile_result)
 	}
 
-	log.Printf("Success")
-}
+	// Routes of removed profiles or old markers stay in gobgpd forever otherwise
+	orphan_err := withdraw_orphan_markers(ctx, true)
 
-// Announce prefix
-func announce_prefix(gobgp_client apipb.GobgpApiClient, prefix netip.Prefix, next_hop netip.Addr, withdraw bool) error {
+	if orphan_err != nil {
+		slog.Error("Cannot withdraw routes with markers which do not belong to any profile", "error", orphan_err)
+	}
 
-	nlri, err := apb.New(&apipb.IPAddressPrefix{
-		Prefix:    prefix.Addr().String(),
-		PrefixLen: uint32(prefix.Bits()),
-	})
+	if len(failed_profiles) == 1 && len(profile_results) == 1 {
+		return profile_results[0].Err
+	}
 
-	// To check that we announce correct thing
-	if withdraw {
-		log.Printf("Withdraw %s/%d", prefix.Addr().String(), uint32(prefix.Bits()))
-	} else {
-		log.Printf("Announce %s/%d", prefix.Addr().String(), uint32(prefix.Bits()))
+	if len(failed_profiles) > 0 {
+		return fmt.Errorf("Sync failed for profiles %s", strings.Join(failed_profiles, ","))
 	}
 
+	metric_last_successful_sync.SetToCurrentTime()
+
+	return nil
+}
+
+// Calculates block list for profile, syncs it with targets of profile and saves snapshot
+func sync_profile(ctx context.Context, profile BlockingProfile) ProfileSyncResult {
+	profile_result := ProfileSyncResult{Profile: profile.Name}
+
+	block_list, err := compute_block_list(ctx, profile)
+
 	if err != nil {
-		return fmt.Errorf("Cannot create prefix message: %v", err)
+		profile_result.Err = err
+		return profile_result
 	}
 
-	origin_attr, err := apb.New(&apipb.OriginAttribute{
-		Origin: 0,
-	})
+	profile_result.BlockList = block_list
+
+	update_block_list_metrics(profile.Name, block_list)
+
+	profile_result.Results, err = apply_block_list(ctx, profile, block_list.Prefixes)
 
 	if err != nil {
-		return fmt.Errorf("Cannot create origin message: %v", err)
+		profile_result.Err = err
+		return profile_result
 	}
 
-	next_hop_attr, err := apb.New(&apipb.NextHopAttribute{
-		NextHop: next_hop.String(),
-	})
+	version, saved, err := save_snapshot(build_snapshot(profile, block_list, "sync"))
 
 	if err != nil {
-		return fmt.Errorf("Cannot create next hop message: %v", err)
+		profile_result.Err = fmt.Errorf("Block list was applied but we cannot save snapshot: %w", err)
+		return profile_result
 	}
 
-	// Create BGP attributes array
-	attrs := []*apb.Any{origin_attr, next_hop_attr}
+	log_saved_snapshot(profile.Name, version, saved)
 
-	var communities_as_32bit_uints []uint32
+	return profile_result
+}
 
-	for _, bgp_community_as_string := range conf.BGPIPv6Communities {
-		// We expect them in format of two uint16 separated by colon
+// Loads prefixes for all countries of profile from GeoIP database and removes allowed addresses from them
+func compute_block_list(ctx context.Context, profile BlockingProfile) (*lockdown.Result, error) {
+	// GeoIP for countries
+	geo_source, err := open_configured_geo_source()
 
-		splitted_community := strings.Split(bgp_community_as_string, ":")
+	if err != nil {
+		return nil, err
+	}
 
-		if len(splitted_community) != 2 {
-			log.Printf("Cannot parse community %s", bgp_community_as_string)
-			continue
-		}
+	defer geo_source.Close()
 
-		first, err := strconv.ParseUint(splitted_community[0], 10, 16)
+	slog.Info("Loaded GeoIP file",
+		"path", get_configured_geo_source_paths(),
+		"database_type", geo_source.DatabaseType(),
+		"build_epoch", geo_source.BuildEpoch())
 
-		if err != nil {
-			log.Printf("Cannot parse %d as 16 bit integer", splitted_community[0])
-			continue
-		}
+	config := lockdown.Config{
+		GeoSource:    geo_source,
+		AllowPartial: conf.AllowPartialBlockList,
+		ASNs:         make(map[uint][]netip.Prefix),
+		Feeds:        make(map[string][]netip.Prefix),
+	}
 
-		second, err := strconv.ParseUint(splitted_community[1], 10, 16)
+	if conf.GeoIPOverridesPath != "" {
+		config.GeoIPOverrides, err = geo.LoadOverrides(conf.GeoIPOverridesPath)
 
 		if err != nil {
-			log.Printf("Cannot parse %d as 16 bit integer", splitted_community[1])
-			continue
+			return nil, err
 		}
+	}
 
-		// Encode two 2 byte integers into single 4 byte integer
-		b := make([]byte, 4)
+	now := time.Now()
 
-		// Well, I just found out that we need to use them in reverse order during testing
-		binary.LittleEndian.PutUint16(b[0:], uint16(second))
-		binary.LittleEndian.PutUint16(b[2:], uint16(first))
+	// Entries added via management API
+	all_overrides, err := load_active_overrides(now)
 
-		community_as_uint32 := binary.LittleEndian.Uint32(b[:])
+	if err != nil {
+		return nil, err
+	}
 
-		//log.Printf("Community as 32 bit integer: %d", community_as_uint32)
+	overrides := get_profile_overrides(all_overrides, profile.Name)
 
-		communities_as_32bit_uints = append(communities_as_32bit_uints, community_as_uint32)
+	config.Countries = append([]string{}, profile.CountryBlockList...)
+
+	for _, country_code := range get_active_scheduled_countries(now, profile.Name) {
+		if !slices.Contains(config.Countries, country_code) {
+			config.Countries = append(config.Countries, country_code)
+		}
 	}
 
-	if len(communities_as_32bit_uints) > 0 {
+	for _, entry := range overrides.Block {
+		if entry.Country != "" && !slices.Contains(config.Countries, entry.Country) {
+			config.Countries = append(config.Countries, entry.Country)
+		}
+	}
+
+	slog.Info("Loading prefixes for countries", "profile", profile.Name, "countries", len(config.Countries))
+
+	for _, entry := range overrides.Block {
+		if entry.Prefix == "" {
+			continue
+		}
 
-		community_attribute, err := apb.New(&apipb.CommunitiesAttribute{
-			Communities: communities_as_32bit_uints,
-		})
+		prefix, err := netip.ParsePrefix(entry.Prefix)
 
 		if err != nil {
-			return fmt.Errorf("Cannot create community message: %v", err)
+			slog.Warn("Cannot parse prefix from block overrides", "prefix", entry.Prefix, "error", err)
+			continue
 		}
 
-		attrs = append(attrs, community_attribute)
+		config.Extra = append(config.Extra, prefix)
 	}
 
-	add_path_request := &apipb.AddPathRequest{
-		Path: &apipb.Path{
-			Family:     &apipb.Family{Afi: apipb.Family_AFI_IP, Safi: apipb.Family_SAFI_UNICAST},
-			Nlri:       nlri,
-			Pattrs:     attrs,
-			IsWithdraw: withdraw,
-		}}
-
-	_, err = gobgp_client.AddPath(context.Background(), add_path_request)
+	// Networks of ASNs from both ASN lists
+	prefixes_by_asn, err := load_configured_asn_networks(profile.ASNBlockList, profile.ASNAllowList)
 
 	if err != nil {
-		return fmt.Errorf("Cannot announce prefix: %w", err)
+		return nil, err
 	}
 
-	return nil
-}
+	for _, asn := range profile.ASNBlockList {
+		config.ASNs[asn] = prefixes_by_asn[asn]
+	}
 
-// Returns all active announces
-func get_all_announced_prefixes(gobgp_client apipb.GobgpApiClient) ([]string, error) {
+	// Third party reputation lists
+	entries_by_feed, err := load_block_feeds(profile.BlockFeeds)
 
-	ipv4_unicast := &apipb.Family{
-		Afi:  apipb.Family_AFI_IP,
-		Safi: apipb.Family_SAFI_UNICAST,
+	if err != nil {
+		return nil, err
 	}
 
-	list_path_request := &apipb.ListPathRequest{
-		TableType: apipb.TableType_GLOBAL,
-		Family:    ipv4_unicast,
+	for feed_name, entries := range entries_by_feed {
+		config.Feeds[feed_name] = get_block_feed_prefixes(entries)
 	}
 
-	stream, err := gobgp_client.ListPath(context.Background(), list_path_request)
+	allow_entries_by_feed, err := load_allow_feeds(profile.AllowFeeds)
 
 	if err != nil {
-		return nil, fmt.Errorf("Cannot list path: %w", err)
+		return nil, err
 	}
 
-	announces := []string{}
+	slog.Info("Applying allow list", "profile", profile.Name, "entries", len(profile.IPAllowList), "overrides", len(overrides.Allow), "asns", len(profile.ASNAllowList), "feeds", len(profile.AllowFeeds))
 
-	for {
-		r, err := stream.Recv()
+	slog.Debug("Allow list", "profile", profile.Name, "allow_list", profile.IPAllowList)
 
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return nil, fmt.Errorf("Failed with error %v", err)
-		}
+	config.Allow = append(config.Allow, get_ip_allow_list(profile)...)
 
-		// log.Printf("Active announce: %s", r.Destination.Prefix)
+	for _, entry := range overrides.Allow {
+		prefix, err := netip.ParsePrefix(entry.Prefix)
 
-		announces = append(announces, r.Destination.Prefix)
-	}
+		if err != nil {
+			slog.Warn("Cannot parse prefix from allow overrides", "prefix", entry.Prefix, "error", err)
+			continue
+		}
 
-	return announces, nil
-}
+		config.Allow = append(config.Allow, prefix)
+	}
 
-// Loads all networks for country with specific ISO code
-// Luckily for us Hong Kong has HK code here and China has CN
-func load_all_ipv4_networks_for_country(geoip_country_maxmind_db *maxminddb.Reader, country_iso_code string) ([]netip.Prefix, error) {
-	// All fields https://github.com/oschwald/geoip2-golang/blob/main/reader.go#L139
-	record := geoip2.Country{}
+	for _, entries := range allow_entries_by_feed {
+		for _, entry := range entries {
+			config.Allow = append(config.Allow, entry.Prefix)
+		}
+	}
 
-	// We use SkipAliasedNetworks because it's recommended in official documentation:
-	// https://pkg.go.dev/github.com/oschwald/maxminddb-golang#SkipAliasedNetworks
+	// Allowed ASNs punch holes in country blocks
+	for _, asn := range profile.ASNAllowList {
+		config.Allow = append(config.Allow, prefixes_by_asn[asn]...)
+	}
 
-	// Please note that a MaxMind DB may map IPv4 networks into several locations
-	// in an IPv6 database. This iterator will iterate over all of these locations
-	// separately. To only iterate over the IPv4 networks once, use the
-	// SkipAliasedNetworks option.
-	networks := geoip_country_maxmind_db.Networks(maxminddb.SkipAliasedNetworks)
+	result, err := lockdown.Compute(ctx, config)
 
-	prefix_list := []netip.Prefix{}
+	if err != nil {
+		return nil, err
+	}
 
-	for networks.Next() {
-		subnet, err := networks.Network(&record)
+	slog.Info("Calculated block list", "profile", profile.Name, "prefixes", len(result.Prefixes), "addresses", result.Addresses)
 
-		if err != nil {
-			return nil, fmt.Errorf("Cannot decode field in dataset: %v", err)
-		}
+	slog.Debug("Prefixes to block", "profile", profile.Name, "prefix_list", result.Prefixes)
 
-		// Filter out IPv6 networks
-		// Well, it's IPNet and we need to use some fancy custom logic to find out type of it
-		if subnet.IP.To4() == nil {
-			continue
-		}
+	for _, usage := range result.Diagnostics.GeoIPOverrides {
+		slog.Info("GeoIP override used", "profile", profile.Name, "prefix", usage.Override.Prefix, "from_country", usage.FromCountry,
+			"country", usage.Override.Country, "addresses", usage.Addresses)
+	}
 
-		// TODO:
-		// We do not expect private ranges here but we have to be sure
-		// Well, I do not think that we have any functions to do so for prefixes
-		// Skip for now
+	return &result, nil
+}
 
-		// Check that network belongs to country we're interested in
-		if record.Country.IsoCode != country_iso_code {
-			continue
-		}
+// Parses addresses and prefixes from ip_allow_list of profile
+func get_ip_allow_list(profile BlockingProfile) []netip.Prefix {
+	prefixes := []netip.Prefix{}
 
-		// Parse it into fancy netip.Prefix
-		prefix, err := netip.ParsePrefix(subnet.String())
+	for _, allow_entry := range profile.IPAllowList {
+		prefix, err := parse_prefix_or_address(allow_entry)
 
 		if err != nil {
-			log.Printf("Cannot parse %s as prefix with error %v", subnet.String(), err)
-			// Well, we accept some malformed prefixes and do not return error in this case
+			slog.Warn("Cannot parse entry from allow list", "entry", allow_entry, "error", err)
 			continue
 		}
 
-		prefix_list = append(prefix_list, prefix)
+		prefixes = append(prefixes, prefix)
 	}
 
-	if networks.Err() != nil {
-		return nil, fmt.Errorf("Cannot correctly iterate over all available networks %w", networks.Err())
+	return prefixes
+}
+
+// Applies block list of profile to all gobgpd targets of profile
+func apply_block_list(ctx context.Context, profile BlockingProfile, prefixes_to_block []netip.Prefix) ([]TargetSyncResult, error) {
+	targets := get_gobgp_targets(profile)
+
+	results := make([]TargetSyncResult, len(targets))
+
+	// We apply same block list to all targets in parallel
+	var wg sync.WaitGroup
+
+	for i, target := range targets {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			results[i] = sync_target(ctx, profile, target, prefixes_to_block)
+		}()
 	}
 
-	// log.Printf("Successfully loaded %d prefixes for country %s", len(prefix_list), country_iso_code)
+	wg.Wait()
+
+	update_target_metrics(profile.Name, results)
 
-	return prefix_list, nil
+	return results, check_target_results(profile.Name, results, conf.TargetFailurePolicy)
 }
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"bitbucket.org/fastnetmon/country_lockdown/internal/gobgpfake"
+	"bitbucket.org/fastnetmon/country_lockdown/internal/mmdbtest"
+
+	apb "google.golang.org/protobuf/types/known/anypb"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+)
+
+// Writes configuration with database and fake gobgpd and loads it
+func load_test_configuration(t *testing.T, configuration map[string]any) {
+	t.Helper()
+
+	directory := t.TempDir()
+
+	// Same configuration keeps state between loads
+	if _, ok := configuration["state_dir"]; !ok {
+		configuration["state_dir"] = filepath.Join(directory, "state")
+	}
+
+	configuration["gobgp_api_retries"] = 0
+
+	configuration_as_json, err := json.Marshal(configuration)
+
+	if err != nil {
+		t.Fatalf("Cannot encode configuration: %v", err)
+	}
+
+	conf_file_path := filepath.Join(directory, "country_lockdown.json")
+
+	err = os.WriteFile(conf_file_path, configuration_as_json, 0644)
+
+	if err != nil {
+		t.Fatalf("Cannot write configuration: %v", err)
+	}
+
+	conf = CountryLockdownConfiguration{}
+
+	err = load_configuration(conf_file_path)
+
+	if err != nil {
+		t.Fatalf("Cannot load configuration: %v", err)
+	}
+}
+
+// Fake gobgpd, GeoIP database and configuration which test changes and reloads
+type test_environment struct {
+	server        *gobgpfake.Server
+	geoip_path    string
+	configuration map[string]any
+}
+
+// Starts fake gobgpd, writes database with networks and loads configuration which uses both
+func start_test_environment(t *testing.T, networks []mmdbtest.Network, configuration map[string]any) *test_environment {
+	t.Helper()
+
+	server, err := gobgpfake.Start()
+
+	if err != nil {
+		t.Fatalf("Cannot start fake gobgp: %v", err)
+	}
+
+	t.Cleanup(server.Stop)
+
+	geoip_path := mmdbtest.WriteTemp(t, "GeoLite2-Country", networks)
+
+	configuration["geoip_path"] = geoip_path
+	configuration["gobgp_api_host"] = server.Address()
+
+	if _, ok := configuration["bgp_ipv4_next_hop"]; !ok {
+		configuration["bgp_ipv4_next_hop"] = "192.0.2.1"
+	}
+
+	load_test_configuration(t, configuration)
+
+	return &test_environment{server: server, geoip_path: geoip_path, configuration: configuration}
+}
+
+// Loads changed configuration, state directory stays same
+func (e *test_environment) reload(t *testing.T) {
+	t.Helper()
+
+	load_test_configuration(t, e.configuration)
+}
+
+func (e *test_environment) sync(t *testing.T) {
+	t.Helper()
+
+	err := run_sync(context.Background())
+
+	if err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+}
+
+func (e *test_environment) rib(t *testing.T) []netip.Prefix {
+	t.Helper()
+
+	return get_rib_prefixes(t, e.server)
+}
+
+// Returns prefixes from RIB of fake gobgpd
+func get_rib_prefixes(t *testing.T, server *gobgpfake.Server) []netip.Prefix {
+	t.Helper()
+
+	prefixes := []netip.Prefix{}
+
+	for _, path := range server.Paths() {
+		nlri := apipb.IPAddressPrefix{}
+
+		if err := path.Nlri.UnmarshalTo(&nlri); err != nil {
+			t.Fatalf("Unexpected NLRI: %v", err)
+		}
+
+		prefixes = append(prefixes, netip.PrefixFrom(netip.MustParseAddr(nlri.Prefix), int(nlri.PrefixLen)))
+	}
+
+	slices.SortFunc(prefixes, func(a netip.Prefix, b netip.Prefix) int { return a.Addr().Compare(b.Addr()) })
+
+	return prefixes
+}
+
+// Networks of three countries which most tests use
+var test_networks = []mmdbtest.Network{
+	{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Record: mmdbtest.Country("TV", "Tuvalu")},
+	{Prefix: netip.MustParsePrefix("10.0.1.0/24"), Record: mmdbtest.Country("NR", "Nauru")},
+	{Prefix: netip.MustParsePrefix("10.0.2.0/24"), Record: mmdbtest.Country("KI", "Kiribati")},
+}
+
+func TestSyncWithAllowListAndWithdrawal(t *testing.T) {
+	env := start_test_environment(t, test_networks, map[string]any{
+		"country_block_list": []string{"TV", "NR"},
+		"ip_allow_list":      []string{"10.0.0.1"},
+	})
+
+	env.sync(t)
+
+	// Allowed address punches hole in 10.0.0.0/24
+	expected := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/32"),
+		netip.MustParsePrefix("10.0.0.2/31"),
+		netip.MustParsePrefix("10.0.0.4/30"),
+		netip.MustParsePrefix("10.0.0.8/29"),
+		netip.MustParsePrefix("10.0.0.16/28"),
+		netip.MustParsePrefix("10.0.0.32/27"),
+		netip.MustParsePrefix("10.0.0.64/26"),
+		netip.MustParsePrefix("10.0.0.128/25"),
+		netip.MustParsePrefix("10.0.1.0/24"),
+	}
+
+	if prefixes := env.rib(t); !slices.Equal(prefixes, expected) {
+		t.Fatalf("Unexpected RIB after first sync: %v", prefixes)
+	}
+
+	// Country was removed from block list and allow list was cleared
+	env.configuration["country_block_list"] = []string{"TV", "KI"}
+	env.configuration["ip_allow_list"] = []string{}
+
+	env.reload(t)
+	env.sync(t)
+
+	expected = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24"), netip.MustParsePrefix("10.0.2.0/24")}
+
+	if prefixes := env.rib(t); !slices.Equal(prefixes, expected) {
+		t.Fatalf("Unexpected RIB after second sync: %v", prefixes)
+	}
+}
+
+func TestWithdrawAllLeavesNothingOfOurs(t *testing.T) {
+	env := start_test_environment(t, test_networks, map[string]any{
+		"profiles": []map[string]any{
+			{"name": "sanctions", "marker_community": "65000:1", "country_block_list": []string{"TV"}},
+			{"name": "abuse", "marker_community": "65000:2", "country_block_list": []string{"NR"}},
+		},
+	})
+
+	env.sync(t)
+
+	// Route which was added by operator with gobgp CLI
+	foreign_prefix := netip.MustParsePrefix("198.51.100.0/24")
+
+	nlri, _ := apb.New(&apipb.IPAddressPrefix{Prefix: foreign_prefix.Addr().String(), PrefixLen: uint32(foreign_prefix.Bits())})
+	next_hop, _ := apb.New(&apipb.NextHopAttribute{NextHop: "192.0.2.1"})
+
+	_, err := env.server.AddPath(context.Background(), &apipb.AddPathRequest{Path: &apipb.Path{
+		Family: &apipb.Family{Afi: apipb.Family_AFI_IP, Safi: apipb.Family_SAFI_UNICAST},
+		Nlri:   nlri,
+		Pattrs: []*apb.Any{next_hop},
+	}})
+
+	if err != nil {
+		t.Fatalf("Cannot add foreign route: %v", err)
+	}
+
+	// Profile was removed and daemon did not sync yet, its routes stay in gobgpd
+	env.configuration["profiles"] = []map[string]any{
+		{"name": "abuse", "marker_community": "65000:2", "country_block_list": []string{"NR"}},
+	}
+
+	env.reload(t)
+
+	// We must not open GeoIP database for withdrawal
+	err = os.Remove(env.geoip_path)
+
+	if err != nil {
+		t.Fatalf("Cannot remove database: %v", err)
+	}
+
+	err = run_withdraw_all(context.Background(), "withdraw-all")
+
+	if err != nil {
+		t.Fatalf("Withdrawal failed: %v", err)
+	}
+
+	if prefixes := env.rib(t); !slices.Equal(prefixes, []netip.Prefix{foreign_prefix}) {
+		t.Fatalf("Only foreign route must stay after withdrawal: %v", prefixes)
+	}
+
+	versions, err := list_profile_snapshot_versions("abuse")
+
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("Expected snapshots of sync and withdrawal: %v %v", versions, err)
+	}
+
+	snapshot, err := load_snapshot(versions[1])
+
+	if err != nil {
+		t.Fatalf("Cannot load snapshot: %v", err)
+	}
+
+	if snapshot.Reason != "withdraw-all" || len(snapshot.Prefixes) != 0 {
+		t.Errorf("Unexpected snapshot of withdrawal: %+v", snapshot)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+
+	"bitbucket.org/fastnetmon/country_lockdown/lockdown"
+)
+
+var metric_country_prefixes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "country_lockdown_country_prefixes",
+	Help: "Number of blocked prefixes per country",
+}, []string{"profile", "country"})
+
+var metric_country_addresses = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "country_lockdown_country_addresses",
+	Help: "Number of blocked IPv4 addresses per country",
+}, []string{"profile", "country"})
+
+var metric_asn_prefixes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "country_lockdown_asn_prefixes",
+	Help: "Number of blocked prefixes per ASN from asn_block_list",
+}, []string{"profile", "asn"})
+
+var metric_asn_addresses = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "country_lockdown_asn_addresses",
+	Help: "Number of blocked IPv4 addresses per ASN from asn_block_list",
+}, []string{"profile", "asn"})
+
+var metric_feed_prefixes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "country_lockdown_feed_prefixes",
+	Help: "Number of blocked prefixes per block feed",
+}, []string{"profile", "feed"})
+
+var metric_feed_addresses = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "country_lockdown_feed_addresses",
+	Help: "Number of blocked IPv4 addresses per block feed",
+}, []string{"profile", "feed"})
+
+var metric_blocked_prefixes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "country_lockdown_blocked_prefixes",
+	Help: "Number of prefixes in block list of profile after aggregation",
+}, []string{"profile"})
+
+var metric_geoip_build_epoch = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "country_lockdown_geoip_build_epoch_seconds",
+	Help: "Build time of GeoIP database",
+}, []string{"database_type"})
+
+var metric_sync_duration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "country_lockdown_sync_duration_seconds",
+	Help:    "Duration of block list reconciliation",
+	Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+})
+
+var metric_last_successful_sync = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "country_lockdown_last_successful_sync_timestamp_seconds",
+	Help: "Time of last successful sync",
+})
+
+var metric_target_last_run_prefixes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "country_lockdown_target_last_run_prefixes",
+	Help: "Number of prefixes per action during last run for target",
+}, []string{"profile", "target", "action"})
+
+var metric_target_prefixes_total = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "country_lockdown_target_prefixes_total",
+	Help: "Number of announced, withdrawn and failed prefixes for target",
+}, []string{"profile", "target", "action"})
+
+var metric_target_sync_success = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "country_lockdown_target_sync_success",
+	Help: "1 when last sync for target was successful",
+}, []string{"profile", "target"})
+
+var metric_gobgp_up = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "country_lockdown_gobgp_up",
+	Help: "1 when we could talk to gobgpd API during last run",
+}, []string{"target"})
+
+var metric_bgp_peer_established = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "country_lockdown_bgp_peer_established",
+	Help: "1 when BGP session with peer is in ESTABLISHED state",
+}, []string{"target", "peer"})
+
+// Exposes details about computed block list of profile
+func update_block_list_metrics(profile_name string, block_list *lockdown.Result) {
+	profile_labels := prometheus.Labels{"profile": profile_name}
+
+	// We reset countries of profile as they may be removed from configuration
+	metric_country_prefixes.DeletePartialMatch(profile_labels)
+	metric_country_addresses.DeletePartialMatch(profile_labels)
+
+	for country_code, stats := range block_list.Countries {
+		metric_country_prefixes.WithLabelValues(profile_name, country_code).Set(float64(stats.Prefixes))
+		metric_country_addresses.WithLabelValues(profile_name, country_code).Set(float64(stats.Addresses))
+	}
+
+	metric_asn_prefixes.DeletePartialMatch(profile_labels)
+	metric_asn_addresses.DeletePartialMatch(profile_labels)
+
+	for asn, stats := range block_list.ASNs {
+		metric_asn_prefixes.WithLabelValues(profile_name, fmt.Sprint(asn)).Set(float64(stats.Prefixes))
+		metric_asn_addresses.WithLabelValues(profile_name, fmt.Sprint(asn)).Set(float64(stats.Addresses))
+	}
+
+	metric_feed_prefixes.DeletePartialMatch(profile_labels)
+	metric_feed_addresses.DeletePartialMatch(profile_labels)
+
+	for feed_name, stats := range block_list.Feeds {
+		metric_feed_prefixes.WithLabelValues(profile_name, feed_name).Set(float64(stats.Prefixes))
+		metric_feed_addresses.WithLabelValues(profile_name, feed_name).Set(float64(stats.Addresses))
+	}
+
+	metric_blocked_prefixes.WithLabelValues(profile_name).Set(float64(len(block_list.Prefixes)))
+
+	metric_geoip_build_epoch.Reset()
+	metric_geoip_build_epoch.WithLabelValues(block_list.Diagnostics.GeoIPDatabaseType).Set(float64(block_list.Diagnostics.GeoIPBuildEpoch))
+}
+
+// Exposes outcome of sync for every target of profile
+func update_target_metrics(profile_name string, results []TargetSyncResult) {
+	for _, result := range results {
+		counts := map[string]int{
+			"announced": result.Announced,
+			"updated":   result.Updated,
+			"withdrawn": result.Withdrawn,
+			"unchanged": result.Skipped,
+			"failed":    result.Failed,
+		}
+
+		for action, count := range counts {
+			metric_target_last_run_prefixes.WithLabelValues(profile_name, result.Target, action).Set(float64(count))
+
+			if action != "unchanged" {
+				metric_target_prefixes_total.WithLabelValues(profile_name, result.Target, action).Add(float64(count))
+			}
+		}
+
+		success := 0.0
+
+		if result.Err == nil {
+			success = 1
+		}
+
+		metric_target_sync_success.WithLabelValues(profile_name, result.Target).Set(success)
+	}
+}
+
+// Exposes session state for all peers of target
+func update_peer_metrics(target_name string, peers []*apipb.Peer) {
+	metric_bgp_peer_established.DeletePartialMatch(prometheus.Labels{"target": target_name})
+
+	for _, peer := range peers {
+		established := 0.0
+
+		if peer.State.SessionState == apipb.PeerState_ESTABLISHED {
+			established = 1
+		}
+
+		metric_bgp_peer_established.WithLabelValues(target_name, peer.State.NeighborAddress).Set(established)
+	}
+}
+
+// Starts HTTP server with /metrics in background
+func start_metrics_server(address string) error {
+	listener, err := net.Listen("tcp", address)
+
+	if err != nil {
+		return fmt.Errorf("Cannot listen on %s for metrics: %w", address, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		err := http.Serve(listener, mux)
+
+		if err != nil {
+			slog.Error("Metrics server stopped", "error", err)
+		}
+	}()
+
+	slog.Info("Exposing Prometheus metrics", "url", "http://"+address+"/metrics")
+
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Marker from snapshots which none of configured profiles uses, e.g. after removal of profile or change of marker_community
+type OrphanMarker struct {
+	MarkerCommunity string
+
+	// Profile and version of latest snapshot with this marker
+	Profile  string
+	Version  int
+	Prefixes int
+}
+
+func get_withdrawn_markers_file_path() string {
+	return filepath.Join(conf.StateDir, "withdrawn_markers.json")
+}
+
+// Returns markers which we withdrew already with version of latest snapshot with marker at that moment
+func load_withdrawn_markers() (map[string]int, error) {
+	withdrawn_markers := make(map[string]int)
+
+	withdrawn_markers_as_json, err := os.ReadFile(get_withdrawn_markers_file_path())
+
+	if os.IsNotExist(err) {
+		return withdrawn_markers, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read withdrawn markers: %w", err)
+	}
+
+	err = json.Unmarshal(withdrawn_markers_as_json, &withdrawn_markers)
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot decode withdrawn markers: %w", err)
+	}
+
+	return withdrawn_markers, nil
+}
+
+func save_withdrawn_markers(withdrawn_markers map[string]int) error {
+	withdrawn_markers_as_json, err := json.MarshalIndent(withdrawn_markers, "", "    ")
+
+	if err != nil {
+		return fmt.Errorf("Cannot encode withdrawn markers: %w", err)
+	}
+
+	withdrawn_markers_path := get_withdrawn_markers_file_path()
+
+	// We write into temporary file and rename it to avoid partially written file
+	err = os.WriteFile(withdrawn_markers_path+".tmp", withdrawn_markers_as_json, 0644)
+
+	if err != nil {
+		return fmt.Errorf("Cannot write withdrawn markers: %w", err)
+	}
+
+	err = os.Rename(withdrawn_markers_path+".tmp", withdrawn_markers_path)
+
+	if err != nil {
+		return fmt.Errorf("Cannot write withdrawn markers: %w", err)
+	}
+
+	return nil
+}
+
+// Returns markers of configured profiles
+func get_configured_markers() []uint32 {
+	markers := []uint32{}
+
+	for _, profile := range get_blocking_profiles() {
+		markers = append(markers, get_profile_marker(profile))
+	}
+
+	return markers
+}
+
+// Forgets withdrawals of markers which profiles use again, we must check them again after next removal
+func forget_configured_markers(withdrawn_markers map[string]int) bool {
+	configured_markers := get_configured_markers()
+
+	changed := false
+
+	for marker_community := range withdrawn_markers {
+		marker, err := parse_community(marker_community)
+
+		if err == nil && slices.Contains(configured_markers, marker) {
+			delete(withdrawn_markers, marker_community)
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// Returns markers from snapshot history which none of configured profiles uses
+// With only_pending we skip markers which latest snapshot is empty or which routes we withdrew after latest snapshot
+func find_orphan_markers(withdrawn_markers map[string]int, only_pending bool) ([]OrphanMarker, error) {
+	versions, err := list_snapshot_versions()
+
+	if err != nil {
+		return nil, err
+	}
+
+	configured_markers := get_configured_markers()
+
+	latest_by_marker := make(map[uint32]OrphanMarker)
+
+	for _, version := range versions {
+		snapshot, err := load_snapshot(version)
+
+		if err != nil {
+			slog.Warn("Cannot load snapshot", "version", version, "error", err)
+			continue
+		}
+
+		// Routes without marker cannot be separated from other routes, older snapshots do not have marker too
+		if snapshot.MarkerCommunity == "" {
+			continue
+		}
+
+		marker, err := parse_community(snapshot.MarkerCommunity)
+
+		if err != nil {
+			slog.Warn("Cannot parse marker community from snapshot", "version", version, "marker_community", snapshot.MarkerCommunity, "error", err)
+			continue
+		}
+
+		if slices.Contains(configured_markers, marker) {
+			continue
+		}
+
+		latest_by_marker[marker] = OrphanMarker{
+			MarkerCommunity: snapshot.MarkerCommunity,
+			Profile:         snapshot.Profile,
+			Version:         snapshot.Version,
+			Prefixes:        len(snapshot.Prefixes),
+		}
+	}
+
+	orphan_markers := []OrphanMarker{}
+
+	for _, orphan_marker := range latest_by_marker {
+		if only_pending && (orphan_marker.Prefixes == 0 || withdrawn_markers[orphan_marker.MarkerCommunity] >= orphan_marker.Version) {
+			continue
+		}
+
+		orphan_markers = append(orphan_markers, orphan_marker)
+	}
+
+	sort.Slice(orphan_markers, func(i, j int) bool {
+		return orphan_markers[i].Version < orphan_markers[j].Version
+	})
+
+	return orphan_markers, nil
+}
+
+// Returns targets of all profiles, routes of removed profile may live in any of them
+func get_all_gobgp_targets() []GoBGPTarget {
+	targets := []GoBGPTarget{}
+
+	for _, profile := range get_blocking_profiles() {
+		for _, target := range get_gobgp_targets(profile) {
+			if !slices.ContainsFunc(targets, func(other GoBGPTarget) bool { return other.Name == target.Name }) {
+				targets = append(targets, target)
+			}
+		}
+	}
+
+	return targets
+}
+
+// Withdraws routes of markers which we do not use anymore from all targets
+// With only_pending we process only markers which we did not withdraw after their latest snapshot
+func withdraw_orphan_markers(ctx context.Context, only_pending bool) error {
+	withdrawn_markers, err := load_withdrawn_markers()
+
+	if err != nil {
+		return err
+	}
+
+	forgotten := forget_configured_markers(withdrawn_markers)
+
+	orphan_markers, err := find_orphan_markers(withdrawn_markers, only_pending)
+
+	if err != nil {
+		return err
+	}
+
+	if len(orphan_markers) == 0 {
+		if forgotten {
+			return save_withdrawn_markers(withdrawn_markers)
+		}
+
+		return nil
+	}
+
+	targets := get_all_gobgp_targets()
+
+	failed_markers := []string{}
+
+	for _, orphan_marker := range orphan_markers {
+		slog.Warn("We have routes with marker which does not belong to any profile, withdrawing them",
+			"marker_community", orphan_marker.MarkerCommunity, "profile", orphan_marker.Profile, "version", orphan_marker.Version, "prefixes", orphan_marker.Prefixes)
+
+		profile := BlockingProfile{Name: orphan_marker.Profile, MarkerCommunity: orphan_marker.MarkerCommunity, GoBGPTargets: targets}
+
+		err := withdraw_from_targets(ctx, profile)
+
+		if err != nil {
+			slog.Error("Cannot withdraw routes of marker", "marker_community", orphan_marker.MarkerCommunity, "profile", orphan_marker.Profile, "error", err)
+			failed_markers = append(failed_markers, orphan_marker.MarkerCommunity)
+			continue
+		}
+
+		withdrawn_markers[orphan_marker.MarkerCommunity] = orphan_marker.Version
+	}
+
+	err = save_withdrawn_markers(withdrawn_markers)
+
+	if err != nil {
+		return err
+	}
+
+	if len(failed_markers) > 0 {
+		return fmt.Errorf("Cannot withdraw routes of markers %s", strings.Join(failed_markers, ","))
+	}
+
+	return nil
+}
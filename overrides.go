@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Runtime entry which we add on top of configuration file
+type OverrideEntry struct {
+	// Prefix or single IP address
+	Prefix string `json:"prefix,omitempty"`
+
+	// Country code, only for block list
+	Country string `json:"country,omitempty"`
+
+	// Entry applies only to this profile, it applies to all profiles when not set
+	Profile string `json:"profile,omitempty"`
+
+	Comment   string    `json:"comment,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// We remove entry after this time, it's permanent when not set
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Entries added via management API, we keep them in state directory to survive restarts
+type Overrides struct {
+	Allow []OverrideEntry `json:"allow"`
+	Block []OverrideEntry `json:"block"`
+}
+
+// Protects overrides file from concurrent API calls
+var overrides_mutex sync.Mutex
+
+func get_overrides_file_path() string {
+	return filepath.Join(conf.StateDir, "overrides.json")
+}
+
+// Loads overrides from state directory, we return empty list when we do not have file yet
+func load_overrides() (*Overrides, error) {
+	overrides_mutex.Lock()
+	defer overrides_mutex.Unlock()
+
+	return read_overrides_file()
+}
+
+// Loads overrides and removes expired entries from them
+func load_active_overrides(now time.Time) (*Overrides, error) {
+	overrides_mutex.Lock()
+	defer overrides_mutex.Unlock()
+
+	overrides, err := read_overrides_file()
+
+	if err != nil {
+		return nil, err
+	}
+
+	expired_entries := 0
+
+	for _, list_name := range []string{"allow", "block"} {
+		list := get_override_list(overrides, list_name)
+
+		active_entries := []OverrideEntry{}
+
+		for _, entry := range *list {
+			if entry.ExpiresAt != nil && !now.Before(*entry.ExpiresAt) {
+				slog.Info("Override expired", "list", list_name, "prefix", entry.Prefix, "country", entry.Country, "profile", entry.Profile,
+					"action", "withdraw", "expires_at", *entry.ExpiresAt)
+				expired_entries++
+				continue
+			}
+
+			active_entries = append(active_entries, entry)
+		}
+
+		*list = active_entries
+	}
+
+	if expired_entries == 0 {
+		return overrides, nil
+	}
+
+	err = write_overrides_file(overrides)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return overrides, nil
+}
+
+func read_overrides_file() (*Overrides, error) {
+	overrides := &Overrides{Allow: []OverrideEntry{}, Block: []OverrideEntry{}}
+
+	overrides_as_json, err := os.ReadFile(get_overrides_file_path())
+
+	if os.IsNotExist(err) {
+		return overrides, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read overrides: %w", err)
+	}
+
+	err = json.Unmarshal(overrides_as_json, overrides)
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot decode overrides: %w", err)
+	}
+
+	return overrides, nil
+}
+
+func write_overrides_file(overrides *Overrides) error {
+	err := os.MkdirAll(conf.StateDir, 0755)
+
+	if err != nil {
+		return fmt.Errorf("Cannot create state folder: %w", err)
+	}
+
+	overrides_as_json, err := json.MarshalIndent(overrides, "", "    ")
+
+	if err != nil {
+		return fmt.Errorf("Cannot encode overrides: %w", err)
+	}
+
+	overrides_path := get_overrides_file_path()
+
+	// We write into temporary file and rename it to avoid partially written file
+	err = os.WriteFile(overrides_path+".tmp", overrides_as_json, 0644)
+
+	if err != nil {
+		return fmt.Errorf("Cannot write overrides: %w", err)
+	}
+
+	err = os.Rename(overrides_path+".tmp", overrides_path)
+
+	if err != nil {
+		return fmt.Errorf("Cannot write overrides: %w", err)
+	}
+
+	return nil
+}
+
+// Checks entry and brings it to canonical form
+func normalise_override_entry(list_name string, entry OverrideEntry) (OverrideEntry, error) {
+	if entry.ExpiresAt != nil && !entry.ExpiresAt.After(time.Now()) {
+		return entry, fmt.Errorf("Expiration time %s is in the past", entry.ExpiresAt.Format(time.RFC3339))
+	}
+
+	if entry.Prefix != "" && entry.Country != "" {
+		return entry, fmt.Errorf("Please specify prefix or country but not both")
+	}
+
+	if entry.Profile != "" && !slices.ContainsFunc(get_blocking_profiles(), func(profile BlockingProfile) bool { return profile.Name == entry.Profile }) {
+		return entry, fmt.Errorf("We do not have profile %s", entry.Profile)
+	}
+
+	if entry.Country != "" {
+		if list_name != "block" {
+			return entry, fmt.Errorf("Countries can be added only to block list")
+		}
+
+		_, err := parse_block_list_entry(entry.Country)
+
+		if err != nil {
+			return entry, err
+		}
+
+		entry.Country = strings.ToUpper(entry.Country)
+
+		return entry, nil
+	}
+
+	if entry.Prefix == "" {
+		return entry, fmt.Errorf("Please specify prefix")
+	}
+
+	prefix, err := parse_prefix_or_address(entry.Prefix)
+
+	if err != nil {
+		return entry, err
+	}
+
+	if !prefix.Addr().Is4() {
+		return entry, fmt.Errorf("We support only IPv4 prefixes")
+	}
+
+	entry.Prefix = prefix.String()
+
+	return entry, nil
+}
+
+// Parses prefix and accepts single address as host prefix
+func parse_prefix_or_address(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("Cannot parse prefix %s: %v", value, err)
+		}
+
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(value)
+
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("Cannot parse address %s: %v", value, err)
+	}
+
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Returns entries which apply to profile
+func get_profile_overrides(overrides *Overrides, profile_name string) *Overrides {
+	profile_overrides := &Overrides{Allow: []OverrideEntry{}, Block: []OverrideEntry{}}
+
+	for _, list_name := range []string{"allow", "block"} {
+		for _, entry := range *get_override_list(overrides, list_name) {
+			if entry.Profile == "" || entry.Profile == profile_name {
+				list := get_override_list(profile_overrides, list_name)
+				*list = append(*list, entry)
+			}
+		}
+	}
+
+	return profile_overrides
+}
+
+// Entries are same when they block or allow same thing for same profile
+func is_same_override_entry(a OverrideEntry, b OverrideEntry) bool {
+	return a.Prefix == b.Prefix && a.Country == b.Country && a.Profile == b.Profile
+}
+
+func get_override_list(overrides *Overrides, list_name string) *[]OverrideEntry {
+	if list_name == "allow" {
+		return &overrides.Allow
+	}
+
+	return &overrides.Block
+}
+
+// Adds entry into allow or block list, returns false when we have it already
+// For existing entry we only update expiration time
+func add_override(list_name string, entry OverrideEntry) (bool, error) {
+	entry, err := normalise_override_entry(list_name, entry)
+
+	if err != nil {
+		return false, err
+	}
+
+	overrides_mutex.Lock()
+	defer overrides_mutex.Unlock()
+
+	overrides, err := read_overrides_file()
+
+	if err != nil {
+		return false, err
+	}
+
+	list := get_override_list(overrides, list_name)
+
+	for i, existing_entry := range *list {
+		if !is_same_override_entry(existing_entry, entry) {
+			continue
+		}
+
+		if equal_expiration_time(existing_entry.ExpiresAt, entry.ExpiresAt) {
+			return false, nil
+		}
+
+		(*list)[i].ExpiresAt = entry.ExpiresAt
+
+		return true, write_overrides_file(overrides)
+	}
+
+	entry.CreatedAt = time.Now().UTC()
+
+	*list = append(*list, entry)
+
+	return true, write_overrides_file(overrides)
+}
+
+func equal_expiration_time(a *time.Time, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.Equal(*b)
+}
+
+// Removes entry from allow or block list, returns false when we do not have it
+func remove_override(list_name string, entry OverrideEntry) (bool, error) {
+	entry, err := normalise_override_entry(list_name, entry)
+
+	if err != nil {
+		return false, err
+	}
+
+	overrides_mutex.Lock()
+	defer overrides_mutex.Unlock()
+
+	overrides, err := read_overrides_file()
+
+	if err != nil {
+		return false, err
+	}
+
+	list := get_override_list(overrides, list_name)
+
+	remaining_entries := []OverrideEntry{}
+
+	for _, existing_entry := range *list {
+		if is_same_override_entry(existing_entry, entry) {
+			continue
+		}
+
+		remaining_entries = append(remaining_entries, existing_entry)
+	}
+
+	if len(remaining_entries) == len(*list) {
+		return false, nil
+	}
+
+	*list = remaining_entries
+
+	return true, write_overrides_file(overrides)
+}
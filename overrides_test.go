@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var test_profiles = []map[string]any{
+	{"name": "sanctions", "marker_community": "65000:1", "country_block_list": []string{"TV"}},
+	{"name": "abuse", "marker_community": "65000:2", "country_block_list": []string{"NR"}},
+}
+
+func TestAddAndRemoveOverrides(t *testing.T) {
+	start_test_environment(t, test_networks, map[string]any{"country_block_list": []string{"TV"}})
+
+	changed, err := add_override("allow", OverrideEntry{Prefix: "10.0.0.1"})
+
+	if err != nil || !changed {
+		t.Fatalf("Cannot add override: %v", err)
+	}
+
+	// Same entry in other form is duplicate
+	changed, err = add_override("allow", OverrideEntry{Prefix: "10.0.0.1/32"})
+
+	if err != nil || changed {
+		t.Fatalf("Duplicate must not change overrides: %v %v", changed, err)
+	}
+
+	expires_at := time.Now().Add(time.Hour).UTC()
+
+	// For existing entry we only update expiration time
+	changed, err = add_override("allow", OverrideEntry{Prefix: "10.0.0.1", ExpiresAt: &expires_at})
+
+	if err != nil || !changed {
+		t.Fatalf("Cannot update expiration time: %v", err)
+	}
+
+	overrides, err := load_overrides()
+
+	if err != nil {
+		t.Fatalf("Cannot load overrides: %v", err)
+	}
+
+	if len(overrides.Allow) != 1 || overrides.Allow[0].Prefix != "10.0.0.1/32" || !equal_expiration_time(overrides.Allow[0].ExpiresAt, &expires_at) {
+		t.Fatalf("Unexpected allow list: %+v", overrides.Allow)
+	}
+
+	changed, err = remove_override("allow", OverrideEntry{Prefix: "10.0.0.1"})
+
+	if err != nil || !changed {
+		t.Fatalf("Cannot remove override: %v", err)
+	}
+
+	changed, err = remove_override("allow", OverrideEntry{Prefix: "10.0.0.1"})
+
+	if err != nil || changed {
+		t.Fatalf("We do not have entry anymore: %v %v", changed, err)
+	}
+
+}
+
+func TestRejectsBrokenOverrides(t *testing.T) {
+	start_test_environment(t, test_networks, map[string]any{"country_block_list": []string{"TV"}})
+
+	expired_at := time.Now().Add(-time.Hour)
+
+	broken_entries := map[string]OverrideEntry{
+		"empty":           {},
+		"prefix":          {Prefix: "10.0.0.0/33"},
+		"ipv6":            {Prefix: "2001:db8::/32"},
+		"both":            {Prefix: "10.0.0.0/24", Country: "TV"},
+		"country":         {Country: "Tuvalu"},
+		"expired":         {Prefix: "10.0.0.0/24", ExpiresAt: &expired_at},
+		"allowed country": {Country: "TV"},
+	}
+
+	for name, entry := range broken_entries {
+		list_name := "block"
+
+		if name == "allowed country" {
+			list_name = "allow"
+		}
+
+		if _, err := add_override(list_name, entry); err == nil {
+			t.Errorf("We must reject %s entry %+v", name, entry)
+		}
+	}
+}
+
+func TestOverridesExpire(t *testing.T) {
+	start_test_environment(t, test_networks, map[string]any{"country_block_list": []string{"TV"}})
+
+	expires_at := time.Now().Add(time.Hour)
+
+	if _, err := add_override("block", OverrideEntry{Country: "ki", ExpiresAt: &expires_at}); err != nil {
+		t.Fatalf("Cannot add override: %v", err)
+	}
+
+	if _, err := add_override("block", OverrideEntry{Prefix: "10.0.2.0/25"}); err != nil {
+		t.Fatalf("Cannot add override: %v", err)
+	}
+
+	overrides, err := load_active_overrides(time.Now())
+
+	if err != nil || len(overrides.Block) != 2 || overrides.Block[0].Country != "KI" {
+		t.Fatalf("Unexpected active overrides before expiration: %+v %v", overrides, err)
+	}
+
+	if next_change := get_next_schedule_change(time.Now()); !next_change.Equal(expires_at) {
+		t.Errorf("Next change must be at expiration of override: %v", next_change)
+	}
+
+	overrides, err = load_active_overrides(expires_at)
+
+	if err != nil || len(overrides.Block) != 1 || overrides.Block[0].Prefix != "10.0.2.0/25" {
+		t.Fatalf("Unexpected active overrides after expiration: %+v %v", overrides, err)
+	}
+
+	// Expired entry is removed from file too
+	overrides, err = load_overrides()
+
+	if err != nil || len(overrides.Block) != 1 {
+		t.Errorf("Expired entry must be removed from file: %+v %v", overrides, err)
+	}
+}
+
+func TestOverridesApplyOnSync(t *testing.T) {
+	env := start_test_environment(t, test_networks, map[string]any{"country_block_list": []string{"TV"}})
+
+	if _, err := add_override("block", OverrideEntry{Country: "NR"}); err != nil {
+		t.Fatalf("Cannot add override: %v", err)
+	}
+
+	if _, err := add_override("allow", OverrideEntry{Prefix: "10.0.0.0/25"}); err != nil {
+		t.Fatalf("Cannot add override: %v", err)
+	}
+
+	env.sync(t)
+
+	expected := []netip.Prefix{netip.MustParsePrefix("10.0.0.128/25"), netip.MustParsePrefix("10.0.1.0/24")}
+
+	if prefixes := env.rib(t); !slices.Equal(prefixes, expected) {
+		t.Errorf("Unexpected RIB: %v, expected %v", prefixes, expected)
+	}
+}
+
+func TestOverridesAPI(t *testing.T) {
+	start_test_environment(t, test_networks, map[string]any{"country_block_list": []string{"TV"}})
+
+	change_override := func(method string, target string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+
+		handle_api_change_override(w, httptest.NewRequest(method, target, strings.NewReader(body)), "block", method == http.MethodPost)
+
+		return w
+	}
+
+	w := change_override(http.MethodPost, "/overrides/block", `{"prefix": "10.0.2.0/24", "comment": "scanner"}`)
+
+	response := map[string]bool{}
+
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || w.Code != http.StatusOK || !response["changed"] {
+		t.Fatalf("Unexpected response to add: %d %s", w.Code, w.Body.String())
+	}
+
+	if w := change_override(http.MethodPost, "/overrides/block", `{"prefix": "10.0.2.0/33"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Broken prefix must be rejected: %d %s", w.Code, w.Body.String())
+	}
+
+	if w := change_override(http.MethodPost, "/overrides/block", `{"prefix": `); w.Code != http.StatusBadRequest {
+		t.Errorf("Broken request must be rejected: %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+
+	handle_api_list_overrides(w, httptest.NewRequest(http.MethodGet, "/overrides/block", nil), "block")
+
+	entries := []OverrideEntry{}
+
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("Cannot decode list of overrides: %v", err)
+	}
+
+	if len(entries) != 1 || entries[0].Prefix != "10.0.2.0/24" || entries[0].Comment != "scanner" {
+		t.Fatalf("Unexpected list of overrides: %+v", entries)
+	}
+
+	if w := change_override(http.MethodDelete, "/overrides/block?prefix=10.0.3.0/24", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Unexpected response to removal of missing entry: %d %s", w.Code, w.Body.String())
+	}
+
+	if w := change_override(http.MethodDelete, "/overrides/block?prefix=10.0.2.0/24", ""); w.Code != http.StatusOK {
+		t.Errorf("Unexpected response to removal: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestProfileOverrides(t *testing.T) {
+	env := start_test_environment(t, test_networks, map[string]any{"profiles": test_profiles})
+
+	if _, err := add_override("block", OverrideEntry{Country: "KI", Profile: "abuse"}); err != nil {
+		t.Fatalf("Cannot add override: %v", err)
+	}
+
+	if _, err := add_override("allow", OverrideEntry{Prefix: "10.0.0.0/25"}); err != nil {
+		t.Fatalf("Cannot add override: %v", err)
+	}
+
+	overrides, err := load_overrides()
+
+	if err != nil {
+		t.Fatalf("Cannot load overrides: %v", err)
+	}
+
+	if profile_overrides := get_profile_overrides(overrides, "sanctions"); len(profile_overrides.Block) != 0 || len(profile_overrides.Allow) != 1 {
+		t.Errorf("Unexpected overrides of sanctions: %+v", profile_overrides)
+	}
+
+	if profile_overrides := get_profile_overrides(overrides, "abuse"); len(profile_overrides.Block) != 1 || len(profile_overrides.Allow) != 1 {
+		t.Errorf("Unexpected overrides of abuse: %+v", profile_overrides)
+	}
+
+	// Entry for single profile is separate from same entry for all profiles
+	changed, err := add_override("allow", OverrideEntry{Prefix: "10.0.0.0/25", Profile: "abuse"})
+
+	if err != nil || !changed {
+		t.Fatalf("Cannot add override for profile: %v", err)
+	}
+
+	if _, err := add_override("block", OverrideEntry{Prefix: "10.0.2.0/24", Profile: "spam"}); err == nil {
+		t.Errorf("We must reject override for unknown profile")
+	}
+
+	changed, err = remove_override("allow", OverrideEntry{Prefix: "10.0.0.0/25", Profile: "abuse"})
+
+	if err != nil || !changed {
+		t.Fatalf("Cannot remove override for profile: %v", err)
+	}
+
+	env.sync(t)
+
+	// Allowed half of TV and NR with KI from override of abuse
+	expected := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.128/25"),
+		netip.MustParsePrefix("10.0.1.0/24"),
+		netip.MustParsePrefix("10.0.2.0/24"),
+	}
+
+	if prefixes := env.rib(t); !slices.Equal(prefixes, expected) {
+		t.Errorf("Unexpected RIB: %v, expected %v", prefixes, expected)
+	}
+
+	// Entry without profile is different one
+	w := httptest.NewRecorder()
+
+	handle_api_change_override(w, httptest.NewRequest(http.MethodDelete, "/overrides/block?country=KI", nil), "block", false)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Unexpected response to removal of entry without profile: %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+
+	handle_api_change_override(w, httptest.NewRequest(http.MethodDelete, "/overrides/block?country=KI&profile=abuse", nil), "block", false)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected response to removal of entry for profile: %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Independent policy with own lists, attributes and targets
+// We compute and reconcile every profile separately and profile touches only routes with its marker community
+type BlockingProfile struct {
+	Name string `json:"name"`
+
+	// Community which we add to all routes of profile, e.g. 65000:666. We use it to find our routes in RIB
+	MarkerCommunity string `json:"marker_community"`
+
+	CountryBlockList []string `json:"country_block_list"`
+	IPAllowList      []string `json:"ip_allow_list"`
+	ASNBlockList     []uint   `json:"asn_block_list"`
+	ASNAllowList     []uint   `json:"asn_allow_list"`
+
+	BlockFeeds []BlockFeedConfiguration `json:"block_feeds"`
+	AllowFeeds []AllowFeedConfiguration `json:"allow_feeds"`
+
+	// We use values from top level of configuration when they're not set
+	BGPIPv4NextHop     string        `json:"bgp_ipv4_next_hop"`
+	BGPIPv4Communities []string      `json:"bgp_ipv4_communities"`
+	GoBGPTargets       []GoBGPTarget `json:"gobgp_targets"`
+}
+
+// Name of profile which we create from top level of configuration when profiles are not set
+const default_profile_name = "default"
+
+// Returns profiles from configuration with inherited attributes
+// Without profiles we have single profile without marker which owns all routes in RIB as before
+func get_blocking_profiles() []BlockingProfile {
+	if len(conf.Profiles) == 0 {
+		return []BlockingProfile{{
+			Name:               default_profile_name,
+			CountryBlockList:   conf.CountryBlockList,
+			IPAllowList:        conf.IPAllowList,
+			ASNBlockList:       conf.ASNBlockList,
+			ASNAllowList:       conf.ASNAllowList,
+			BlockFeeds:         conf.BlockFeeds,
+			AllowFeeds:         conf.AllowFeeds,
+			BGPIPv4NextHop:     conf.BGPIPv4NextHop,
+			BGPIPv4Communities: conf.BGPIPv6Communities,
+			GoBGPTargets:       conf.GoBGPTargets,
+		}}
+	}
+
+	profiles := []BlockingProfile{}
+
+	for _, profile := range conf.Profiles {
+		if profile.BGPIPv4NextHop == "" {
+			profile.BGPIPv4NextHop = conf.BGPIPv4NextHop
+		}
+
+		if profile.BGPIPv4Communities == nil {
+			profile.BGPIPv4Communities = conf.BGPIPv6Communities
+		}
+
+		if len(profile.GoBGPTargets) == 0 {
+			profile.GoBGPTargets = conf.GoBGPTargets
+		}
+
+		profiles = append(profiles, profile)
+	}
+
+	return profiles
+}
+
+// Returns profile by name, empty name is allowed only when we have single profile
+func get_blocking_profile(name string) (BlockingProfile, error) {
+	profiles := get_blocking_profiles()
+
+	if name == "" {
+		if len(profiles) > 1 {
+			return BlockingProfile{}, fmt.Errorf("We have %d profiles, please specify one of them", len(profiles))
+		}
+
+		return profiles[0], nil
+	}
+
+	for _, profile := range profiles {
+		if profile.Name == name {
+			return profile, nil
+		}
+	}
+
+	return BlockingProfile{}, fmt.Errorf("We do not have profile %s", name)
+}
+
+// Checks profiles and lists for every profile
+func validate_blocking_profiles() error {
+	if len(conf.Profiles) > 0 {
+		top_level_lists := map[string]int{
+			"country_block_list": len(conf.CountryBlockList),
+			"ip_allow_list":      len(conf.IPAllowList),
+			"asn_block_list":     len(conf.ASNBlockList),
+			"asn_allow_list":     len(conf.ASNAllowList),
+			"block_feeds":        len(conf.BlockFeeds),
+			"allow_feeds":        len(conf.AllowFeeds),
+		}
+
+		for list_name, length := range top_level_lists {
+			if length > 0 {
+				return fmt.Errorf("Please move %s into profiles, we cannot use it on top level with profiles", list_name)
+			}
+		}
+	}
+
+	names := []string{}
+	markers := []uint32{}
+
+	for index, profile := range get_blocking_profiles() {
+		if profile.Name == "" {
+			return fmt.Errorf("Profile %d does not have name", index)
+		}
+
+		if slices.Contains(names, profile.Name) {
+			return fmt.Errorf("We have multiple profiles with name %s", profile.Name)
+		}
+
+		names = append(names, profile.Name)
+
+		err := validate_blocking_profile(profile)
+
+		if err != nil {
+			return fmt.Errorf("Profile %s is invalid: %w", profile.Name, err)
+		}
+
+		// Default profile owns all routes and does not have marker
+		if len(conf.Profiles) == 0 {
+			continue
+		}
+
+		marker, err := parse_community(profile.MarkerCommunity)
+
+		if err != nil {
+			return fmt.Errorf("Profile %s must have valid marker_community: %w", profile.Name, err)
+		}
+
+		if marker == 0 {
+			return fmt.Errorf("Profile %s cannot use 0:0 as marker_community", profile.Name)
+		}
+
+		if slices.Contains(markers, marker) {
+			return fmt.Errorf("Profile %s uses marker_community %s of another profile", profile.Name, profile.MarkerCommunity)
+		}
+
+		markers = append(markers, marker)
+	}
+
+	for index, block := range conf.ScheduledCountryBlocks {
+		if block.Profile != "" && !slices.Contains(names, block.Profile) {
+			return fmt.Errorf("Scheduled block %s uses unknown profile %s", get_scheduled_block_name(index, block), block.Profile)
+		}
+	}
+
+	return nil
+}
+
+func validate_blocking_profile(profile BlockingProfile) error {
+	err := validate_asn_lists(profile.ASNBlockList, profile.ASNAllowList)
+
+	if err != nil {
+		return err
+	}
+
+	err = validate_block_feeds(profile.BlockFeeds)
+
+	if err != nil {
+		return err
+	}
+
+	return validate_allow_feeds(profile.AllowFeeds)
+}
+
+// Parses community in format of two uint16 separated by colon and encodes it as single uint32
+func parse_community(community_as_string string) (uint32, error) {
+	splitted_community := strings.Split(community_as_string, ":")
+
+	if len(splitted_community) != 2 {
+		return 0, fmt.Errorf("Cannot parse community %s, please use format 65000:666", community_as_string)
+	}
+
+	first, err := strconv.ParseUint(splitted_community[0], 10, 16)
+
+	if err != nil {
+		return 0, fmt.Errorf("Cannot parse community part %s as 16 bit integer", splitted_community[0])
+	}
+
+	second, err := strconv.ParseUint(splitted_community[1], 10, 16)
+
+	if err != nil {
+		return 0, fmt.Errorf("Cannot parse community part %s as 16 bit integer", splitted_community[1])
+	}
+
+	// Encode two 2 byte integers into single 4 byte integer
+	b := make([]byte, 4)
+
+	// Well, I just found out that we need to use them in reverse order during testing
+	binary.LittleEndian.PutUint16(b[0:], uint16(second))
+	binary.LittleEndian.PutUint16(b[2:], uint16(first))
+
+	return binary.LittleEndian.Uint32(b[:]), nil
+}
+
+// Returns marker community of profile as uint32 or zero when profile does not have it
+func get_profile_marker(profile BlockingProfile) uint32 {
+	if profile.MarkerCommunity == "" {
+		return 0
+	}
+
+	// We validate it on load
+	marker, _ := parse_community(profile.MarkerCommunity)
+
+	return marker
+}
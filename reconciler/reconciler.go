@@ -0,0 +1,148 @@
+// Package reconciler brings announces in BGP speaker in line with block list
+package reconciler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+
+	"bitbucket.org/fastnetmon/country_lockdown/announcer"
+)
+
+// Changes which we need to apply to active announces
+type Plan struct {
+	Announce []netip.Prefix
+
+	// Active announces with outdated attributes, we announce them again
+	Update []netip.Prefix
+
+	Withdraw  []netip.Prefix
+	Unchanged []netip.Prefix
+}
+
+// Outcome of reconciliation
+type Result struct {
+	Announced int
+	Updated   int
+	Withdrawn int
+	Unchanged int
+	Failed    int
+}
+
+// Compares active announces with block list
+func NewPlan(active []announcer.Route, desired []netip.Prefix) Plan {
+	plan := Plan{}
+
+	desired_map := make(map[netip.Prefix]bool)
+
+	for _, prefix := range desired {
+		desired_map[prefix] = true
+	}
+
+	active_map := make(map[netip.Prefix]announcer.Route)
+
+	// Find announces we have to withdraw
+	for _, route := range active {
+		active_map[route.Prefix] = route
+
+		if !desired_map[route.Prefix] {
+			plan.Withdraw = append(plan.Withdraw, route.Prefix)
+		}
+	}
+
+	// Filter out already active announces
+	for _, prefix := range desired {
+		route, ok := active_map[prefix]
+
+		if ok && route.Outdated {
+			plan.Update = append(plan.Update, prefix)
+			continue
+		}
+
+		if ok {
+			plan.Unchanged = append(plan.Unchanged, prefix)
+			continue
+		}
+
+		plan.Announce = append(plan.Announce, prefix)
+	}
+
+	return plan
+}
+
+// Loads active announces and applies difference with block list
+func Reconcile(ctx context.Context, logger *slog.Logger, a announcer.Announcer, desired []netip.Prefix) (Result, error) {
+	active, err := a.ListAnnounced(ctx)
+
+	if err != nil {
+		return Result{}, fmt.Errorf("Cannot load announces: %w", err)
+	}
+
+	logger.Info("Loaded active announces", "prefixes", len(active))
+
+	return Apply(ctx, logger, a, NewPlan(active, desired))
+}
+
+// Withdraws and announces prefixes from plan, we withdraw first
+func Apply(ctx context.Context, logger *slog.Logger, a announcer.Announcer, plan Plan) (Result, error) {
+	result := Result{Unchanged: len(plan.Unchanged)}
+
+	for _, prefix := range plan.Withdraw {
+		logger.Debug("We have to withdraw prefix", "prefix", prefix, "action", "withdraw")
+
+		err := a.Withdraw(ctx, prefix)
+
+		if err != nil {
+			logger.Error("Cannot withdraw prefix", "prefix", prefix, "action", "withdraw", "error", err)
+			result.Failed++
+			continue
+		}
+
+		result.Withdrawn++
+	}
+
+	logger.Debug("Finished withdrawal process", "withdrawn", result.Withdrawn)
+
+	if len(plan.Update) > 0 {
+		logger.Info("Prepare to update prefixes with changed attributes", "prefixes", len(plan.Update))
+	}
+
+	for _, prefix := range plan.Update {
+		logger.Debug("We have to update prefix", "prefix", prefix, "action", "update")
+
+		err := a.Announce(ctx, prefix)
+
+		if err != nil {
+			logger.Error("Cannot update prefix", "prefix", prefix, "action", "update", "error", err)
+			result.Failed++
+			continue
+		}
+
+		result.Updated++
+	}
+
+	logger.Debug("Skipped following prefixes as already active", "prefix_list", plan.Unchanged)
+
+	logger.Info("Prepare to announce prefixes", "prefixes", len(plan.Announce), "unchanged", result.Unchanged)
+
+	logger.Debug("Prefixes to announce", "prefix_list", plan.Announce)
+
+	for _, prefix := range plan.Announce {
+		err := a.Announce(ctx, prefix)
+
+		if err != nil {
+			logger.Error("Cannot announce prefix", "prefix", prefix, "action", "announce", "error", err)
+			result.Failed++
+			continue
+		}
+
+		result.Announced++
+	}
+
+	if result.Failed > 0 {
+		return result, fmt.Errorf("Cannot announce, update or withdraw %d prefixes", result.Failed)
+	}
+
+	return result, nil
+}
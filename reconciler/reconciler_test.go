@@ -0,0 +1,272 @@
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+
+	"bitbucket.org/fastnetmon/country_lockdown/announcer"
+	"bitbucket.org/fastnetmon/country_lockdown/internal/gobgpfake"
+)
+
+// 65000:666 and 65000:777
+const (
+	sanctions_marker = 65000<<16 | 666
+	abuse_marker     = 65000<<16 | 777
+)
+
+func start_fake_gobgp(t *testing.T) (*gobgpfake.Server, apipb.GobgpApiClient) {
+	t.Helper()
+
+	server, err := gobgpfake.Start()
+
+	if err != nil {
+		t.Fatalf("Cannot start fake gobgp: %v", err)
+	}
+
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient(server.Address(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+
+	if err != nil {
+		t.Fatalf("Cannot connect to fake gobgp: %v", err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	return server, apipb.NewGobgpApiClient(conn)
+}
+
+func new_announcer(client apipb.GobgpApiClient, marker uint32) *announcer.GoBGP {
+	return announcer.NewGoBGP(client, announcer.Attributes{
+		NextHop: netip.MustParseAddr("192.0.2.1"),
+		Marker:  marker,
+	})
+}
+
+func parse_prefixes(values ...string) []netip.Prefix {
+	prefixes := []netip.Prefix{}
+
+	for _, value := range values {
+		prefixes = append(prefixes, netip.MustParsePrefix(value))
+	}
+
+	return prefixes
+}
+
+func list_announced(t *testing.T, a announcer.Announcer) []netip.Prefix {
+	t.Helper()
+
+	routes, err := a.ListAnnounced(context.Background())
+
+	if err != nil {
+		t.Fatalf("Cannot list announces: %v", err)
+	}
+
+	prefixes := []netip.Prefix{}
+
+	for _, route := range routes {
+		prefixes = append(prefixes, route.Prefix)
+	}
+
+	slices.SortFunc(prefixes, func(a netip.Prefix, b netip.Prefix) int { return a.Addr().Compare(b.Addr()) })
+
+	return prefixes
+}
+
+func TestNewPlan(t *testing.T) {
+	active := []announcer.Route{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/24")},
+		{Prefix: netip.MustParsePrefix("10.0.1.0/24")},
+		{Prefix: netip.MustParsePrefix("10.0.3.0/24"), Outdated: true},
+		{Prefix: netip.MustParsePrefix("10.0.4.0/24"), Outdated: true},
+	}
+
+	plan := NewPlan(active, parse_prefixes("10.0.1.0/24", "10.0.2.0/24", "10.0.3.0/24"))
+
+	if !slices.Equal(plan.Withdraw, parse_prefixes("10.0.0.0/24", "10.0.4.0/24")) {
+		t.Errorf("Unexpected withdrawals: %v", plan.Withdraw)
+	}
+
+	if !slices.Equal(plan.Announce, parse_prefixes("10.0.2.0/24")) {
+		t.Errorf("Unexpected announces: %v", plan.Announce)
+	}
+
+	if !slices.Equal(plan.Unchanged, parse_prefixes("10.0.1.0/24")) {
+		t.Errorf("Unexpected unchanged prefixes: %v", plan.Unchanged)
+	}
+
+	if !slices.Equal(plan.Update, parse_prefixes("10.0.3.0/24")) {
+		t.Errorf("Unexpected updates: %v", plan.Update)
+	}
+}
+
+func TestReconcileAnnouncesAndWithdraws(t *testing.T) {
+	ctx := context.Background()
+
+	_, client := start_fake_gobgp(t)
+
+	a := new_announcer(client, sanctions_marker)
+
+	result, err := Reconcile(ctx, slog.Default(), a, parse_prefixes("10.0.0.0/24", "10.0.1.0/24"))
+
+	if err != nil {
+		t.Fatalf("Cannot reconcile: %v", err)
+	}
+
+	if result != (Result{Announced: 2}) {
+		t.Errorf("Unexpected result of first run: %+v", result)
+	}
+
+	// Country was removed from block list and another one was added
+	result, err = Reconcile(ctx, slog.Default(), a, parse_prefixes("10.0.1.0/24", "10.0.2.0/24"))
+
+	if err != nil {
+		t.Fatalf("Cannot reconcile: %v", err)
+	}
+
+	if result != (Result{Announced: 1, Withdrawn: 1, Unchanged: 1}) {
+		t.Errorf("Unexpected result of second run: %+v", result)
+	}
+
+	if announced := list_announced(t, a); !slices.Equal(announced, parse_prefixes("10.0.1.0/24", "10.0.2.0/24")) {
+		t.Errorf("Unexpected announces: %v", announced)
+	}
+
+	// Nothing changed
+	result, err = Reconcile(ctx, slog.Default(), a, parse_prefixes("10.0.1.0/24", "10.0.2.0/24"))
+
+	if err != nil {
+		t.Fatalf("Cannot reconcile: %v", err)
+	}
+
+	if result != (Result{Unchanged: 2}) {
+		t.Errorf("Unexpected result of third run: %+v", result)
+	}
+}
+
+func TestReconcileUpdatesChangedAttributes(t *testing.T) {
+	ctx := context.Background()
+
+	server, client := start_fake_gobgp(t)
+
+	_, err := Reconcile(ctx, slog.Default(), new_announcer(client, sanctions_marker), parse_prefixes("10.0.0.0/24", "10.0.1.0/24"))
+
+	if err != nil {
+		t.Fatalf("Cannot reconcile: %v", err)
+	}
+
+	// Next hop was changed in configuration
+	a := announcer.NewGoBGP(client, announcer.Attributes{
+		NextHop: netip.MustParseAddr("192.0.2.2"),
+		Marker:  sanctions_marker,
+	})
+
+	result, err := Reconcile(ctx, slog.Default(), a, parse_prefixes("10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/24"))
+
+	if err != nil {
+		t.Fatalf("Cannot reconcile: %v", err)
+	}
+
+	if result != (Result{Announced: 1, Updated: 2}) {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+
+	// We replace paths and do not add new ones
+	paths := server.Paths()
+
+	if len(paths) != 3 {
+		t.Fatalf("Expected 3 paths in RIB, got %d", len(paths))
+	}
+
+	for _, path := range paths {
+		next_hop := apipb.NextHopAttribute{}
+
+		for _, attr := range path.Pattrs {
+			attr.UnmarshalTo(&next_hop)
+		}
+
+		if next_hop.NextHop != "192.0.2.2" {
+			t.Errorf("Path has old next hop: %s", next_hop.NextHop)
+		}
+	}
+
+	result, err = Reconcile(ctx, slog.Default(), a, parse_prefixes("10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/24"))
+
+	if err != nil {
+		t.Fatalf("Cannot reconcile: %v", err)
+	}
+
+	if result != (Result{Unchanged: 3}) {
+		t.Errorf("Unexpected result after update: %+v", result)
+	}
+}
+
+func TestReconcileKeepsRoutesOfOtherProfiles(t *testing.T) {
+	ctx := context.Background()
+
+	server, client := start_fake_gobgp(t)
+
+	sanctions := new_announcer(client, sanctions_marker)
+	abuse := new_announcer(client, abuse_marker)
+
+	_, err := Reconcile(ctx, slog.Default(), sanctions, parse_prefixes("10.0.0.0/24", "10.0.1.0/24"))
+
+	if err != nil {
+		t.Fatalf("Cannot reconcile sanctions: %v", err)
+	}
+
+	// Same prefix in both profiles
+	_, err = Reconcile(ctx, slog.Default(), abuse, parse_prefixes("10.0.0.0/24"))
+
+	if err != nil {
+		t.Fatalf("Cannot reconcile abuse: %v", err)
+	}
+
+	if paths := server.Paths(); len(paths) != 3 {
+		t.Fatalf("Expected 3 paths in RIB, got %d", len(paths))
+	}
+
+	// Empty block list of abuse profile must not touch routes of sanctions profile
+	result, err := Reconcile(ctx, slog.Default(), abuse, []netip.Prefix{})
+
+	if err != nil {
+		t.Fatalf("Cannot reconcile abuse: %v", err)
+	}
+
+	if result != (Result{Withdrawn: 1}) {
+		t.Errorf("Unexpected result for abuse: %+v", result)
+	}
+
+	if announced := list_announced(t, sanctions); !slices.Equal(announced, parse_prefixes("10.0.0.0/24", "10.0.1.0/24")) {
+		t.Errorf("Routes of sanctions profile were changed: %v", announced)
+	}
+
+	if announced := list_announced(t, abuse); len(announced) != 0 {
+		t.Errorf("Routes of abuse profile were not withdrawn: %v", announced)
+	}
+}
+
+func TestReconcileReportsFailures(t *testing.T) {
+	server, client := start_fake_gobgp(t)
+
+	server.SetAddPathError(errors.New("table is full"))
+
+	result, err := Reconcile(context.Background(), slog.Default(), new_announcer(client, 0), parse_prefixes("10.0.0.0/24", "10.0.1.0/24"))
+
+	if err == nil {
+		t.Fatalf("Reconcile must fail when we cannot announce")
+	}
+
+	if result != (Result{Failed: 2}) {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+}
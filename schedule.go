@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Countries which we block only for some time or during specific windows
+type ScheduledCountryBlock struct {
+	Name      string   `json:"name"`
+	Countries []string `json:"countries"`
+
+	// Countries are added only to this profile, to all profiles when it's empty
+	Profile string `json:"profile"`
+
+	// Entry is ignored after this time, RFC 3339 format
+	ExpiresAt *time.Time `json:"expires_at"`
+
+	// Start of every active window in cron format: minute hour day month weekday
+	// Entry is always active when schedule is not set
+	Schedule string `json:"schedule"`
+
+	// How long window stays active after start, e.g. 14h or 90m
+	Duration string `json:"duration"`
+
+	// IANA name like Europe/London, UTC by default
+	Timezone string `json:"timezone"`
+}
+
+// Parsed window of scheduled block
+type ScheduledWindow struct {
+	Schedule cron.Schedule
+	Duration time.Duration
+	Location *time.Location
+}
+
+// We log only changes of state for scheduled blocks
+var scheduled_blocks_state = make(map[string]bool)
+var scheduled_blocks_state_mutex sync.Mutex
+
+func get_scheduled_block_name(index int, block ScheduledCountryBlock) string {
+	if block.Name != "" {
+		return block.Name
+	}
+
+	return fmt.Sprintf("%d (%s)", index, strings.Join(block.Countries, ","))
+}
+
+// Parses cron schedule, duration and timezone. Returns nil when entry does not have schedule
+func parse_scheduled_window(block ScheduledCountryBlock) (*ScheduledWindow, error) {
+	if block.Schedule == "" {
+		if block.Duration != "" || block.Timezone != "" {
+			return nil, fmt.Errorf("Duration and timezone can be used only with schedule")
+		}
+
+		return nil, nil
+	}
+
+	schedule, err := cron.ParseStandard(block.Schedule)
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse schedule %s: %v", block.Schedule, err)
+	}
+
+	if block.Duration == "" {
+		return nil, fmt.Errorf("Duration for schedule %s is not set", block.Schedule)
+	}
+
+	duration, err := time.ParseDuration(block.Duration)
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse duration %s: %v", block.Duration, err)
+	}
+
+	if duration <= 0 {
+		return nil, fmt.Errorf("Duration %s must be positive", block.Duration)
+	}
+
+	location := time.UTC
+
+	if block.Timezone != "" {
+		location, err = time.LoadLocation(block.Timezone)
+
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load timezone %s: %v", block.Timezone, err)
+		}
+	}
+
+	return &ScheduledWindow{Schedule: schedule, Duration: duration, Location: location}, nil
+}
+
+// Checks all scheduled blocks from configuration
+func validate_scheduled_blocks(blocks []ScheduledCountryBlock) error {
+	for index, block := range blocks {
+		if len(block.Countries) == 0 {
+			return fmt.Errorf("Scheduled block %s does not have countries", get_scheduled_block_name(index, block))
+		}
+
+		_, err := parse_scheduled_window(block)
+
+		if err != nil {
+			return fmt.Errorf("Scheduled block %s is invalid: %w", get_scheduled_block_name(index, block), err)
+		}
+	}
+
+	return nil
+}
+
+// Returns time when window which covers now started or zero time when we're outside of windows
+func get_active_window_start(window *ScheduledWindow, now time.Time) time.Time {
+	// Window is active when it started no earlier than duration ago
+	window_start := window.Schedule.Next(now.Add(-window.Duration).In(window.Location))
+
+	if window_start.After(now) {
+		return time.Time{}
+	}
+
+	return window_start
+}
+
+func is_scheduled_block_active(block ScheduledCountryBlock, now time.Time) bool {
+	if block.ExpiresAt != nil && !now.Before(*block.ExpiresAt) {
+		return false
+	}
+
+	window, err := parse_scheduled_window(block)
+
+	if err != nil {
+		// We validate configuration on load and do not expect it here
+		slog.Error("Cannot parse scheduled block", "error", err)
+		return false
+	}
+
+	if window == nil {
+		return true
+	}
+
+	return !get_active_window_start(window, now).IsZero()
+}
+
+// Returns countries from scheduled blocks for profile which are active now
+func get_active_scheduled_countries(now time.Time, profile_name string) []string {
+	scheduled_blocks_state_mutex.Lock()
+	defer scheduled_blocks_state_mutex.Unlock()
+
+	countries := []string{}
+
+	for index, block := range conf.ScheduledCountryBlocks {
+		name := get_scheduled_block_name(index, block)
+
+		active := is_scheduled_block_active(block, now)
+
+		previous_state, known := scheduled_blocks_state[name]
+
+		if !known || previous_state != active {
+			if active {
+				slog.Info("Scheduled block is active", "name", name, "country", block.Countries, "action", "block")
+			} else if block.ExpiresAt != nil && !now.Before(*block.ExpiresAt) {
+				slog.Info("Scheduled block expired", "name", name, "country", block.Countries, "action", "withdraw", "expires_at", *block.ExpiresAt)
+			} else {
+				slog.Info("Scheduled block is outside of active window", "name", name, "country", block.Countries, "action", "withdraw")
+			}
+		}
+
+		scheduled_blocks_state[name] = active
+
+		if active && (block.Profile == "" || block.Profile == profile_name) {
+			countries = append(countries, block.Countries...)
+		}
+	}
+
+	return countries
+}
+
+// Returns time when some scheduled block or override changes state or zero time when we do not expect changes
+func get_next_schedule_change(now time.Time) time.Time {
+	next_change := time.Time{}
+
+	update_next_change := func(change time.Time) {
+		if change.After(now) && (next_change.IsZero() || change.Before(next_change)) {
+			next_change = change
+		}
+	}
+
+	for _, block := range conf.ScheduledCountryBlocks {
+		if block.ExpiresAt != nil {
+			update_next_change(*block.ExpiresAt)
+		}
+
+		window, err := parse_scheduled_window(block)
+
+		if err != nil || window == nil {
+			continue
+		}
+
+		update_next_change(window.Schedule.Next(now.In(window.Location)))
+
+		window_start := get_active_window_start(window, now)
+
+		if !window_start.IsZero() {
+			update_next_change(window_start.Add(window.Duration))
+		}
+	}
+
+	overrides, err := load_overrides()
+
+	if err != nil {
+		slog.Warn("Cannot load overrides to check their expiration", "error", err)
+		return next_change
+	}
+
+	for _, entry := range append(overrides.Allow, overrides.Block...) {
+		if entry.ExpiresAt != nil {
+			update_next_change(*entry.ExpiresAt)
+		}
+	}
+
+	return next_change
+}
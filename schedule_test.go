@@ -0,0 +1,133 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// Working hours in Tokyo, from 00:00 till 08:00 UTC on weekdays
+var test_scheduled_block = ScheduledCountryBlock{
+	Countries: []string{"KI"},
+	Schedule:  "0 9 * * 1-5",
+	Duration:  "8h",
+	Timezone:  "Asia/Tokyo",
+}
+
+func TestParseScheduledWindow(t *testing.T) {
+	window, err := parse_scheduled_window(ScheduledCountryBlock{Countries: []string{"KI"}})
+
+	if err != nil || window != nil {
+		t.Fatalf("Entry without schedule is always active: %v %v", window, err)
+	}
+
+	window, err = parse_scheduled_window(test_scheduled_block)
+
+	if err != nil {
+		t.Fatalf("Cannot parse window: %v", err)
+	}
+
+	if window.Duration != 8*time.Hour || window.Location.String() != "Asia/Tokyo" {
+		t.Errorf("Unexpected window: %+v", window)
+	}
+
+	broken_blocks := []ScheduledCountryBlock{
+		{Duration: "1h"},
+		{Timezone: "UTC"},
+		{Schedule: "0 9 * *", Duration: "1h"},
+		{Schedule: "0 9 * * *"},
+		{Schedule: "0 9 * * *", Duration: "9 hours"},
+		{Schedule: "0 9 * * *", Duration: "-1h"},
+		{Schedule: "0 9 * * *", Duration: "1h", Timezone: "Mars/Olympus"},
+	}
+
+	for _, block := range broken_blocks {
+		if _, err := parse_scheduled_window(block); err == nil {
+			t.Errorf("We must reject scheduled block %+v", block)
+		}
+	}
+}
+
+func TestScheduledBlockWindows(t *testing.T) {
+	expires_at := time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)
+
+	block := test_scheduled_block
+	block.ExpiresAt = &expires_at
+
+	states := []struct {
+		now    time.Time
+		active bool
+	}{
+		// Monday
+		{time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC), true},
+		{time.Date(2026, 10, 19, 7, 59, 0, 0, time.UTC), true},
+		{time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC), false},
+		// Sunday
+		{time.Date(2026, 10, 18, 3, 0, 0, 0, time.UTC), false},
+		// Window of Tuesday starts right at expiration
+		{time.Date(2026, 10, 20, 3, 0, 0, 0, time.UTC), false},
+	}
+
+	for _, state := range states {
+		if active := is_scheduled_block_active(block, state.now); active != state.active {
+			t.Errorf("Unexpected state of block at %s: %v", state.now.Format(time.RFC3339), active)
+		}
+	}
+}
+
+func TestActiveScheduledBlocks(t *testing.T) {
+	start_test_environment(t, test_networks, map[string]any{
+		"country_block_list":       []string{"TV"},
+		"scheduled_country_blocks": []ScheduledCountryBlock{test_scheduled_block, {Name: "always", Countries: []string{"nr"}}},
+	})
+
+	monday := time.Date(2026, 10, 19, 3, 0, 0, 0, time.UTC)
+
+	if countries := get_active_scheduled_countries(monday, default_profile_name); !slices.Equal(countries, []string{"KI", "NR"}) {
+		t.Errorf("Unexpected countries inside window: %v", countries)
+	}
+
+	if countries := get_active_scheduled_countries(monday.Add(6*time.Hour), default_profile_name); !slices.Equal(countries, []string{"NR"}) {
+		t.Errorf("Unexpected countries outside of window: %v", countries)
+	}
+
+	// Window closes at 08:00 UTC
+	if next_change := get_next_schedule_change(monday); !next_change.Equal(time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected next change inside window: %v", next_change)
+	}
+
+	// And opens again on Tuesday at 09:00 in Tokyo
+	if next_change := get_next_schedule_change(monday.Add(6 * time.Hour)); !next_change.Equal(time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected next change outside of window: %v", next_change)
+	}
+}
+
+func TestScheduledBlocksOfProfiles(t *testing.T) {
+	sanctions_block := test_scheduled_block
+	sanctions_block.Profile = "sanctions"
+
+	start_test_environment(t, test_networks, map[string]any{
+		"profiles":                 test_profiles,
+		"scheduled_country_blocks": []ScheduledCountryBlock{sanctions_block, {Name: "always", Countries: []string{"NR"}}},
+	})
+
+	monday := time.Date(2026, 10, 19, 3, 0, 0, 0, time.UTC)
+
+	if countries := get_active_scheduled_countries(monday, "sanctions"); !slices.Equal(countries, []string{"KI", "NR"}) {
+		t.Errorf("Unexpected countries of sanctions: %v", countries)
+	}
+
+	if countries := get_active_scheduled_countries(monday, "abuse"); !slices.Equal(countries, []string{"NR"}) {
+		t.Errorf("Unexpected countries of abuse: %v", countries)
+	}
+
+	// Window closes at 08:00 UTC
+	if next_change := get_next_schedule_change(monday); !next_change.Equal(time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected next change inside window: %v", next_change)
+	}
+
+	// And opens again on Tuesday at 09:00 in Tokyo
+	if next_change := get_next_schedule_change(monday.Add(6 * time.Hour)); !next_change.Equal(time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected next change outside of window: %v", next_change)
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"bitbucket.org/fastnetmon/country_lockdown/lockdown"
+)
+
+// BGP attributes which were used for announces
+type SnapshotAttributes struct {
+	NextHop     string   `json:"next_hop"`
+	Communities []string `json:"communities"`
+}
+
+// Block list which we successfully applied to gobgpd
+type Snapshot struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// What created this snapshot: sync, rollback, withdraw-all or shutdown
+	Reason string `json:"reason"`
+
+	// Every profile has own snapshots, older snapshots without it belong to default profile
+	Profile string `json:"profile,omitempty"`
+
+	// Marker of our routes, we use it to find routes of removed profiles and old markers
+	MarkerCommunity string `json:"marker_community,omitempty"`
+
+	ConfigHash        string `json:"config_hash"`
+	GeoIPBuildEpoch   uint   `json:"geoip_build_epoch"`
+	GeoIPDatabaseType string `json:"geoip_database_type"`
+
+	Attributes SnapshotAttributes `json:"attributes"`
+	Prefixes   []string           `json:"prefixes"`
+
+	// Version which we applied with rollback, next rollback continues from it
+	RollbackTo int `json:"rollback_to,omitempty"`
+}
+
+// Checks that snapshots have same prefixes, marker and attributes
+func is_same_snapshot_state(a *Snapshot, b *Snapshot) bool {
+	return slices.Equal(a.Prefixes, b.Prefixes) &&
+		a.MarkerCommunity == b.MarkerCommunity &&
+		a.Attributes.NextHop == b.Attributes.NextHop &&
+		slices.Equal(a.Attributes.Communities, b.Attributes.Communities)
+}
+
+// Prepares snapshot for block list with attributes of profile
+func build_snapshot(profile BlockingProfile, block_list *lockdown.Result, reason string) Snapshot {
+	prefixes := []string{}
+
+	for _, prefix := range block_list.Prefixes {
+		prefixes = append(prefixes, prefix.String())
+	}
+
+	return Snapshot{
+		CreatedAt:         time.Now().UTC(),
+		Reason:            reason,
+		Profile:           profile.Name,
+		MarkerCommunity:   profile.MarkerCommunity,
+		ConfigHash:        conf_file_hash,
+		GeoIPBuildEpoch:   block_list.Diagnostics.GeoIPBuildEpoch,
+		GeoIPDatabaseType: block_list.Diagnostics.GeoIPDatabaseType,
+		Attributes: SnapshotAttributes{
+			NextHop:     profile.BGPIPv4NextHop,
+			Communities: profile.BGPIPv4Communities,
+		},
+		Prefixes: prefixes,
+	}
+}
+
+func get_snapshots_path() string {
+	return filepath.Join(conf.StateDir, "snapshots")
+}
+
+func get_snapshot_file_path(version int) string {
+	return filepath.Join(get_snapshots_path(), fmt.Sprintf("snapshot-%06d.json", version))
+}
+
+// Returns versions of all snapshots in ascending order
+func list_snapshot_versions() ([]int, error) {
+	entries, err := os.ReadDir(get_snapshots_path())
+
+	if os.IsNotExist(err) {
+		return []int{}, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list snapshots: %w", err)
+	}
+
+	versions := []int{}
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		if !strings.HasPrefix(name, "snapshot-") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		version, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "snapshot-"), ".json"))
+
+		if err != nil {
+			continue
+		}
+
+		versions = append(versions, version)
+	}
+
+	sort.Ints(versions)
+
+	return versions, nil
+}
+
+// Saves snapshot with next version and removes oldest snapshots of same profile
+// We do not save snapshot when prefixes and attributes did not change since latest snapshot of profile and return version of latest one
+func save_snapshot(snapshot Snapshot) (int, bool, error) {
+	err := os.MkdirAll(get_snapshots_path(), 0755)
+
+	if err != nil {
+		return 0, false, fmt.Errorf("Cannot create snapshots folder: %w", err)
+	}
+
+	profile_versions, err := list_profile_snapshot_versions(snapshot.Profile)
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	if len(profile_versions) > 0 {
+		latest_version := profile_versions[len(profile_versions)-1]
+
+		latest_snapshot, err := load_snapshot(latest_version)
+
+		if err == nil && is_same_snapshot_state(latest_snapshot, &snapshot) {
+			return latest_version, false, nil
+		}
+	}
+
+	versions, err := list_snapshot_versions()
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	snapshot.Version = 1
+
+	if len(versions) > 0 {
+		snapshot.Version = versions[len(versions)-1] + 1
+	}
+
+	snapshot_as_json, err := json.MarshalIndent(snapshot, "", "    ")
+
+	if err != nil {
+		return 0, false, fmt.Errorf("Cannot encode snapshot: %w", err)
+	}
+
+	snapshot_path := get_snapshot_file_path(snapshot.Version)
+
+	// We write into temporary file and rename it to avoid partially written snapshots
+	err = os.WriteFile(snapshot_path+".tmp", snapshot_as_json, 0644)
+
+	if err != nil {
+		return 0, false, fmt.Errorf("Cannot write snapshot: %w", err)
+	}
+
+	err = os.Rename(snapshot_path+".tmp", snapshot_path)
+
+	if err != nil {
+		return 0, false, fmt.Errorf("Cannot write snapshot: %w", err)
+	}
+
+	// Every profile keeps own history and busy profile does not evict snapshots of quiet one
+	profile_versions = append(profile_versions, snapshot.Version)
+
+	for len(profile_versions) > int(conf.SnapshotsToKeep) {
+		err = os.Remove(get_snapshot_file_path(profile_versions[0]))
+
+		if err != nil {
+			slog.Warn("Cannot remove old snapshot", "version", profile_versions[0], "error", err)
+		}
+
+		profile_versions = profile_versions[1:]
+	}
+
+	return snapshot.Version, true, nil
+}
+
+// Returns newest snapshot of profile with prefixes or attributes which differ from latest one
+// After rollback we search before snapshot which we rolled back to, so repeated rollback goes further back instead of toggling
+func find_rollback_version(profile_name string) (int, error) {
+	profile_versions, err := list_profile_snapshot_versions(profile_name)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if len(profile_versions) == 0 {
+		return 0, fmt.Errorf("We do not have any snapshots of profile %s", profile_name)
+	}
+
+	latest_snapshot, err := load_snapshot(profile_versions[len(profile_versions)-1])
+
+	if err != nil {
+		return 0, err
+	}
+
+	start := len(profile_versions) - 1
+
+	if latest_snapshot.RollbackTo != 0 {
+		if index := slices.Index(profile_versions, latest_snapshot.RollbackTo); index >= 0 {
+			start = index
+		}
+	}
+
+	for i := start - 1; i >= 0; i-- {
+		snapshot, err := load_snapshot(profile_versions[i])
+
+		if err != nil {
+			slog.Warn("Cannot load snapshot", "version", profile_versions[i], "error", err)
+			continue
+		}
+
+		if !is_same_snapshot_state(snapshot, latest_snapshot) {
+			return snapshot.Version, nil
+		}
+	}
+
+	return 0, fmt.Errorf("We do not have older snapshot of profile %s which differs from applied block list", profile_name)
+}
+
+// Returns versions of snapshots which belong to profile in ascending order
+func list_profile_snapshot_versions(profile_name string) ([]int, error) {
+	versions, err := list_snapshot_versions()
+
+	if err != nil {
+		return nil, err
+	}
+
+	profile_versions := []int{}
+
+	for _, version := range versions {
+		snapshot, err := load_snapshot(version)
+
+		if err != nil {
+			slog.Warn("Cannot load snapshot", "version", version, "error", err)
+			continue
+		}
+
+		if snapshot.Profile == profile_name {
+			profile_versions = append(profile_versions, version)
+		}
+	}
+
+	return profile_versions, nil
+}
+
+func load_snapshot(version int) (*Snapshot, error) {
+	snapshot_as_json, err := os.ReadFile(get_snapshot_file_path(version))
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read snapshot %d: %w", version, err)
+	}
+
+	snapshot := Snapshot{}
+
+	err = json.Unmarshal(snapshot_as_json, &snapshot)
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot decode snapshot %d: %w", version, err)
+	}
+
+	if snapshot.Profile == "" {
+		snapshot.Profile = default_profile_name
+	}
+
+	return &snapshot, nil
+}
+
+// Prints short information about all snapshots
+func print_snapshots() error {
+	versions, err := list_snapshot_versions()
+
+	if err != nil {
+		return err
+	}
+
+	if len(versions) == 0 {
+		fmt.Printf("We do not have any snapshots in %s\n", get_snapshots_path())
+		return nil
+	}
+
+	for _, version := range versions {
+		snapshot, err := load_snapshot(version)
+
+		if err != nil {
+			slog.Warn("Cannot load snapshot", "version", version, "error", err)
+			continue
+		}
+
+		fmt.Printf("%6d  %s  %-12s  %-14s  %6d prefixes  %s build %s  config %.12s\n",
+			snapshot.Version,
+			snapshot.CreatedAt.Format(time.RFC3339),
+			snapshot.Profile,
+			snapshot.Reason,
+			len(snapshot.Prefixes),
+			snapshot.GeoIPDatabaseType,
+			time.Unix(int64(snapshot.GeoIPBuildEpoch), 0).UTC().Format("2006-01-02"),
+			snapshot.ConfigHash)
+	}
+
+	return nil
+}
+
+// Applies one of previous snapshots of profile to gobgpd. When version is zero we use snapshot before latest one
+func run_rollback(ctx context.Context, profile_name string, version int) error {
+	profile, err := get_blocking_profile(profile_name)
+
+	if err != nil {
+		return err
+	}
+
+	if version == 0 {
+		version, err = find_rollback_version(profile.Name)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	snapshot, err := load_snapshot(version)
+
+	if err != nil {
+		return err
+	}
+
+	if snapshot.Profile != profile.Name {
+		return fmt.Errorf("Snapshot %d belongs to profile %s, please use --profile %s", version, snapshot.Profile, snapshot.Profile)
+	}
+
+	slog.Info("Rolling back to snapshot", "profile", profile.Name, "version", snapshot.Version, "created_at", snapshot.CreatedAt.Format(time.RFC3339), "prefixes", len(snapshot.Prefixes))
+
+	block_list := &lockdown.Result{
+		Diagnostics: lockdown.Diagnostics{
+			GeoIPBuildEpoch:   snapshot.GeoIPBuildEpoch,
+			GeoIPDatabaseType: snapshot.GeoIPDatabaseType,
+		},
+	}
+
+	for _, prefix_as_string := range snapshot.Prefixes {
+		prefix, err := netip.ParsePrefix(prefix_as_string)
+
+		if err != nil {
+			return fmt.Errorf("Cannot parse prefix %s from snapshot: %w", prefix_as_string, err)
+		}
+
+		block_list.Prefixes = append(block_list.Prefixes, prefix)
+	}
+
+	// We announce prefixes with same attributes as we used for this snapshot
+	profile.BGPIPv4NextHop = snapshot.Attributes.NextHop
+	profile.BGPIPv4Communities = snapshot.Attributes.Communities
+
+	_, err = apply_block_list(ctx, profile, block_list.Prefixes)
+
+	if err != nil {
+		return err
+	}
+
+	rollback_snapshot := build_snapshot(profile, block_list, fmt.Sprintf("rollback to %d", snapshot.Version))
+
+	// Snapshot belongs to configuration which was used to create original one
+	rollback_snapshot.ConfigHash = snapshot.ConfigHash
+	rollback_snapshot.RollbackTo = snapshot.Version
+
+	new_version, saved, err := save_snapshot(rollback_snapshot)
+
+	if err != nil {
+		return fmt.Errorf("Rollback was applied but we cannot save snapshot: %w", err)
+	}
+
+	log_saved_snapshot(profile.Name, new_version, saved)
+
+	slog.Warn("Running daemon recalculates block list on next sync and replaces this rollback, please stop it or fix configuration or GeoIP database before next sync")
+
+	return nil
+}
+
+func log_saved_snapshot(profile_name string, version int, saved bool) {
+	if !saved {
+		slog.Info("Block list did not change since latest snapshot", "profile", profile_name, "version", version)
+		return
+	}
+
+	slog.Info("Saved applied block list as snapshot", "profile", profile_name, "version", version)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestRollbackRestoresPreviousBlockLists(t *testing.T) {
+	env := start_test_environment(t, test_networks, map[string]any{
+		"country_block_list": []string{"TV"},
+	})
+
+	env.sync(t)
+
+	// Block list did not change and we must not save same snapshot again
+	env.sync(t)
+
+	versions, err := list_profile_snapshot_versions(default_profile_name)
+
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("Expected single snapshot after two same syncs: %v %v", versions, err)
+	}
+
+	for _, countries := range [][]string{{"TV", "NR"}, {"KI"}} {
+		env.configuration["country_block_list"] = countries
+		env.reload(t)
+		env.sync(t)
+	}
+
+	if prefixes := env.rib(t); !slices.Equal(prefixes, []netip.Prefix{netip.MustParsePrefix("10.0.2.0/24")}) {
+		t.Fatalf("Unexpected RIB before rollback: %v", prefixes)
+	}
+
+	// Every rollback steps further back instead of toggling between two latest block lists
+	for _, expected := range []netip.Prefix{netip.MustParsePrefix("10.0.0.0/23"), netip.MustParsePrefix("10.0.0.0/24")} {
+		err = run_rollback(context.Background(), default_profile_name, 0)
+
+		if err != nil {
+			t.Fatalf("Rollback failed: %v", err)
+		}
+
+		if prefixes := env.rib(t); !slices.Equal(prefixes, []netip.Prefix{expected}) {
+			t.Fatalf("Unexpected RIB after rollback: %v, expected %v", prefixes, expected)
+		}
+	}
+
+	if err := run_rollback(context.Background(), default_profile_name, 0); err == nil {
+		t.Errorf("We do not have older snapshots and rollback must fail")
+	}
+
+	versions, err = list_profile_snapshot_versions(default_profile_name)
+
+	if err != nil || len(versions) != 5 {
+		t.Fatalf("Expected snapshots of three syncs and two rollbacks: %v %v", versions, err)
+	}
+
+	snapshot, err := load_snapshot(versions[4])
+
+	if err != nil {
+		t.Fatalf("Cannot load snapshot: %v", err)
+	}
+
+	if snapshot.RollbackTo != versions[0] || snapshot.Reason != "rollback to 1" {
+		t.Errorf("Unexpected snapshot of rollback: %+v", snapshot)
+	}
+}
+
+func TestSyncWithdrawsRoutesOfRemovedProfile(t *testing.T) {
+	env := start_test_environment(t, test_networks, map[string]any{
+		"profiles": []map[string]any{
+			{"name": "sanctions", "marker_community": "65000:1", "country_block_list": []string{"TV"}},
+			{"name": "abuse", "marker_community": "65000:2", "country_block_list": []string{"KI"}},
+		},
+	})
+
+	env.sync(t)
+
+	env.configuration["profiles"] = []map[string]any{
+		{"name": "abuse", "marker_community": "65000:2", "country_block_list": []string{"KI"}},
+	}
+
+	env.reload(t)
+	env.sync(t)
+
+	if prefixes := env.rib(t); !slices.Equal(prefixes, []netip.Prefix{netip.MustParsePrefix("10.0.2.0/24")}) {
+		t.Fatalf("Routes of removed profile must be withdrawn: %v", prefixes)
+	}
+
+	withdrawn_markers, err := load_withdrawn_markers()
+
+	if err != nil {
+		t.Fatalf("Cannot load withdrawn markers: %v", err)
+	}
+
+	if _, ok := withdrawn_markers["65000:1"]; !ok || len(withdrawn_markers) != 1 {
+		t.Errorf("Unexpected withdrawn markers: %v", withdrawn_markers)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"bitbucket.org/fastnetmon/country_lockdown/blockset"
+	"bitbucket.org/fastnetmon/country_lockdown/geo"
+	"bitbucket.org/fastnetmon/country_lockdown/lockdown"
+)
+
+// What we would block with current configuration and databases
+type BlockListStats struct {
+	// Set only when we have profiles in configuration
+	Profile string `json:"profile,omitempty"`
+
+	Prefixes  int    `json:"prefixes"`
+	Addresses uint64 `json:"addresses"`
+
+	Countries map[string]blockset.Stats `json:"countries"`
+	ASNs      map[uint]blockset.Stats   `json:"asns,omitempty"`
+	Feeds     map[string]blockset.Stats `json:"feeds,omitempty"`
+
+	GeoIPOverrides []geo.OverrideUsage `json:"geoip_overrides,omitempty"`
+
+	GeoIPBuildEpoch   uint   `json:"geoip_build_epoch"`
+	GeoIPDatabaseType string `json:"geoip_database_type"`
+}
+
+// Calculates block lists for all profiles without talking to gobgpd and prints statistics for them
+// JSON output is always list of statistics, with single element when we do not have profiles in configuration
+func run_stats(ctx context.Context, format string) error {
+	if format != "table" && format != "json" {
+		return fmt.Errorf("Unknown format %s, please use table or json", format)
+	}
+
+	all_stats := []BlockListStats{}
+
+	for _, profile := range get_blocking_profiles() {
+		block_list, err := compute_block_list(ctx, profile)
+
+		if err != nil {
+			return err
+		}
+
+		stats := get_block_list_stats(block_list)
+
+		if len(conf.Profiles) > 0 {
+			stats.Profile = profile.Name
+		}
+
+		all_stats = append(all_stats, stats)
+	}
+
+	if format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "    ")
+
+		return encoder.Encode(all_stats)
+	}
+
+	for index, stats := range all_stats {
+		if index > 0 {
+			fmt.Println()
+		}
+
+		print_block_list_stats(stats)
+	}
+
+	return nil
+}
+
+func get_block_list_stats(block_list *lockdown.Result) BlockListStats {
+	return BlockListStats{
+		Prefixes:          len(block_list.Prefixes),
+		Addresses:         blockset.CountAddresses(block_list.Prefixes),
+		Countries:         block_list.Countries,
+		ASNs:              block_list.ASNs,
+		Feeds:             block_list.Feeds,
+		GeoIPOverrides:    block_list.Diagnostics.GeoIPOverrides,
+		GeoIPBuildEpoch:   block_list.Diagnostics.GeoIPBuildEpoch,
+		GeoIPDatabaseType: block_list.Diagnostics.GeoIPDatabaseType,
+	}
+}
+
+func print_block_list_stats(stats BlockListStats) {
+	if stats.Profile != "" {
+		fmt.Printf("Profile:        %s\n", stats.Profile)
+	}
+
+	fmt.Printf("GeoIP database: %s built %d\n", stats.GeoIPDatabaseType, stats.GeoIPBuildEpoch)
+	fmt.Printf("Block list:     %d prefixes %d addresses\n\n", stats.Prefixes, stats.Addresses)
+
+	country_codes := []string{}
+
+	for country_code := range stats.Countries {
+		country_codes = append(country_codes, country_code)
+	}
+
+	sort.Strings(country_codes)
+
+	fmt.Printf("%-10s %12s %16s\n", "Country", "Prefixes", "Addresses")
+
+	for _, country_code := range country_codes {
+		fmt.Printf("%-10s %12d %16d\n", country_code, stats.Countries[country_code].Prefixes, stats.Countries[country_code].Addresses)
+	}
+
+	if len(stats.ASNs) > 0 {
+		asns := []uint{}
+
+		for asn := range stats.ASNs {
+			asns = append(asns, asn)
+		}
+
+		sort.Slice(asns, func(i, j int) bool { return asns[i] < asns[j] })
+
+		fmt.Printf("\n%-10s %12s %16s\n", "ASN", "Prefixes", "Addresses")
+
+		for _, asn := range asns {
+			fmt.Printf("%-10s %12d %16d\n", fmt.Sprintf("AS%d", asn), stats.ASNs[asn].Prefixes, stats.ASNs[asn].Addresses)
+		}
+	}
+
+	if len(stats.Feeds) > 0 {
+		feed_names := []string{}
+
+		for feed_name := range stats.Feeds {
+			feed_names = append(feed_names, feed_name)
+		}
+
+		sort.Strings(feed_names)
+
+		fmt.Printf("\n%-20s %12s %16s\n", "Feed", "Prefixes", "Addresses")
+
+		for _, feed_name := range feed_names {
+			fmt.Printf("%-20s %12d %16d\n", feed_name, stats.Feeds[feed_name].Prefixes, stats.Feeds[feed_name].Addresses)
+		}
+	}
+
+	if len(stats.GeoIPOverrides) > 0 {
+		fmt.Printf("\nGeoIP overrides used:\n")
+
+		for _, usage := range stats.GeoIPOverrides {
+			fmt.Printf("  %s moved %d addresses to %s from %s%s\n", usage.Override.Prefix, usage.Addresses,
+				usage.Override.Country, format_country_code(usage.FromCountry), format_geoip_override_comment(usage.Override))
+		}
+	}
+}
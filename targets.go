@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+
+	"google.golang.org/grpc"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+
+	"bitbucket.org/fastnetmon/country_lockdown/announcer"
+	"bitbucket.org/fastnetmon/country_lockdown/reconciler"
+)
+
+// gobgpd instance where we keep our announces
+type GoBGPTarget struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+
+	// Overrides bgp_ipv4_next_hop for this target
+	NextHop string `json:"next_hop"`
+
+	// Overrides gobgp_api_tls for this target
+	TLS *GoBGPTLSConfiguration `json:"tls"`
+}
+
+// Outcome of sync for single target
+type TargetSyncResult struct {
+	Target    string
+	Announced int
+	Updated   int
+	Withdrawn int
+	Skipped   int
+	Failed    int
+	Err       error
+}
+
+// Returns list of targets for profile, single gobgp_api_host is used when list is empty
+func get_gobgp_targets(profile BlockingProfile) []GoBGPTarget {
+	if len(profile.GoBGPTargets) == 0 {
+		return []GoBGPTarget{{Name: conf.GoBGPApiAddress, Address: conf.GoBGPApiAddress}}
+	}
+
+	targets := []GoBGPTarget{}
+
+	for _, target := range profile.GoBGPTargets {
+		if target.Name == "" {
+			target.Name = target.Address
+		}
+
+		targets = append(targets, target)
+	}
+
+	return targets
+}
+
+// Syncs announces of profile in single gobgpd instance with block list of profile
+func sync_target(ctx context.Context, profile BlockingProfile, target GoBGPTarget, prefixes_to_block []netip.Prefix) TargetSyncResult {
+	result := TargetSyncResult{Target: target.Name}
+
+	logger := slog.With("profile", profile.Name, "target", target.Name)
+
+	next_hop, err := get_target_next_hop(logger, profile, target)
+
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	conn, err := connect_to_target(target)
+
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	defer conn.Close()
+
+	logger.Debug("Will use GoBGP API", "address", target.Address)
+
+	gobgp_client := apipb.NewGobgpApiClient(conn)
+
+	if conf.MetricsListenAddress != "" {
+		peers, err := list_bgp_peers(ctx, gobgp_client)
+
+		if err != nil {
+			logger.Warn("Cannot list peers for metrics", "error", describe_gobgp_error(target.Address, err))
+		} else {
+			update_peer_metrics(target.Name, peers)
+		}
+	}
+
+	// Addresses of peers which passed pre-flight check
+	healthy_peers := []string{}
+
+	var preflight_err error
+
+	if conf.BGPHealthCheck.Enabled {
+		healthy_peers, err = check_bgp_peers(ctx, logger, gobgp_client, conf.BGPHealthCheck, prefixes_to_block)
+
+		if err != nil {
+			preflight_err = fmt.Errorf("BGP pre-flight check failed: %w", describe_gobgp_error(target.Address, err))
+
+			if conf.BGPHealthCheck.AbortOnFailure {
+				// We do not know if we can load announces and must not report gobgpd as up from previous run
+				metric_gobgp_up.WithLabelValues(target.Name).Set(0)
+				result.Err = preflight_err
+				return result
+			}
+
+			// We still announce prefixes to gobgpd and they will reach peers when sessions recover
+			logger.Warn("Continue sync despite failed pre-flight check", "error", preflight_err)
+		}
+	}
+
+	if conf.L3VPN.Enabled && conf.L3VPN.VRF != "" {
+		l3vpn_attributes, err := parse_l3vpn_attributes(conf.L3VPN)
+
+		if err != nil {
+			result.Err = err
+			return result
+		}
+
+		err = ensure_vrf(ctx, gobgp_client, conf.L3VPN, l3vpn_attributes)
+
+		if err != nil {
+			result.Err = describe_gobgp_error(target.Address, err)
+			return result
+		}
+	}
+
+	attributes, err := get_announcer_attributes(profile, next_hop)
+
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	gobgp_announcer := announcer.NewGoBGP(gobgp_client, attributes)
+
+	logger.Debug("Load all active announces")
+	active_announces, err := gobgp_announcer.ListAnnounced(ctx)
+
+	if err != nil {
+		metric_gobgp_up.WithLabelValues(target.Name).Set(0)
+		result.Err = fmt.Errorf("Cannot load announces: %w", describe_gobgp_error(target.Address, err))
+		return result
+	}
+
+	metric_gobgp_up.WithLabelValues(target.Name).Set(1)
+
+	logger.Info("Loaded active announces", "prefixes", len(active_announces))
+
+	logger.Debug("Active announces", "prefix_list", active_announces)
+
+	reconcile_result, err := reconciler.Apply(ctx, logger, gobgp_announcer, reconciler.NewPlan(active_announces, prefixes_to_block))
+
+	result.Announced = reconcile_result.Announced
+	result.Updated = reconcile_result.Updated
+	result.Withdrawn = reconcile_result.Withdrawn
+	result.Skipped = reconcile_result.Unchanged
+	result.Failed = reconcile_result.Failed
+
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	if conf.BGPHealthCheck.Enabled && conf.BGPHealthCheck.CheckAdjOut {
+		err = check_adj_out(ctx, logger, gobgp_client, healthy_peers, prefixes_to_block)
+
+		if err != nil {
+			result.Err = fmt.Errorf("BGP post-sync check failed: %w", describe_gobgp_error(target.Address, err))
+			return result
+		}
+	}
+
+	result.Err = preflight_err
+
+	return result
+}
+
+// Returns next hop of target or profile
+func get_target_next_hop(logger *slog.Logger, profile BlockingProfile, target GoBGPTarget) (netip.Addr, error) {
+	next_hop_as_string := profile.BGPIPv4NextHop
+
+	if target.NextHop != "" {
+		next_hop_as_string = target.NextHop
+	}
+
+	if next_hop_as_string == "" {
+		return netip.Addr{}, fmt.Errorf("BGP IPv4 next hop is empty")
+	}
+
+	next_hop, err := netip.ParseAddr(next_hop_as_string)
+
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("Cannot parse BGP IPv4 next hop %s: %v", next_hop_as_string, err)
+	}
+
+	if !next_hop.Is4() {
+		logger.Warn("Next hop must be IPv4 address", "next_hop", next_hop)
+	}
+
+	logger.Debug("Will use next hop", "next_hop", next_hop)
+
+	return next_hop, nil
+}
+
+// Connects to gobgpd of target with TLS settings of target
+func connect_to_target(target GoBGPTarget) (*grpc.ClientConn, error) {
+	if target.Address == "" {
+		return nil, fmt.Errorf("Address for target is not set")
+	}
+
+	tls_conf := conf.GoBGPApiTLS
+
+	if target.TLS != nil {
+		tls_conf = *target.TLS
+	}
+
+	return connect_to_gobgp(target.Address, tls_conf, conf.GoBGPApiTimeout, *conf.GoBGPApiRetries)
+}
+
+// Returns attributes which we add to announces of profile
+func get_announcer_attributes(profile BlockingProfile, next_hop netip.Addr) (announcer.Attributes, error) {
+	attributes := announcer.Attributes{
+		NextHop: next_hop,
+		Marker:  get_profile_marker(profile),
+	}
+
+	for _, bgp_community_as_string := range profile.BGPIPv4Communities {
+		community_as_uint32, err := parse_community(bgp_community_as_string)
+
+		if err != nil {
+			slog.Warn("Cannot parse community", "community", bgp_community_as_string, "error", err)
+			continue
+		}
+
+		attributes.Communities = append(attributes.Communities, community_as_uint32)
+	}
+
+	l3vpn_attributes, err := get_configured_l3vpn()
+
+	if err != nil {
+		return attributes, err
+	}
+
+	attributes.L3VPN = l3vpn_attributes
+
+	return attributes, nil
+}
+
+// Reports results for all targets and decides if whole run failed
+func check_target_results(profile_name string, results []TargetSyncResult, failure_policy string) error {
+	failed_targets := 0
+
+	for _, result := range results {
+		if result.Err != nil {
+			failed_targets++
+			slog.Error("Target failed", "profile", profile_name, "target", result.Target, "error", result.Err,
+				"announced", result.Announced, "updated", result.Updated, "withdrawn", result.Withdrawn, "unchanged", result.Skipped, "failed", result.Failed)
+			continue
+		}
+
+		slog.Info("Target synced", "profile", profile_name, "target", result.Target,
+			"announced", result.Announced, "updated", result.Updated, "withdrawn", result.Withdrawn, "unchanged", result.Skipped)
+	}
+
+	if failed_targets == 0 {
+		return nil
+	}
+
+	if failed_targets == len(results) {
+		return fmt.Errorf("All %d targets failed", len(results))
+	}
+
+	if failure_policy == "degraded" {
+		slog.Warn("Running in degraded mode", "profile", profile_name, "failed_targets", failed_targets, "targets", len(results))
+		return nil
+	}
+
+	return fmt.Errorf("%d of %d targets failed", failed_targets, len(results))
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+
+	"bitbucket.org/fastnetmon/country_lockdown/announcer"
+	"bitbucket.org/fastnetmon/country_lockdown/lockdown"
+	"bitbucket.org/fastnetmon/country_lockdown/reconciler"
+)
+
+// Withdraws all our routes of every profile and routes of markers from snapshots which profiles do not use anymore from all targets
+// It's emergency action and we do not open GeoIP databases or calculate block list for it
+func run_withdraw_all(ctx context.Context, reason string) error {
+	failed_profiles := []string{}
+
+	for _, profile := range get_blocking_profiles() {
+		err := withdraw_profile(ctx, profile, reason)
+
+		if err != nil {
+			slog.Error("Cannot withdraw routes of profile", "profile", profile.Name, "error", err)
+			failed_profiles = append(failed_profiles, profile.Name)
+		}
+	}
+
+	// We check all old markers as we may not know about manual changes in gobgpd
+	err := withdraw_orphan_markers(ctx, false)
+
+	if err != nil {
+		slog.Error("Cannot withdraw routes of markers which do not belong to any profile", "error", err)
+
+		if len(failed_profiles) == 0 {
+			return err
+		}
+	}
+
+	if len(failed_profiles) > 0 {
+		return fmt.Errorf("Cannot withdraw routes of profiles %s", strings.Join(failed_profiles, ","))
+	}
+
+	return nil
+}
+
+// Withdraws routes of profile from all its targets and saves empty snapshot, rollback restores previous block list
+func withdraw_profile(ctx context.Context, profile BlockingProfile, reason string) error {
+	err := withdraw_from_targets(ctx, profile)
+
+	if err != nil {
+		return err
+	}
+
+	// Routes are gone already and we must not report failure only because of state directory
+	version, saved, err := save_snapshot(build_snapshot(profile, &lockdown.Result{}, reason))
+
+	if err != nil {
+		slog.Warn("Routes were withdrawn but we cannot save snapshot, rollback will not know about withdrawal", "profile", profile.Name, "error", err)
+		return nil
+	}
+
+	log_saved_snapshot(profile.Name, version, saved)
+
+	return nil
+}
+
+// Withdraws routes with marker of profile from all targets of profile in parallel
+func withdraw_from_targets(ctx context.Context, profile BlockingProfile) error {
+	targets := get_gobgp_targets(profile)
+
+	results := make([]TargetSyncResult, len(targets))
+
+	var wg sync.WaitGroup
+
+	for i, target := range targets {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			results[i] = withdraw_target(ctx, profile, target)
+		}()
+	}
+
+	wg.Wait()
+
+	failed_targets := 0
+
+	for _, result := range results {
+		if result.Err != nil {
+			failed_targets++
+			slog.Error("Cannot withdraw routes from target", "profile", profile.Name, "target", result.Target, "error", result.Err,
+				"withdrawn", result.Withdrawn, "failed", result.Failed)
+			continue
+		}
+
+		slog.Info("Withdrew all routes from target", "profile", profile.Name, "target", result.Target, "withdrawn", result.Withdrawn)
+	}
+
+	// We do not accept degraded mode here as routes stay in some of gobgpd instances
+	if failed_targets > 0 {
+		return fmt.Errorf("Failed %d of %d targets", failed_targets, len(targets))
+	}
+
+	return nil
+}
+
+// Withdraws all routes with marker of profile from single gobgpd instance
+func withdraw_target(ctx context.Context, profile BlockingProfile, target GoBGPTarget) TargetSyncResult {
+	result := TargetSyncResult{Target: target.Name}
+
+	logger := slog.With("profile", profile.Name, "target", target.Name)
+
+	// Withdrawal needs only prefix and marker, route distinguisher too for VPN table
+	// We do not check next hop or communities as broken attributes must not block emergency withdrawal
+	l3vpn_attributes, err := get_configured_l3vpn()
+
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	conn, err := connect_to_target(target)
+
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	defer conn.Close()
+
+	attributes := announcer.Attributes{Marker: get_profile_marker(profile), L3VPN: l3vpn_attributes}
+
+	gobgp_announcer := announcer.NewGoBGP(apipb.NewGobgpApiClient(conn), attributes)
+
+	active_announces, err := gobgp_announcer.ListAnnounced(ctx)
+
+	if err != nil {
+		result.Err = fmt.Errorf("Cannot load announces: %w", describe_gobgp_error(target.Address, err))
+		return result
+	}
+
+	logger.Info("Loaded active announces", "prefixes", len(active_announces))
+
+	// Plan with empty block list withdraws everything we own
+	reconcile_result, err := reconciler.Apply(ctx, logger, gobgp_announcer, reconciler.NewPlan(active_announces, nil))
+
+	result.Withdrawn = reconcile_result.Withdrawn
+	result.Failed = reconcile_result.Failed
+	result.Err = err
+
+	return result
+}